@@ -0,0 +1,21 @@
+// SPDX-License-Identifier: MIT
+pragma solidity 0.8.24;
+
+// FileShareLedger holds the ledger records of blockchain-fileshare on an EVM chain. A record is the encoded, signed
+// transaction data exactly as the built-in ledger stores it, its ID is the sha256 of those bytes. Records only live in
+// the event log, the contract keeps no more than the block each ID was recorded in so a record can't be added twice.
+// Signatures are RSA and are checked by the Go side on the way in and on the way out, not here.
+contract FileShareLedger {
+    event TransactionRecorded(bytes32 indexed id, bytes data);
+
+    mapping(bytes32 => uint256) public recordedAt;
+    uint256 public transactionCount;
+
+    function record(bytes32 id, bytes calldata data) external {
+        require(recordedAt[id] == 0, "transaction is already on the ledger");
+        require(sha256(data) == id, "transaction ID does not match its data");
+        recordedAt[id] = block.number;
+        transactionCount += 1;
+        emit TransactionRecorded(id, data);
+    }
+}
@@ -0,0 +1,88 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the reasons a download can be denied, check for them with errors.Is
+var (
+	ErrNotMember          = errors.New("user is not a member of the group")
+	ErrUnknownTransaction = errors.New("could not locate transaction")
+	ErrNotAFile           = errors.New("transaction is not a file record")
+	ErrWrongGroup         = errors.New("file belongs to another group")
+	ErrHandleMismatch     = errors.New("requested IPFS handle is not the one on the ledger")
+	ErrSuperseded         = errors.New("file has been replaced by a newer version")
+	ErrFileDeleted        = errors.New("file has been deleted")
+	ErrPolicyDenied       = errors.New("download denied by the group policy")
+	ErrStaleRequest       = errors.New("download request is expired or not valid yet")
+	ErrReplayedRequest    = errors.New("download request has already been used")
+	ErrTooManyRequests    = errors.New("too many download requests in flight, try again later")
+)
+
+// DownloadDeniedError is what the proxy returns when it refuses a download. Reason is one of the Err* values above,
+// the message is the more specific one from the ledger or the policy when there is one.
+type DownloadDeniedError struct {
+	Reason        error
+	UserId        string
+	GroupId       string
+	TransactionId string
+	cause         error
+}
+
+func (e *DownloadDeniedError) Error() string {
+	if e.cause != nil {
+		return e.cause.Error()
+	}
+	return e.Reason.Error()
+}
+
+func (e *DownloadDeniedError) Unwrap() []error {
+	if e.cause != nil {
+		return []error{e.Reason, e.cause}
+	}
+	return []error{e.Reason}
+}
+
+func denyDownload(reason error, userId string, groupId string, transactionId string) *DownloadDeniedError {
+	return &DownloadDeniedError{Reason: reason, UserId: userId, GroupId: groupId, TransactionId: transactionId}
+}
+
+// AuthorizeDownload checks a download of transactionId by userId in groupId against the proxy's membership list and
+// the ledger record itself and returns that record. The record has to be a file of that group and the current
+// version of it, callers holding an older ID resolve it with the ledger's ResolveLatestTransaction first.
+func (proxy IPFSProxy) AuthorizeDownload(userId string, groupId string, transactionId string) (Data, error) {
+	if _, err := proxy.getUserPublicKey(groupId, userId); err != nil {
+		return Data{}, denyDownload(ErrNotMember, userId, groupId, transactionId)
+	}
+	if proxy.ledger == nil {
+		return Data{}, &proxyFailure{errors.New("proxy is not connected to a ledger")}
+	}
+
+	record, err := proxy.ledger.GetTransactionByHash(transactionId)
+	if err != nil {
+		denial := denyDownload(ErrUnknownTransaction, userId, groupId, transactionId)
+		denial.cause = err
+		return Data{}, denial
+	}
+	if !isFileRecord(record) {
+		return Data{}, denyDownload(ErrNotAFile, userId, groupId, transactionId)
+	}
+	if record.groupId != groupId {
+		return Data{}, denyDownload(ErrWrongGroup, userId, groupId, transactionId)
+	}
+
+	latest, err := proxy.ledger.ResolveLatestTransaction(transactionId)
+	if errors.Is(err, ErrFileDeleted) {
+		return Data{}, denyDownload(ErrFileDeleted, userId, groupId, transactionId)
+	}
+	if err != nil {
+		return Data{}, &proxyFailure{err} //the record itself was found, the ledger failed following it
+	}
+	if latest != transactionId {
+		denial := denyDownload(ErrSuperseded, userId, groupId, transactionId)
+		denial.cause = fmt.Errorf("file has been replaced by transaction %s", latest)
+		return Data{}, denial
+	}
+	return record, nil
+}
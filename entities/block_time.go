@@ -0,0 +1,27 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+// Block timestamps never go backwards along the chain. Time range queries (sequenceRange) binary search the blocks by
+// timestamp and an out of turn seal is timed from the previous block, so this is a rule of the chain every node checks
+// (checkBlockTime) rather than something sealers merely try to keep.
+
+// nextBlockTime is the timestamp for a block on top of tip: now, or tip's own timestamp when our clock is behind the
+// previous sealer's
+func nextBlockTime(tip BlockHeader) int64 {
+	timestamp := time.Now().UnixNano()
+	if timestamp < tip.Timestamp {
+		return tip.Timestamp
+	}
+	return timestamp
+}
+
+func checkBlockTime(header BlockHeader, prev BlockHeader) error {
+	if header.Timestamp < prev.Timestamp {
+		return fmt.Errorf("block %d: timestamp is earlier than block %d", header.Index, prev.Index)
+	}
+	return nil
+}
@@ -1,37 +1,608 @@
 package entities
 
 import (
+	"blockchain-fileshare/utils"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
-
-	"github.com/google/uuid"
+	"fmt"
+	"sync"
+	"time"
 )
 
 type Data struct {
-	userId   string
-	groupId  string
-	fileHash string
-	IPFSHash string
+	userId        string
+	groupId       string
+	fileHash      string
+	IPFSHash      string
 	fileExtension string
+	kind          TransactionKind
+	memberId      string   //who joined/left for membership records, the validator for validator set changes
+	groupKey      string   //fingerprint of the group public key for group creation and key rotation records
+	publicKey     []byte   //key of the validator being added
+	previousId    string   //for re-encryption records, the transaction ID of the file this one replaces, for deletions the one deleted
+	tags          []string //labels of a file that policies can refer to
+	policy        string   //policy source for policy records
+	fileKey       []byte   //for file records, the file's data key encrypted with the group public key
+	fileId        string   //for key release records, the transaction ID of the file version the key was released for
+	nonce         string   //for key release records, the nonce of the download request the key was released on
+	stale         bool     //for rekeyed file records, the ciphertext predates a member's removal (see RevocationMode)
+	createdAt     int64
+	signerKey     []byte //public key the signature was made with, so the chain can be re-verified without the proxy around
+	signature     []byte
+}
+
+// signingBytes gives a deterministic byte representation of everything the signer vouches for, every field is
+// length-prefixed so that moving bytes from one field to its neighbour changes the result
+func (d Data) signingBytes() []byte {
+	buf := []byte{}
+	for _, field := range []string{d.userId, d.groupId, d.fileHash, d.IPFSHash, d.fileExtension} {
+		buf = appendString(buf, field)
+	}
+	buf = binary.AppendUvarint(buf, uint64(d.kind))
+	buf = appendString(buf, d.memberId)
+	buf = appendString(buf, d.groupKey)
+	buf = appendString(buf, string(d.publicKey))
+	buf = appendString(buf, d.previousId)
+	buf = binary.AppendUvarint(buf, uint64(len(d.tags)))
+	for _, tag := range d.tags {
+		buf = appendString(buf, tag)
+	}
+	buf = appendString(buf, d.policy)
+	buf = appendString(buf, string(d.fileKey))
+	buf = appendString(buf, d.fileId)
+	buf = appendString(buf, d.nonce)
+	if d.stale {
+		buf = binary.AppendUvarint(buf, 1)
+	} else {
+		buf = binary.AppendUvarint(buf, 0)
+	}
+	buf = binary.AppendVarint(buf, d.createdAt)
+	buf = appendString(buf, string(d.signerKey))
+	return buf
+}
+
+func (d Data) encode() []byte {
+	return appendString(d.signingBytes(), string(d.signature))
+}
+
+func (d Data) hash() string {
+	sum := sha256.Sum256(d.encode())
+	return hex.EncodeToString(sum[:])
+}
+
+type Transaction struct {
+	ID     string //hex encoded sha256 of the transaction data, this is what UploadFile hands back to the users
+	Data   Data
+	Pruned bool //only the ID is left, Prune dropped the data because no live file needs it any more
+}
+
+type BlockHeader struct {
+	Index      int
+	Timestamp  int64
+	PrevHash   string
+	MerkleRoot string
+	Sealer     string //id of the validator that sealed the block, empty unless the chain runs proof of authority
+	Hash       string
+	Seal       []byte //the sealer's signature over Hash
+}
+
+func (h BlockHeader) computeHash() string {
+	buf := []byte{}
+	buf = binary.AppendUvarint(buf, uint64(h.Index))
+	buf = binary.AppendVarint(buf, h.Timestamp)
+	buf = appendString(buf, h.PrevHash)
+	buf = appendString(buf, h.MerkleRoot)
+	buf = appendString(buf, h.Sealer)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+type Block struct {
+	Header       BlockHeader
+	Transactions []Transaction
+}
+
+type txLocation struct {
+	block int
+	tx    int
 }
 
 type Blockchain struct {
-	blocks map[string]Data
+	mu     sync.RWMutex
+	blocks []Block
+	txs    map[string]txLocation //transaction ID -> where it lives in the chain, so lookups don't need to walk every block
+	index  *ledgerIndex          //secondary indexes behind Query
+	store  *segmentStore         //nil for a purely in-memory ledger
+
+	keyRegistry *IPFSProxy          //when set, signers must be using the public key the proxy has on file for them
+	observers   []func(Block)       //called with the chain lock held every time a block is appended
+	pending     []func(Transaction) //called with the chain lock held every time a transaction is left pending, see onPending
+
+	authority  *proofOfAuthority //nil unless EnableProofOfAuthority was called
+	validators []Validator       //validator set in effect for the next block
+	orphans    []Transaction     //transactions knocked off the chain by a fork switch, waiting for our turn to seal them back in
+	mempool    *mempool          //nil unless EnableMempool was called, then transactions are batched into blocks
+	sealTimer  *time.Timer       //set while orphans wait for this validator to be allowed to seal, see sealLater
+
+	changed    chan struct{} //closed and replaced whenever the chain changes, wakes up subscriptions
+	forkPoints []int         //block indexes fork switches rolled the chain back to, in order, that a subscription may not have seen yet
+	forkBase   int           //how many fork points came before forkPoints[0], they were trimmed once every subscription was past them
+	subs       map[*Subscription]bool
+
+	checkpoint *Checkpoint //nil on an archival ledger, otherwise nothing at or below it can change any more
+}
+
+// every ledger starts from the exact same genesis block so that two chains can be compared block by block
+func genesisBlock() Block {
+	header := BlockHeader{
+		Index:      0,
+		Timestamp:  0,
+		PrevHash:   "",
+		MerkleRoot: merkleRoot(nil),
+	}
+	header.Hash = header.computeHash()
+	return Block{Header: header, Transactions: []Transaction{}}
+}
+
+// newBlock builds the next block on top of the tip, under proof of authority it is also sealed (if it is our turn, or
+// the validator whose turn it is has let OUT_OF_TURN_SEAL_DELAY pass)
+func (b *Blockchain) newBlock(transactions []Transaction) (Block, error) {
+	tip := b.blocks[len(b.blocks)-1]
+	timestamp := nextBlockTime(tip.Header)
+	header := BlockHeader{
+		Index:      tip.Header.Index + 1,
+		Timestamp:  timestamp,
+		PrevHash:   tip.Header.Hash,
+		MerkleRoot: merkleRoot(transactionIDs(transactions)),
+	}
+
+	if b.authority == nil {
+		header.Hash = header.computeHash()
+		return Block{Header: header, Transactions: transactions}, nil
+	}
+
+	if _, isValidator := findValidator(b.validators, b.authority.sealerId); !isValidator {
+		return Block{}, errNotInTurn
+	}
+	if expectedSealer(b.validators, header.Index).Id != b.authority.sealerId && !mayLeaveTurn(timestamp, tip.Header) {
+		return Block{}, errNotInTurn
+	}
+	header.Sealer = b.authority.sealerId
+	header.Hash = header.computeHash()
+	seal, err := utils.SignBytes([]byte(header.Hash), b.authority.sealerKey)
+	if err != nil {
+		return Block{}, err
+	}
+	header.Seal = seal
+	return Block{Header: header, Transactions: transactions}, nil
+}
+
+// sealPending puts the orphaned transactions (minus any that made it back on chain through a fork) and extra into a new block
+func (b *Blockchain) sealPending(extra []Transaction) error {
+	transactions := []Transaction{}
+	for _, tx := range b.orphans {
+		if _, exists := b.txs[tx.ID]; !exists {
+			transactions = append(transactions, tx)
+		}
+	}
+	transactions = append(transactions, extra...)
+	if len(transactions) == 0 {
+		b.orphans = nil
+		return nil
+	}
+
+	block, err := b.newBlock(transactions)
+	if err != nil {
+		return err
+	}
+	if err := b.appendBlock(block); err != nil {
+		return err
+	}
+	b.orphans = nil
+	return nil
+}
+
+// appendBlock persists the block first (when the ledger is backed by disk) and only then makes it visible
+func (b *Blockchain) appendBlock(block Block) error {
+	if b.store != nil {
+		if err := b.store.append(block); err != nil {
+			return err
+		}
+	}
+
+	b.blocks = append(b.blocks, block)
+	b.indexBlock(block)
+	if b.authority != nil {
+		b.validators = applyValidatorChanges(b.validators, block)
+	}
+	for _, observer := range b.observers {
+		observer(block)
+	}
+	b.notifyChanged()
+	return nil
+}
+
+func (b *Blockchain) indexBlock(block Block) {
+	for idx, tx := range block.Transactions {
+		b.txs[tx.ID] = txLocation{block: block.Header.Index, tx: idx}
+	}
+	b.index.add(block)
+}
+
+func (b *Blockchain) onAppend(observer func(Block)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observers = append(b.observers, observer)
+}
+
+// onPending registers observer for transactions CreateTransaction accepted without sealing them right away, so they
+// can be passed on to a validator that may seal them sooner
+func (b *Blockchain) onPending(observer func(Transaction)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, observer)
+}
+
+func (b *Blockchain) notifyPending(tx Transaction) {
+	for _, observer := range b.pending {
+		observer(tx)
+	}
+}
+
+// pendingTransactions is every transaction accepted but not sealed yet
+func (b *Blockchain) pendingTransactions() []Transaction {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	transactions := append([]Transaction{}, b.orphans...)
+	if b.mempool != nil {
+		transactions = append(transactions, b.mempool.pending...)
+	}
+	return transactions
+}
+
+// UseKeyRegistry makes the ledger check every new transaction's signer against the keys registered in the proxy
+func (b *Blockchain) UseKeyRegistry(proxy *IPFSProxy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keyRegistry = proxy
+}
+
+func (b *Blockchain) CreateTransaction(data Data) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := verifyTransactionSignature(data); err != nil {
+		return "", err
+	}
+	if isValidatorChange(data.kind) {
+		if err := b.checkValidatorChange(data); err != nil {
+			return "", err
+		}
+	} else if err := checkRegisteredSigner(b.keyRegistry, data); err != nil {
+		return "", err
+	}
+	if isMembershipRecord(data.kind) {
+		creation, created := b.groupCreation(data.groupId)
+		if err := checkMembership(data, creation, created); err != nil {
+			return "", err
+		}
+	}
+	previous, found := b.lookup(data.previousId)
+	if err := checkPrevious(data, previous, found, b.keyRegistry); err != nil {
+		return "", err
+	}
+
+	tx := Transaction{ID: data.hash(), Data: data}
+	if _, exists := b.txs[tx.ID]; exists {
+		return "", ErrAlreadyOnLedger
+	}
+	if b.mempool != nil {
+		if err := b.queue(tx); err != nil {
+			return "", err
+		}
+		b.notifyPending(tx)
+		return tx.ID, nil
+	}
+	if b.transactionStatus(tx.ID) == TX_STATUS_PENDING {
+		return "", ErrAlreadyPending
+	}
+	err := b.sealPending([]Transaction{tx})
+	if errors.Is(err, errNotInTurn) && b.sealLater() {
+		//pending until this validator may seal it, WaitForConfirmation tells when that happened
+		b.orphans = append(b.orphans, tx)
+		b.notifyPending(tx)
+		return tx.ID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return tx.ID, nil
 }
 
-func (b *Blockchain) CreateTransaction(data Data) string {
-	uuid := uuid.New().String()
-	b.blocks[uuid] = data
-	return uuid
+// sealLater seals the orphans once this validator may seal the next block, in turn or out of it, and returns false
+// when it never will because it is not a validator. A ledger with a mempool retries on its own. The chain lock must be
+// held.
+func (b *Blockchain) sealLater() bool {
+	if b.authority == nil {
+		return false
+	}
+	if _, isValidator := findValidator(b.validators, b.authority.sealerId); !isValidator {
+		return false
+	}
+	if b.mempool != nil || b.sealTimer != nil {
+		return true
+	}
+
+	tip := b.blocks[len(b.blocks)-1].Header
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(time.Unix(0, tip.Timestamp+int64(OUT_OF_TURN_SEAL_DELAY))), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.sealTimer != timer {
+			return //stopped by Close
+		}
+		b.sealTimer = nil
+		err := b.sealPending(nil)
+		if errors.Is(err, errNotInTurn) {
+			b.sealLater() //the chain moved on in the meantime
+		} else if err != nil {
+			fmt.Println("could not seal pending transactions", err)
+		}
+	})
+	b.sealTimer = timer
+	return true
 }
 
-func (b Blockchain) GetTransactionByHash(transactionId string) (Data, error) {
+func (b *Blockchain) GetTransactionByHash(transactionId string) (Data, error) {
 	if transactionId == "" {
 		return Data{}, errors.New("transaction ID should not be an empty string")
 	}
-	data, ok := b.blocks[transactionId]
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	location, ok := b.txs[transactionId]
 	if !ok {
 		return Data{}, errors.New("could not locate transaction")
 	}
+	tx := b.blocks[location.block].Transactions[location.tx]
+	if tx.Pruned {
+		return Data{}, errors.New("transaction has been pruned from this ledger")
+	}
+	return tx.Data, nil
+}
+
+// lookup is GetTransactionByHash for callers already holding the chain lock, pruned transactions are not found
+func (b *Blockchain) lookup(transactionId string) (Data, bool) {
+	location, ok := b.txs[transactionId]
+	if !ok {
+		return Data{}, false
+	}
+	tx := b.blocks[location.block].Transactions[location.tx]
+	return tx.Data, !tx.Pruned
+}
+
+// Close seals whatever is left in the mempool and releases the segment file of a disk-backed ledger
+func (b *Blockchain) Close() error {
+	b.stopMempool()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sealTimer != nil {
+		b.sealTimer.Stop()
+		b.sealTimer = nil
+	}
+
+	var flushErr error
+	if b.mempool != nil {
+		flushErr = b.flushMempool()
+		b.mempool = nil //later transactions get a block each again, nothing is left to seal them in the background
+	}
+
+	//the store is released even when the mempool could not be sealed, what is still pending is lost either way
+	if b.store == nil {
+		return flushErr
+	}
+	err := b.store.close()
+	b.store = nil
+	return errors.Join(flushErr, err)
+}
+
+// Height is the index of the latest block, genesis is 0
+func (b *Blockchain) Height() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.blocks) - 1
+}
+
+func (b *Blockchain) GetBlock(index int) (Block, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if index < 0 || index >= len(b.blocks) {
+		return Block{}, errors.New("block does not exist")
+	}
+	return b.blocks[index], nil
+}
+
+// VerifyChain walks the whole chain and recomputes every transaction ID, merkle root, block hash and link.
+// It returns the index of the first block that does not add up (and why), or -1 if the chain is intact.
+// On a pruned ledger the blocks up to the checkpoint are checked against the checkpoint instead, see VerifyFromCheckpoint.
+func (b *Blockchain) VerifyChain() (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return verifyBlocks(b.blocks, b.genesisValidators(), b.checkpoint, b.keyRegistry)
+}
+
+// verifyBlocks checks a whole chain from genesis, genesisValidators is nil for chains that don't run proof of authority.
+// With a checkpoint, the blocks up to it may have pruned transactions and only need to hash-link up to the
+// checkpoint's block, the validator set after it is the checkpoint's. The records themselves are checked with
+// verifyRecords against registry, which may be nil.
+func verifyBlocks(blocks []Block, genesisValidators []Validator, checkpoint *Checkpoint, registry *IPFSProxy) (int, error) {
+	if len(blocks) == 0 {
+		return 0, errors.New("chain has no genesis block")
+	}
+	genesis := genesisBlock().Header
+	if blocks[0].Header.Hash != genesis.Hash || blocks[0].Header.computeHash() != genesis.Hash || len(blocks[0].Transactions) != 0 {
+		return 0, errors.New("genesis block does not match")
+	}
+
+	start := 1
+	validators := genesisValidators
+	if checkpoint != nil {
+		if checkpoint.Height >= len(blocks) {
+			return len(blocks) - 1, errors.New("chain ends before its checkpoint")
+		}
+		for i := 1; i <= checkpoint.Height; i++ {
+			if err := verifyPrunedBlock(blocks[i], blocks[i-1].Header); err != nil {
+				return i, err
+			}
+		}
+		if blocks[checkpoint.Height].Header.Hash != checkpoint.Hash {
+			return checkpoint.Height, errors.New("block does not match the checkpoint")
+		}
+		if genesisValidators != nil && checkpoint.Validators == nil {
+			return checkpoint.Height, errors.New("checkpoint has no validator set")
+		}
+		if genesisValidators != nil {
+			validators = checkpoint.Validators
+		}
+		start = checkpoint.Height + 1
+	}
+
+	for i := start; i < len(blocks); i++ {
+		if err := verifyBlock(blocks[i], blocks[i-1].Header, validators); err != nil {
+			return i, err
+		}
+		if validators != nil {
+			validators = applyValidatorChanges(validators, blocks[i])
+		}
+	}
+	return verifyRecords(blocks[1:], registry, nil, nil)
+}
+
+// verifyRecords checks the transactions in blocks the way CreateTransaction checks a new one: the signer against the
+// registry (when there is one, see checkRecordedSigner), membership records against the group's creation (see
+// checkMembership) and the previous record. The previous record and the group creation must come earlier in blocks or
+// be found by lookup and creation (when there are). A previous record that has been pruned was checked before it
+// was, it is taken as it is. It returns the index of the first block with a record that fails, or -1.
+func verifyRecords(blocks []Block, registry *IPFSProxy, lookup func(string) (Transaction, bool), creation func(string) (Data, bool)) (int, error) {
+	earlier := map[string]Transaction{}
+	creations := map[string]Data{}
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			earlier[tx.ID] = tx
+			if tx.Pruned {
+				continue
+			}
+			if !isValidatorChange(tx.Data.kind) {
+				if err := checkRecordedSigner(registry, tx.Data); err != nil {
+					return block.Header.Index, fmt.Errorf("block %d: transaction %s: %w", block.Header.Index, tx.ID, err)
+				}
+			}
+			if isMembershipRecord(tx.Data.kind) {
+				groupCreation, created := creations[tx.Data.groupId]
+				if !created && creation != nil {
+					groupCreation, created = creation(tx.Data.groupId)
+				}
+				if err := checkMembership(tx.Data, groupCreation, created); err != nil {
+					return block.Header.Index, fmt.Errorf("block %d: transaction %s: %w", block.Header.Index, tx.ID, err)
+				}
+				if tx.Data.kind == TX_GROUP_CREATED {
+					creations[tx.Data.groupId] = tx.Data
+				}
+			}
+			if tx.Data.previousId == "" && tx.Data.kind != TX_FILE_DELETED {
+				continue
+			}
+			previous, found := earlier[tx.Data.previousId]
+			if !found && lookup != nil {
+				previous, found = lookup(tx.Data.previousId)
+			}
+			if found && previous.Pruned {
+				continue
+			}
+			if err := checkPrevious(tx.Data, previous.Data, found, registry); err != nil {
+				return block.Header.Index, fmt.Errorf("block %d: transaction %s: %w", block.Header.Index, tx.ID, err)
+			}
+		}
+	}
+	return -1, nil
+}
+
+// verifyBlock checks a block on its own and against the header of the block it claims to follow.
+// validators is the set in effect for this block, or nil when the chain does not run proof of authority.
+func verifyBlock(block Block, prev BlockHeader, validators []Validator) error {
+	header := block.Header
+	if header.Index != prev.Index+1 {
+		return fmt.Errorf("block %d: expected index %d", header.Index, prev.Index+1)
+	}
+	if header.PrevHash != prev.Hash {
+		return fmt.Errorf("block %d: previous hash does not match block %d", header.Index, prev.Index)
+	}
+	if err := checkBlockTime(header, prev); err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if tx.Pruned {
+			return fmt.Errorf("block %d: transaction %s has been pruned", header.Index, tx.ID)
+		}
+		if tx.ID != tx.Data.hash() {
+			return fmt.Errorf("block %d: transaction %s has been modified", header.Index, tx.ID)
+		}
+		if err := verifyTransactionSignature(tx.Data); err != nil {
+			return fmt.Errorf("block %d: transaction %s: %w", header.Index, tx.ID, err)
+		}
+	}
+	if header.MerkleRoot != merkleRoot(transactionIDs(block.Transactions)) {
+		return fmt.Errorf("block %d: merkle root does not match its transactions", header.Index)
+	}
+	if header.Hash != header.computeHash() {
+		return fmt.Errorf("block %d: block hash does not match its header", header.Index)
+	}
+	if validators != nil {
+		if err := verifySeal(header, prev, validators); err != nil {
+			return fmt.Errorf("block %d: %w", header.Index, err)
+		}
+		if err := verifyValidatorChanges(block, validators); err != nil {
+			return fmt.Errorf("block %d: %w", header.Index, err)
+		}
+	}
+	return nil
+}
 
+func transactionIDs(transactions []Transaction) []string {
+	ids := make([]string, 0, len(transactions))
+	for _, tx := range transactions {
+		ids = append(ids, tx.ID)
+	}
+	return ids
+}
+
+// signTransaction stamps the data with its creation time and the signer's public key, then signs all of it
+func signTransaction(data Data, publicKey []byte, privateKey []byte) (Data, error) {
+	if data.createdAt == 0 {
+		data.createdAt = time.Now().UnixNano()
+	}
+	data.signerKey = publicKey
+
+	signature, err := utils.SignBytes(data.signingBytes(), privateKey)
+	if err != nil {
+		return Data{}, err
+	}
+	data.signature = signature
 	return data, nil
 }
+
+func verifyTransactionSignature(data Data) error {
+	if len(data.signature) == 0 || len(data.signerKey) == 0 {
+		return errors.New("transaction is not signed")
+	}
+	if err := utils.VerifyBytesSignature(data.signingBytes(), data.signature, data.signerKey); err != nil {
+		return errors.New("transaction signature does not verify")
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package entities
+
+import (
+	"blockchain-fileshare/utils"
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// how long after the previous block a validator whose turn it is not may seal the next one, so the chain keeps going
+// when the validator whose turn it is is down or has nothing to seal
+const OUT_OF_TURN_SEAL_DELAY = time.Second
+
+var errNotInTurn = errors.New("it is not this validator's turn to seal a block")
+
+type Validator struct {
+	Id        string
+	PublicKey []byte
+}
+
+// proofOfAuthority is the consensus configuration of a chain: who the validators were at genesis and,
+// if this node is one of them, the key it seals with
+type proofOfAuthority struct {
+	genesis   []Validator
+	sealerId  string //empty for a node that only verifies
+	sealerKey []byte
+}
+
+// EnableProofOfAuthority switches the chain to proof of authority: block i is sealed by validator i mod n of the set in
+// effect at that height, or by any other validator once OUT_OF_TURN_SEAL_DELAY has passed since block i-1. The blocks
+// already on the chain must satisfy the same rule or nothing changes.
+// Pass an empty sealerId for a node that follows the chain without sealing.
+func (b *Blockchain) EnableProofOfAuthority(validators []Validator, sealerId string, sealerPrivateKey []byte) error {
+	if len(validators) == 0 {
+		return errors.New("proof of authority needs at least one validator")
+	}
+	//a sealer that only joins the set later through a validator change can't be checked up front
+	if sealer, ok := findValidator(validators, sealerId); ok {
+		probe, err := utils.SignBytes([]byte(sealerId), sealerPrivateKey)
+		if err != nil {
+			return err
+		}
+		if utils.VerifyBytesSignature([]byte(sealerId), probe, sealer.PublicKey) != nil {
+			return errors.New("sealer key does not match its validator entry")
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	genesis := append([]Validator{}, validators...)
+	if badIdx, err := verifyBlocks(b.blocks, genesis, b.checkpoint, b.keyRegistry); err != nil {
+		return fmt.Errorf("existing chain is not valid under proof of authority at block %d: %w", badIdx, err)
+	}
+
+	b.authority = &proofOfAuthority{genesis: genesis, sealerId: sealerId, sealerKey: sealerPrivateKey}
+	b.validators = b.validatorSetAfter(len(b.blocks) - 1)
+	return nil
+}
+
+// Validators returns the validator set that will seal the next block, nil when the chain is not proof of authority
+func (b *Blockchain) Validators() []Validator {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]Validator(nil), b.validators...)
+}
+
+func (b *Blockchain) genesisValidators() []Validator {
+	if b.authority == nil {
+		return nil
+	}
+	return b.authority.genesis
+}
+
+// validatorSetAfter replays validator set changes up to and including block idx, nil when the chain is not proof of authority
+func (b *Blockchain) validatorSetAfter(idx int) []Validator {
+	if b.authority == nil {
+		return nil
+	}
+	validators, from := append([]Validator{}, b.authority.genesis...), 1
+	if b.checkpoint != nil && b.checkpoint.Validators != nil {
+		//the validator changes before the checkpoint may be pruned, forks never reach back past it anyway
+		validators, from = append([]Validator{}, b.checkpoint.Validators...), b.checkpoint.Height+1
+	}
+	for _, block := range b.blocks[from : idx+1] {
+		validators = applyValidatorChanges(validators, block)
+	}
+	return validators
+}
+
+func expectedSealer(validators []Validator, index int) Validator {
+	return validators[index%len(validators)]
+}
+
+func findValidator(validators []Validator, id string) (Validator, bool) {
+	for _, v := range validators {
+		if v.Id == id {
+			return v, true
+		}
+	}
+	return Validator{}, false
+}
+
+// mayLeaveTurn is true when a block at timestamp may be sealed by a validator whose turn it is not
+func mayLeaveTurn(timestamp int64, prev BlockHeader) bool {
+	return timestamp >= prev.Timestamp+int64(OUT_OF_TURN_SEAL_DELAY)
+}
+
+func verifySeal(header BlockHeader, prev BlockHeader, validators []Validator) error {
+	sealer, isValidator := findValidator(validators, header.Sealer)
+	if !isValidator {
+		return fmt.Errorf("sealed by %q which is not a validator", header.Sealer)
+	}
+	if expected := expectedSealer(validators, header.Index); header.Sealer != expected.Id && !mayLeaveTurn(header.Timestamp, prev) {
+		return fmt.Errorf("sealed by %q out of turn, expected %q", header.Sealer, expected.Id)
+	}
+	if utils.VerifyBytesSignature([]byte(header.Hash), header.Seal, sealer.PublicKey) != nil {
+		return errors.New("seal does not verify")
+	}
+	return nil
+}
+
+// inTurnBlocks counts the blocks sealed by the validator whose turn it was, validators is the set in effect for the
+// first of them. It is 0 for a chain that does not run proof of authority.
+func inTurnBlocks(blocks []Block, validators []Validator) int {
+	count := 0
+	for _, block := range blocks {
+		if validators == nil {
+			return 0
+		}
+		if block.Header.Sealer == expectedSealer(validators, block.Header.Index).Id {
+			count++
+		}
+		validators = applyValidatorChanges(validators, block)
+	}
+	return count
+}
+
+func isValidatorChange(kind TransactionKind) bool {
+	return kind == TX_VALIDATOR_ADDED || kind == TX_VALIDATOR_REMOVED
+}
+
+// applyValidatorChanges returns the validator set that follows block, changes take effect from the next block on
+func applyValidatorChanges(validators []Validator, block Block) []Validator {
+	next := validators
+	copied := false
+	for _, tx := range block.Transactions {
+		if !isValidatorChange(tx.Data.kind) {
+			continue
+		}
+		if !copied {
+			next = append([]Validator{}, validators...)
+			copied = true
+		}
+
+		_, exists := findValidator(next, tx.Data.memberId)
+		switch {
+		case tx.Data.kind == TX_VALIDATOR_ADDED && !exists:
+			next = append(next, Validator{Id: tx.Data.memberId, PublicKey: tx.Data.publicKey})
+		case tx.Data.kind == TX_VALIDATOR_REMOVED && exists:
+			for idx, v := range next {
+				if v.Id == tx.Data.memberId {
+					next = append(next[:idx], next[idx+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return next
+}
+
+// verifyValidatorChanges makes sure every validator set change in block was signed by a validator in the set the block
+// was sealed under and that the block does not leave the chain without validators
+func verifyValidatorChanges(block Block, validators []Validator) error {
+	for _, tx := range block.Transactions {
+		if isValidatorChange(tx.Data.kind) && !signedByValidator(tx.Data, validators) {
+			return fmt.Errorf("validator set change %s is not signed by a validator", tx.ID)
+		}
+	}
+	if len(applyValidatorChanges(validators, block)) == 0 {
+		return errors.New("block removes every validator")
+	}
+	return nil
+}
+
+func signedByValidator(data Data, validators []Validator) bool {
+	signer, ok := findValidator(validators, data.userId)
+	return ok && bytes.Equal(signer.PublicKey, data.signerKey)
+}
+
+func (b *Blockchain) checkValidatorChange(data Data) error {
+	if b.authority == nil {
+		return errors.New("chain does not run proof of authority")
+	}
+	if !signedByValidator(data, b.validators) {
+		return errors.New("validator set changes must be signed by a current validator")
+	}
+	_, exists := findValidator(b.validators, data.memberId)
+	if data.kind == TX_VALIDATOR_ADDED && (exists || len(data.publicKey) == 0) {
+		return errors.New("validator is already in the set or has no public key")
+	}
+	if data.kind == TX_VALIDATOR_REMOVED && (!exists || len(b.validators) == 1) {
+		return errors.New("validator is not in the set or is the last one")
+	}
+	return nil
+}
+
+// CreateValidatorChange builds a signed transaction adding (TX_VALIDATOR_ADDED) or removing (TX_VALIDATOR_REMOVED)
+// a validator. It has to be signed by a validator that is in the set at the time it is sealed.
+func CreateValidatorChange(kind TransactionKind, validator Validator, signer Validator, signerPrivateKey []byte) (Data, error) {
+	if !isValidatorChange(kind) {
+		return Data{}, errors.New("not a validator set change")
+	}
+
+	data := Data{
+		userId:   signer.Id,
+		kind:     kind,
+		memberId: validator.Id,
+	}
+	if kind == TX_VALIDATOR_ADDED {
+		data.publicKey = validator.PublicKey
+	}
+	return signTransaction(data, signer.PublicKey, signerPrivateKey)
+}
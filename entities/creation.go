@@ -1,6 +1,9 @@
 package entities
 
 import (
+	"fmt"
+	"sync"
+
 	keys "blockchain-fileshare/keys"
 
 	"github.com/google/uuid"
@@ -15,6 +18,7 @@ func CreateAGroupOwner() GroupOwner {
 		groupsOwned: []Group{},
 		publicKey:   public,
 		privateKey:  private,
+		mu:          &sync.Mutex{},
 	}
 	return g
 }
@@ -32,11 +36,89 @@ func CreateAGroupMember() GroupMember {
 
 func CreateBlockChain() *Blockchain {
 	return &Blockchain{
-		blocks: map[string]Data{},
+		blocks:  []Block{genesisBlock()},
+		txs:     map[string]txLocation{},
+		index:   newLedgerIndex(),
+		changed: make(chan struct{}),
+	}
+}
+
+// CreateUploadData is the unsigned ledger record of a file landing in a group, the uploader fills in who they are when signing it
+func CreateUploadData(groupId string, fileHash string, IPFSHash string, fileExtension string) Data {
+	return Data{
+		groupId:       groupId,
+		fileHash:      fileHash,
+		IPFSHash:      IPFSHash,
+		fileExtension: fileExtension,
 	}
 }
 
-func CreateOperator(proxy *IPFSProxy, sh *shell.Shell, blockchain *Blockchain) Operators {
+// CreateUpdateData is the unsigned ledger record of new content for the file recorded in previousId, only whoever
+// recorded that version or the group owner may sign it (see checkPrevious)
+func CreateUpdateData(groupId string, fileHash string, IPFSHash string, fileExtension string, previousId string) Data {
+	data := CreateUploadData(groupId, fileHash, IPFSHash, fileExtension)
+	data.kind = TX_FILE_UPDATED
+	data.previousId = previousId
+	return data
+}
+
+// CreateDeleteData is the unsigned ledger record of the file version recorded in previousId being deleted, IPFSHash
+// is that version's. The same people who may replace the version may delete it (see checkPrevious).
+func CreateDeleteData(groupId string, IPFSHash string, fileExtension string, previousId string) Data {
+	return Data{
+		groupId:       groupId,
+		IPFSHash:      IPFSHash,
+		fileExtension: fileExtension,
+		kind:          TX_FILE_DELETED,
+		previousId:    previousId,
+	}
+}
+
+// CreateMembershipData is the unsigned ledger record of memberId joining (TX_MEMBER_ADDED) or leaving
+// (TX_MEMBER_REMOVED) a group, only whoever created the group may sign it (see checkMembership)
+func CreateMembershipData(kind TransactionKind, groupId string, memberId string) Data {
+	return Data{
+		groupId:  groupId,
+		memberId: memberId,
+		kind:     kind,
+	}
+}
+
+// OpenBlockChain loads (or starts) a ledger persisted under dir, every block found on disk is verified before use
+// (from its checkpoint when it has been pruned). Without a key registry the signers of the records on disk can't be
+// checked, OpenBlockChainWithRegistry does that.
+func OpenBlockChain(dir string) (*Blockchain, error) {
+	return OpenBlockChainWithRegistry(dir, nil)
+}
+
+// OpenBlockChainWithRegistry is OpenBlockChain for a ledger whose records were made by the groups of registry: every
+// record on disk must be signed with a key registry has (or had) on file for its signer, and the ledger checks new
+// transactions against registry from then on as if UseKeyRegistry had been called
+func OpenBlockChainWithRegistry(dir string, registry *IPFSProxy) (*Blockchain, error) {
+	store, blocks, checkpoint, err := openSegmentStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	blockchain := CreateBlockChain()
+	blockchain.blocks = append(blockchain.blocks, blocks...)
+	blockchain.checkpoint = checkpoint
+	if badIdx, err := verifyBlocks(blockchain.blocks, nil, checkpoint, registry); err != nil {
+		store.close()
+		return nil, fmt.Errorf("ledger in %s failed verification at block %d: %w", dir, badIdx, err)
+	}
+	for _, block := range blocks {
+		blockchain.indexBlock(block)
+	}
+
+	blockchain.store = store
+	blockchain.keyRegistry = registry
+	return blockchain, nil
+}
+
+// CreateOperator wires proxy (an *IPFSProxy or a ProxyClient) to the IPFS node and ledger and bundles them up
+func CreateOperator(proxy Proxy, sh *shell.Shell, blockchain Ledger) Operators {
+	proxy.Connect(sh, blockchain)
 	return Operators{
 		proxy:      proxy,
 		sh:         sh,
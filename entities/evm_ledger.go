@@ -0,0 +1,499 @@
+package entities
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/v2"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	EVM_RPC_TIMEOUT    = 30 * time.Second //for a single JSON-RPC round trip
+	EVM_DEPLOY_TIMEOUT = 2 * time.Minute  //for the contract deployment to be mined
+)
+
+// EVMClient is the part of an Ethereum JSON-RPC client the EVM ledger needs. The client returned by ethclient.Dial
+// satisfies it, and so does the client of go-ethereum's simulated backend.
+type EVMClient interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	ethereum.ChainIDReader
+}
+
+// EVMLedger keeps ledger records in a FileShareLedger contract (contracts/FileShareLedger.sol). Records go on chain in
+// the same encoding the built-in ledger uses and are checked again when they are read back, the contract itself only
+// refuses duplicates and records whose ID does not match their bytes. Anyone can call the contract, so a record that
+// does not check out is left out of the ledger as if it had never been made.
+type EVMLedger struct {
+	mu        sync.Mutex
+	client    EVMClient
+	contract  *bind.BoundContract
+	abi       abi.ABI
+	opts      *bind.TransactOpts
+	fromBlock uint64 //block the contract was deployed in, nothing to look for before that
+
+	submitted map[string]common.Hash //transaction ID -> Ethereum transaction carrying it, until it is known to be mined
+
+	//records read back from the contract, logs are only fetched for blocks that were not read before
+	indexMu     sync.Mutex     //taken after mu when both are needed
+	keyRegistry *IPFSProxy     //when set, signers must be using the public key the proxy has on file for them, set under both locks
+	index       []evmRecord    //records that checked out, in chain order
+	indexed     map[string]int //transaction ID -> position in index
+	groups      map[string]int //group ID -> position of its creation record in index
+	scannedTo   uint64         //next block to read logs from
+	scannedHash common.Hash    //hash of the last block read, if it leaves the chain the index is read again from scratch
+}
+
+// DeployEVMLedger deploys a fresh FileShareLedger contract paid for by key and waits for it to be mined
+func DeployEVMLedger(client EVMClient, key *ecdsa.PrivateKey) (*EVMLedger, error) {
+	opts, err := evmTransactOpts(client, key)
+	if err != nil {
+		return nil, err
+	}
+	bytecode, err := hex.DecodeString(FILE_SHARE_LEDGER_BIN)
+	if err != nil {
+		return nil, err
+	}
+
+	address, tx, err := bind.DeployContract(opts, bytecode, client, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not deploy the ledger contract: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_DEPLOY_TIMEOUT)
+	defer cancel()
+	receipt, err := bind.WaitMined(ctx, client, tx.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("ledger contract was not mined: %w", err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, errors.New("ledger contract deployment failed")
+	}
+	return OpenEVMLedger(client, key, address, receipt.BlockNumber.Uint64())
+}
+
+// OpenEVMLedger attaches to a FileShareLedger contract that is already deployed at address (in block fromBlock),
+// transactions are paid for by key
+func OpenEVMLedger(client EVMClient, key *ecdsa.PrivateKey, address common.Address, fromBlock uint64) (*EVMLedger, error) {
+	opts, err := evmTransactOpts(client, key)
+	if err != nil {
+		return nil, err
+	}
+	contractAbi, err := abi.JSON(strings.NewReader(FILE_SHARE_LEDGER_ABI))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+	code, err := client.CodeAt(ctx, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(code) == 0 {
+		return nil, errors.New("no ledger contract at that address")
+	}
+
+	return &EVMLedger{
+		client:    client,
+		contract:  bind.NewBoundContract(address, contractAbi, client, client, client),
+		abi:       contractAbi,
+		opts:      opts,
+		fromBlock: fromBlock,
+		submitted: map[string]common.Hash{},
+		indexed:   map[string]int{},
+		groups:    map[string]int{},
+		scannedTo: fromBlock,
+	}, nil
+}
+
+func evmTransactOpts(client EVMClient, key *ecdsa.PrivateKey) (*bind.TransactOpts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewKeyedTransactor(key, chainID), nil
+}
+
+// Address is where the ledger contract lives, hand it to OpenEVMLedger on other machines
+func (l *EVMLedger) Address() common.Address {
+	return l.contract.Address()
+}
+
+// UseKeyRegistry checks signers against proxy from now on, records already read are checked again
+func (l *EVMLedger) UseKeyRegistry(proxy *IPFSProxy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.indexMu.Lock()
+	defer l.indexMu.Unlock()
+	l.keyRegistry = proxy
+	l.resetIndex()
+}
+
+// CreateTransaction submits data to the contract and returns once the Ethereum transaction is sent,
+// use WaitForConfirmation to know it has been mined
+func (l *EVMLedger) CreateTransaction(data Data) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := verifyTransactionSignature(data); err != nil {
+		return "", err
+	}
+	if isValidatorChange(data.kind) {
+		return "", errors.New("validator set changes only exist on a proof of authority ledger")
+	}
+	if err := checkRegisteredSigner(l.keyRegistry, data); err != nil {
+		return "", err
+	}
+	if isMembershipRecord(data.kind) {
+		//the group's creation may not be mined yet, checkRecord holds the record to it when it is read back
+		creation, created, err := l.groupCreation(data.groupId)
+		if err != nil {
+			return "", err
+		}
+		if err := checkMembership(data, creation, created); created && err != nil {
+			return "", err
+		}
+	}
+	if data.previousId != "" || data.kind == TX_FILE_DELETED {
+		previous, err := l.GetTransactionByHash(data.previousId)
+		if err := checkPrevious(data, previous, err == nil, l.keyRegistry); err != nil {
+			return "", err
+		}
+	}
+
+	id := data.hash()
+	if _, pending := l.submitted[id]; pending {
+		return "", ErrAlreadyPending
+	}
+	recorded, err := l.recordedAt(id)
+	if err != nil {
+		return "", err
+	}
+	if recorded != 0 {
+		return "", ErrAlreadyOnLedger
+	}
+
+	opts := *l.opts
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+	opts.Context = ctx
+	tx, err := l.contract.Transact(&opts, "record", common.HexToHash(id), data.encode())
+	if err != nil {
+		return "", fmt.Errorf("could not submit transaction: %w", err)
+	}
+	l.submitted[id] = tx.Hash()
+	return id, nil
+}
+
+// recordedAt is the block the contract recorded id in, 0 when it has not been
+func (l *EVMLedger) recordedAt(id string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+
+	results := []any{}
+	if err := l.contract.Call(&bind.CallOpts{Context: ctx}, &results, "recordedAt", common.HexToHash(id)); err != nil {
+		return 0, err
+	}
+	return results[0].(*big.Int).Uint64(), nil
+}
+
+func (l *EVMLedger) GetTransactionByHash(transactionId string) (Data, error) {
+	if transactionId == "" {
+		return Data{}, errors.New("transaction ID should not be an empty string")
+	}
+	id, err := hex.DecodeString(transactionId)
+	if err != nil || len(id) != common.HashLength {
+		return Data{}, errors.New("could not locate transaction")
+	}
+
+	l.indexMu.Lock()
+	defer l.indexMu.Unlock()
+	if err := l.updateIndex(); err != nil {
+		return Data{}, err
+	}
+	seq, ok := l.indexed[hex.EncodeToString(id)]
+	if !ok {
+		return Data{}, errors.New("could not locate transaction")
+	}
+	return l.index[seq].tx.Data, nil
+}
+
+func (l *EVMLedger) WaitForConfirmation(transactionId string, timeout time.Duration) error {
+	l.mu.Lock()
+	txHash, pending := l.submitted[transactionId]
+	l.mu.Unlock()
+
+	if !pending {
+		recorded, err := l.recordedAt(transactionId)
+		if err != nil {
+			return err
+		}
+		if recorded == 0 {
+			return errors.New("transaction is not pending or on the ledger")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	receipt, err := bind.WaitMined(ctx, l.client, txHash)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("timed out waiting for the transaction to be committed")
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	delete(l.submitted, transactionId)
+	l.mu.Unlock()
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return errors.New("transaction was rejected by the ledger contract")
+	}
+	return nil
+}
+
+// ResolveLatestTransaction follows re-encryptions through the records read back from the contract, there is no index
+// on chain
+func (l *EVMLedger) ResolveLatestTransaction(transactionId string) (string, error) {
+	if transactionId == "" {
+		return "", errors.New("transaction ID should not be an empty string")
+	}
+
+	records, err := l.records()
+	if err != nil {
+		return "", err
+	}
+	transactions := make([]Transaction, 0, len(records))
+	for _, record := range records {
+		transactions = append(transactions, record.tx)
+	}
+	l.indexMu.Lock()
+	registry := l.keyRegistry
+	l.indexMu.Unlock()
+	return resolveLatestIn(transactions, transactionId, registry)
+}
+
+// Query filters the records read back from the contract here, the cursor names the log of the last record seen by
+// its block hash and log index
+func (l *EVMLedger) Query(q LedgerQuery) (QueryResult, error) {
+	cursor, limit, err := q.page()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	records, err := l.records()
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	after := -1
+	if cursor != nil {
+		for seq, record := range records {
+			if record.blockHash == cursor.blockHash && record.logIndex == cursor.position {
+				after = seq
+				break
+			}
+		}
+		if after == -1 {
+			return QueryResult{}, ErrStaleCursor
+		}
+	}
+
+	blockTimes := map[uint64]int64{}
+	result := QueryResult{Entries: []LedgerEntry{}}
+	for seq := after + 1; seq < len(records); seq++ {
+		record := records[seq]
+		if !q.matches(record.tx.Data) {
+			continue
+		}
+		timestamp, err := l.blockTime(blockTimes, record.block)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		if (!q.From.IsZero() && timestamp < q.From.UnixNano()) || (!q.To.IsZero() && timestamp > q.To.UnixNano()) {
+			continue
+		}
+
+		if len(result.Entries) == limit {
+			last := records[seq-1]
+			result.NextCursor = queryCursor{blockHash: last.blockHash, position: last.logIndex}.String()
+			break
+		}
+		result.Entries = append(result.Entries, LedgerEntry{BlockIndex: int(record.block), Timestamp: timestamp, Transaction: record.tx})
+	}
+	return result, nil
+}
+
+type evmRecord struct {
+	block     uint64
+	blockHash string
+	logIndex  int
+	tx        Transaction
+}
+
+// records is every transaction the contract has recorded that checked out, in chain order
+func (l *EVMLedger) records() ([]evmRecord, error) {
+	l.indexMu.Lock()
+	defer l.indexMu.Unlock()
+	if err := l.updateIndex(); err != nil {
+		return nil, err
+	}
+	//the index is only ever appended to or replaced, the caller's slice stays as it is
+	return l.index[:len(l.index):len(l.index)], nil
+}
+
+// updateIndex reads the logs of the blocks mined since the last call, indexMu must be held
+func (l *EVMLedger) updateIndex() error {
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+	if l.scannedTo > l.fromBlock {
+		last, err := l.client.HeaderByNumber(ctx, new(big.Int).SetUint64(l.scannedTo-1))
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			return err
+		}
+		if err != nil || last.Hash() != l.scannedHash {
+			l.resetIndex()
+		}
+	}
+	latest, err := l.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if latest.Number.Uint64() < l.scannedTo {
+		return nil
+	}
+
+	logs, err := l.client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(l.scannedTo),
+		ToBlock:   latest.Number,
+		Addresses: []common.Address{l.Address()},
+		Topics:    [][]common.Hash{{l.abi.Events["TransactionRecorded"].ID}},
+	})
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if log.Removed {
+			continue
+		}
+		tx, err := l.unpackRecord(log)
+		if err != nil {
+			continue
+		}
+		if err := l.checkRecord(tx.Data); err != nil {
+			continue
+		}
+		l.indexed[tx.ID] = len(l.index)
+		if tx.Data.kind == TX_GROUP_CREATED {
+			l.groups[tx.Data.groupId] = len(l.index)
+		}
+		l.index = append(l.index, evmRecord{block: log.BlockNumber, blockHash: log.BlockHash.Hex(), logIndex: int(log.Index), tx: tx})
+	}
+	l.scannedTo = latest.Number.Uint64() + 1
+	l.scannedHash = latest.Hash()
+	return nil
+}
+
+// checkRecord holds a record read back from the contract to the rules CreateTransaction applies on the way in, its
+// previous record has to come before it
+func (l *EVMLedger) checkRecord(data Data) error {
+	if isValidatorChange(data.kind) {
+		return errors.New("validator set changes only exist on a proof of authority ledger")
+	}
+	if err := checkRecordedSigner(l.keyRegistry, data); err != nil {
+		return err
+	}
+	if isMembershipRecord(data.kind) {
+		seq, created := l.groups[data.groupId]
+		creation := Data{}
+		if created {
+			creation = l.index[seq].tx.Data
+		}
+		if err := checkMembership(data, creation, created); err != nil {
+			return err
+		}
+	}
+	if data.previousId != "" || data.kind == TX_FILE_DELETED {
+		seq, found := l.indexed[data.previousId]
+		previous := Data{}
+		if found {
+			previous = l.index[seq].tx.Data
+		}
+		return checkPrevious(data, previous, found, l.keyRegistry)
+	}
+	return nil
+}
+
+// groupCreation is the TX_GROUP_CREATED record of groupId read back from the contract, if there is one
+func (l *EVMLedger) groupCreation(groupId string) (Data, bool, error) {
+	l.indexMu.Lock()
+	defer l.indexMu.Unlock()
+	if err := l.updateIndex(); err != nil {
+		return Data{}, false, err
+	}
+	seq, created := l.groups[groupId]
+	if !created {
+		return Data{}, false, nil
+	}
+	return l.index[seq].tx.Data, true, nil
+}
+
+func (l *EVMLedger) resetIndex() {
+	l.index = nil
+	l.indexed = map[string]int{}
+	l.groups = map[string]int{}
+	l.scannedTo = l.fromBlock
+	l.scannedHash = common.Hash{}
+}
+
+// blockTime is when block number was mined in unix nanoseconds, like the built-in ledger's block timestamps
+func (l *EVMLedger) blockTime(cache map[uint64]int64, number uint64) (int64, error) {
+	if timestamp, ok := cache[number]; ok {
+		return timestamp, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EVM_RPC_TIMEOUT)
+	defer cancel()
+	header, err := l.client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return 0, err
+	}
+	cache[number] = int64(header.Time) * int64(time.Second)
+	return cache[number], nil
+}
+
+// unpackRecord turns a TransactionRecorded event back into a transaction, checking it on the way
+func (l *EVMLedger) unpackRecord(log types.Log) (Transaction, error) {
+	fields, err := l.abi.Unpack("TransactionRecorded", log.Data)
+	if err != nil {
+		return Transaction{}, err
+	}
+	data, err := decodeData(fields[0].([]byte))
+	if err != nil {
+		return Transaction{}, err
+	}
+	//the chain vouches for the bytes, not for who wrote them
+	id := hex.EncodeToString(log.Topics[1].Bytes())
+	if data.hash() != id {
+		return Transaction{}, errors.New("record on chain does not match its transaction ID")
+	}
+	if err := verifyTransactionSignature(data); err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{ID: id, Data: data}, nil
+}
@@ -0,0 +1,19 @@
+package entities
+
+// ABI and creation code of contracts/FileShareLedger.sol.
+// The creation code was assembled by hand against that source (there was no solc in the build environment when it was
+// written), if the contract changes regenerate it with the compiler version the source pins:
+// `solc-0.8.24 --bin --abi contracts/FileShareLedger.sol`. TestEVMLedgerContractCode deploys it and checks the runtime
+// code it leaves behind, which is the part of FILE_SHARE_LEDGER_BIN after FILE_SHARE_LEDGER_RUNTIME_OFFSET.
+const FILE_SHARE_LEDGER_ABI = `[
+	{"type":"function","name":"record","stateMutability":"nonpayable","inputs":[{"name":"id","type":"bytes32"},{"name":"data","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"recordedAt","stateMutability":"view","inputs":[{"name":"","type":"bytes32"}],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"transactionCount","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"event","name":"TransactionRecorded","anonymous":false,"inputs":[{"name":"id","type":"bytes32","indexed":true},{"name":"data","type":"bytes","indexed":false}]}
+]`
+
+// FILE_SHARE_LEDGER_RUNTIME_OFFSET is the length in bytes of the constructor at the start of FILE_SHARE_LEDGER_BIN,
+// it copies everything after itself into memory and returns it as the code of the contract
+const FILE_SHARE_LEDGER_RUNTIME_OFFSET = 14
+
+const FILE_SHARE_LEDGER_BIN = "6102148061000e6000396000f3fe3461003457600436106100345760003560e01c8063e568f5b514610067578063bc23adb714610039578063b77bf6001461005b575b600080fd5b6024361061003457600435600052600060205260406000205460005260206000f35b60015460005260206000f35b60443610610034576024358063ffffffff90116100345760040180358063ffffffff901161003457906020013682820111610034576004356000526000602052604060002080541561012f577f08c379a000000000000000000000000000000000000000000000000000000000600052602060045260246024527f7472616e73616374696f6e20697320616c7265616479206f6e20746865206c656044527f646765720000000000000000000000000000000000000000000000000000000060645260846000fd5b82826080376020600084608060025afa1561003457600051600435146101cb577f08c379a000000000000000000000000000000000000000000000000000000000600052602060045260266024527f7472616e73616374696f6e20494420646f6573206e6f74206d617463682069746044527f732064617461000000000000000000000000000000000000000000000000000060645260846000fd5b4390556001546001016001556020604052816060526004357f563d0b4792abda9f1b2319f3d2e606fe90ed05139c6f51c9d13e0eef89c7f0d683601f01601f19166040016040a200"
@@ -0,0 +1,214 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errBlocksDoNotConnect = errors.New("blocks do not connect to this chain")
+
+// prefersChain is the fork choice rule, every node applies it the same way so they all end up on the same chain:
+// the higher chain wins, between two chains of the same height the one with more blocks sealed in turn since they
+// split wins (inTurn, always 0 without proof of authority) and after that the one whose tip hash sorts first
+func prefersChain(height int, inTurn int, tip string, otherHeight int, otherInTurn int, otherTip string) bool {
+	if height != otherHeight {
+		return height > otherHeight
+	}
+	if inTurn != otherInTurn {
+		return inTurn > otherInTurn
+	}
+	return tip < otherTip
+}
+
+func (b *Blockchain) tip() (int, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	last := b.blocks[len(b.blocks)-1].Header
+	return last.Index, last.Hash
+}
+
+// locator lists our block hashes from the tip backwards, densely at first and then doubling the gap,
+// so a peer can find where our chains split without us sending every hash
+func (b *Blockchain) locator() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	hashes := []string{}
+	step := 1
+	for idx := len(b.blocks) - 1; idx > 0; idx -= step {
+		hashes = append(hashes, b.blocks[idx].Header.Hash)
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+	}
+	return append(hashes, b.blocks[0].Header.Hash)
+}
+
+// blocksAfter returns (at most limit) blocks following the highest locator hash that is on our chain
+func (b *Blockchain) blocksAfter(locator []string, limit int) []Block {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	start := 0
+	for _, hash := range locator {
+		if idx := b.indexOfHash(hash); idx != -1 {
+			start = idx
+			break
+		}
+	}
+
+	end := len(b.blocks)
+	if end-(start+1) > limit {
+		end = start + 1 + limit
+	}
+	blocks := make([]Block, end-(start+1))
+	copy(blocks, b.blocks[start+1:end])
+	return blocks
+}
+
+func (b *Blockchain) indexOfHash(hash string) int {
+	for idx := len(b.blocks) - 1; idx >= 0; idx-- {
+		if b.blocks[idx].Header.Hash == hash {
+			return idx
+		}
+	}
+	return -1
+}
+
+// adoptBlocks looks at a run of blocks hanging off one of our blocks and switches to them when the fork choice rule
+// prefers the resulting chain. Transactions that only existed on the abandoned tail are put back in a new block on top
+// so that no upload record disappears because of a fork.
+func (b *Blockchain) adoptBlocks(blocks []Block) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(blocks) == 0 {
+		return false, nil
+	}
+	ancestor := b.indexOfHash(blocks[0].Header.PrevHash)
+	if ancestor == -1 {
+		return false, errBlocksDoNotConnect
+	}
+	for len(blocks) > 0 && ancestor+1 < len(b.blocks) && b.blocks[ancestor+1].Header.Hash == blocks[0].Header.Hash {
+		ancestor++
+		blocks = blocks[1:]
+	}
+	if len(blocks) == 0 {
+		return false, nil
+	}
+	if b.checkpoint != nil && ancestor < b.checkpoint.Height {
+		return false, errors.New("fork reaches back past the checkpoint")
+	}
+
+	if err := b.verifyCandidate(ancestor, blocks); err != nil {
+		return false, err
+	}
+
+	tip := b.blocks[len(b.blocks)-1].Header
+	candidateTip := blocks[len(blocks)-1].Header
+	validators := b.validatorSetAfter(ancestor)
+	inTurn, candidateInTurn := inTurnBlocks(b.blocks[ancestor+1:], validators), inTurnBlocks(blocks, validators)
+	if !prefersChain(candidateTip.Index, candidateInTurn, candidateTip.Hash, tip.Index, inTurn, tip.Hash) {
+		return false, nil
+	}
+
+	dropped, err := b.truncateTo(ancestor)
+	if err != nil {
+		return false, err
+	}
+	for _, block := range blocks {
+		if err := b.appendBlock(block); err != nil {
+			return true, err
+		}
+	}
+
+	for _, block := range dropped {
+		for _, tx := range block.Transactions {
+			if _, exists := b.txs[tx.ID]; !exists {
+				b.orphans = append(b.orphans, tx)
+			}
+		}
+	}
+	//under proof of authority the orphans wait until we may seal, they ride along with the next block we seal
+	if err := b.sealPending(nil); errors.Is(err, errNotInTurn) {
+		b.sealLater()
+	} else if err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// verifyCandidate checks blocks that would follow b.blocks[ancestor], including that none of them replays a
+// transaction that is already on the part of the chain they would keep and that their records hold up against that
+// part of the chain and the key registry, like the ones CreateTransaction takes
+func (b *Blockchain) verifyCandidate(ancestor int, blocks []Block) error {
+	prev := b.blocks[ancestor].Header
+	validators := b.validatorSetAfter(ancestor)
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		if err := verifyBlock(block, prev, validators); err != nil {
+			return err
+		}
+		//an out of turn seal only has to wait for the previous block, a timestamp from the future would skip that
+		if validators != nil && block.Header.Timestamp > time.Now().Add(OUT_OF_TURN_SEAL_DELAY).UnixNano() {
+			return fmt.Errorf("block %d: timestamp is in the future", block.Header.Index)
+		}
+		if validators != nil {
+			validators = applyValidatorChanges(validators, block)
+		}
+		for _, tx := range block.Transactions {
+			location, exists := b.txs[tx.ID]
+			if seen[tx.ID] || (exists && location.block <= ancestor) {
+				return fmt.Errorf("block %d: transaction %s appears twice", block.Header.Index, tx.ID)
+			}
+			seen[tx.ID] = true
+		}
+		prev = block.Header
+	}
+
+	kept := func(transactionId string) (Transaction, bool) {
+		location, exists := b.txs[transactionId]
+		if !exists || location.block > ancestor {
+			return Transaction{}, false
+		}
+		return b.blocks[location.block].Transactions[location.tx], true
+	}
+	created := func(groupId string) (Data, bool) {
+		for _, seq := range b.index.byGroup[groupId] {
+			location := b.index.locations[seq]
+			if location.block > ancestor {
+				break
+			}
+			if data := b.transactionAt(seq).Data; data.kind == TX_GROUP_CREATED {
+				return data, true
+			}
+		}
+		return Data{}, false
+	}
+	_, err := verifyRecords(blocks, b.keyRegistry, kept, created)
+	return err
+}
+
+// truncateTo drops every block after index keep from disk and memory and returns them
+func (b *Blockchain) truncateTo(keep int) ([]Block, error) {
+	if b.store != nil {
+		if err := b.store.truncate(keep); err != nil {
+			return nil, err
+		}
+	}
+
+	dropped := append([]Block{}, b.blocks[keep+1:]...)
+	for _, block := range dropped {
+		for _, tx := range block.Transactions {
+			delete(b.txs, tx.ID)
+		}
+	}
+	b.blocks = b.blocks[:keep+1]
+	b.index.truncate(keep)
+	b.validators = b.validatorSetAfter(keep)
+	b.forkPoints = append(b.forkPoints, keep)
+	b.trimForkPoints()
+	b.notifyChanged()
+	return dropped, nil
+}
@@ -2,7 +2,6 @@ package entities
 
 import (
 	"blockchain-fileshare/ipfs"
-	keys "blockchain-fileshare/keys"
 	"blockchain-fileshare/utils"
 	"bytes"
 	"crypto"
@@ -10,20 +9,47 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"strings"
+	"os"
+	"sync"
+	"time"
 
 	shell "github.com/ipfs/go-ipfs-api"
 )
 
 // this struct is to make life easy to deal with Member interface change
 type Operators struct {
-	proxy      *IPFSProxy
+	proxy      Proxy
 	sh         *shell.Shell
-	blockchain *Blockchain
+	blockchain Ledger
+
+	confirmUploads bool //see ConfirmUploads
+	confirmTimeout time.Duration
+}
+
+// ConfirmUploads makes every upload through the operator (new files, new versions, re-encryptions) wait until its
+// ledger record is committed, for up to timeout (0 waits for as long as it takes). Otherwise an upload returns once the
+// ledger accepted the record, which on a ledger with a mempool or on an EVM ledger only means it is pending.
+func (o *Operators) ConfirmUploads(timeout time.Duration) {
+	o.confirmUploads = true
+	o.confirmTimeout = timeout
+}
+
+// recordUpload puts the record of an upload on the ledger and waits for it when ConfirmUploads asked for that
+func (o *Operators) recordUpload(data Data) (string, error) {
+	transactionHash, err := o.blockchain.CreateTransaction(data)
+	if err != nil {
+		return "", err
+	}
+	if o.confirmUploads {
+		if err := o.blockchain.WaitForConfirmation(transactionHash, o.confirmTimeout); err != nil {
+			return "", err
+		}
+	}
+	return transactionHash, nil
 }
 
 type Member interface {
@@ -39,12 +65,14 @@ type File struct {
 	FileName      string //this is probably what the users will ever see on the interface
 	Handle        string //this is not actually, necessary for the system to work, but it is required for testing the security later
 	TransactionID string
+	Stale         bool //encrypted before a member was removed, its next write or a sweep re-encrypts it (see RevocationMode)
 }
 
 type Group struct {
 	groupID      string
 	groupMembers []Member
 	files        []File
+	revocation   RevocationMode
 }
 
 type UserMetadata struct { //this is like GroupMember/GroupOwner but since we don't want private key to be stored in the proxy, I chose to go with this struct
@@ -63,15 +91,23 @@ of what's going on for anyone looking through my code
 **/
 
 type GroupMetadata struct {
-	ownerUuid  string
-	groupUuid  string //this might be redundant but we might need it later
-	publicKey  []byte
-	privateKey []byte
-	users      []UserMetadata
+	ownerUuid   string
+	groupUuid   string //this might be redundant but we might need it later
+	publicKey   []byte
+	privateKey  []byte
+	shareIndex  int //which proxy of a threshold group this is, privateKey is then its own key for the data key shares wrapped to it. 0 when privateKey is the group private key
+	users       []UserMetadata
+	formerUsers []UserMetadata //members that were removed, their records stay on the ledger signed with these keys
 }
 
 type IPFSProxy struct {
-	groups map[string]GroupMetadata
+	mu       *sync.RWMutex //guards groups, only held while they are read or changed, never across IPFS or ledger calls
+	groups   map[string]GroupMetadata
+	ledger   Ledger         //where group lifecycle changes get recorded, nil until the proxy is wired into an operator
+	sh       *shell.Shell   //IPFS node uploads go to
+	replays  *replayCache   //nonces of the download requests it accepted
+	releases *releaseGate   //key releases being evaluated, one per user and file at a time
+	store    *proxyKeyStore //where groups are persisted, nil for a proxy that only lives in memory
 }
 
 type UploadRequest struct {
@@ -79,6 +115,35 @@ type UploadRequest struct {
 	groupID           string
 	requestedUserUuid string
 	signature         []byte
+
+	//set when the uploader encrypted the file itself (see ThresholdProxy.prepareUpload), filePath is the ciphertext then
+	checksum string //of the plaintext, as the ledger records it
+	fileKey  []byte //the data key wrapped for the group key
+}
+
+// signUpload lets proxy prepare the upload of filePath and signs what it is sent, done removes whatever the
+// preparation left on disk once the upload is over
+func signUpload(proxy Proxy, groupID string, userId string, filePath string, privateKey []byte) (UploadRequest, func(), error) {
+	uploadReq, err := proxy.prepareUpload(UploadRequest{
+		filePath:          filePath,
+		groupID:           groupID,
+		requestedUserUuid: userId,
+	})
+	if err != nil {
+		return UploadRequest{}, nil, err
+	}
+	done := func() {
+		if uploadReq.filePath != filePath {
+			os.Remove(uploadReq.filePath)
+		}
+	}
+
+	uploadReq.signature, err = utils.SignSignature(uploadReq.filePath, privateKey)
+	if err != nil {
+		done()
+		return UploadRequest{}, nil, err
+	}
+	return uploadReq, done, nil
 }
 
 type DownloadRequest struct {
@@ -87,17 +152,48 @@ type DownloadRequest struct {
 	IPFSHandle             string
 	fileExtension          string
 	requestedUserPublicKey []byte //there is no to send this in practice, I just did this because I did not want to spend time finding a user's public key on IPFSProxy's side
+	keyRelease             Data   //signed by the user, the proxy puts it on the ledger when it hands over the key
+	transactionId          string //ledger record of the file, the proxy authorizes the download against it
+	nonce                  string //random, the proxy accepts each request once
+	issuedAt               int64  //unix nanoseconds, the request is only good between issuedAt and expiresAt
+	expiresAt              int64
 }
 
-func encodeDownloadRequest(downloadRequest DownloadRequest) ([]byte, error) {
-	var downloadReqStructBytesBuffer bytes.Buffer
-	encoder := gob.NewEncoder(&downloadReqStructBytesBuffer)
-	err := encoder.Encode(downloadRequest)
-	if err != nil {
-		return nil, err
+// newDownloadRequest is a request that is good for DOWNLOAD_REQUEST_LIFETIME from now
+func newDownloadRequest(userId string, groupId string, IPFSHandle string, publicKey []byte, transactionId string) DownloadRequest {
+	now := time.Now()
+	return DownloadRequest{
+		requestedUserId:        userId,
+		groupId:                groupId,
+		IPFSHandle:             IPFSHandle,
+		requestedUserPublicKey: publicKey,
+		transactionId:          transactionId,
+		nonce:                  newNonce(),
+		issuedAt:               now.UnixNano(),
+		expiresAt:              now.Add(DOWNLOAD_REQUEST_LIFETIME).UnixNano(),
 	}
+}
 
-	return downloadReqStructBytesBuffer.Bytes(), nil
+// encodeDownloadRequest is what gets signed, every field is in it (length-prefixed like a ledger record) so none of
+// them can be changed without breaking the signature. The leading tag keeps it from passing for any other signed
+// message made with the same key.
+func encodeDownloadRequest(downloadRequest DownloadRequest) ([]byte, error) {
+	buf := appendString([]byte{}, "download-request")
+	for _, field := range []string{
+		downloadRequest.requestedUserId,
+		downloadRequest.groupId,
+		downloadRequest.IPFSHandle,
+		downloadRequest.fileExtension,
+		string(downloadRequest.requestedUserPublicKey),
+		string(downloadRequest.keyRelease.encode()),
+		downloadRequest.transactionId,
+		downloadRequest.nonce,
+	} {
+		buf = appendString(buf, field)
+	}
+	buf = binary.AppendVarint(buf, downloadRequest.issuedAt)
+	buf = binary.AppendVarint(buf, downloadRequest.expiresAt)
+	return buf, nil
 }
 
 func SignDownloadRequest(downloadRequest DownloadRequest, privateKeyBytes []byte) ([]byte, error) {
@@ -130,60 +226,150 @@ func SignDownloadRequest(downloadRequest DownloadRequest, privateKeyBytes []byte
 
 // return slice of old files for testing our threat model
 func (proxy *IPFSProxy) ChangeKeyAndSecureFiles(operator *Operators, groupOwner *GroupOwner, groupIdx int, groupID string) ([]File, error) {
-	group, exists := proxy.groups[groupID]
-	if !exists {
-		return nil, errors.New("group does not exist")
-	}
+	return changeKeyAndSecureFiles(operator, groupOwner, groupIdx, groupID)
+}
 
-	public, private := keys.GenerateKeyPair(group.groupUuid)
+// changeKeyAndSecureFiles rotates the group key through whichever proxy the operator uses and rewraps the data key of
+// every file of the group under the new key. The files stay on IPFS as they are, the owner has the proxy release each
+// data key and records it again encrypted with the new public key, so nothing has to be downloaded or re-uploaded and
+// the proxy can be on another host. Every data key is released before the key is rotated: once it is, a data key that
+// was not can't be released any more, so the rotation does not happen when one of them fails.
+func changeKeyAndSecureFiles(operator *Operators, groupOwner *GroupOwner, groupIdx int, groupID string) ([]File, error) {
+	return rotateGroupKey(operator, groupOwner, groupIdx, groupID, false)
+}
 
-	groupMetadata := groupOwner.groupsOwned[groupIdx]
-	oldFiles := groupMetadata.files
-	newFilePaths := []string{}
-	for _, file := range groupMetadata.files {
-		decryptedFilePath, _, err := groupOwner.DownloadFile(operator, groupID, file.TransactionID) //verifying checksum is optional, we already know that all the files (are not tampered)/(have not been tampered)
+// rotateGroupKey is changeKeyAndSecureFiles, revoking is set when a member was just removed. The files are then
+// re-encrypted under the new key right away in an eager group, with the data keys released before the rotation, and
+// rewrapped and recorded as stale in a lazy one (or when re-encrypting fails).
+func rotateGroupKey(operator *Operators, groupOwner *GroupOwner, groupIdx int, groupID string, revoking bool) ([]File, error) {
+	if _, err := operator.proxy.OwnerOf(groupID); err != nil {
+		return nil, err
+	}
+	groupOwner.mu.Lock()
+	defer groupOwner.mu.Unlock()
+
+	oldFiles := groupOwner.groupsOwned[groupIdx].files
+	reencrypt := revoking && groupOwner.groupsOwned[groupIdx].revocation == REVOCATION_EAGER
+	previous := []Data{} //current version of each file
+	previousIds := []string{}
+	dataKeys := [][]byte{}
+	defer func() {
+		for _, dataKey := range dataKeys {
+			clear(dataKey)
+		}
+	}()
+	for _, file := range oldFiles {
+		latestHash, err := operator.blockchain.ResolveLatestTransaction(file.TransactionID)
+		if err != nil {
+			return nil, fmt.Errorf("could not rekey file %s: %w", file.FileName, err)
+		}
+		data, err := operator.blockchain.GetTransactionByHash(latestHash)
+		if err != nil {
+			return nil, fmt.Errorf("could not rekey file %s: %w", file.FileName, err)
+		}
+		_, releasedKey, err := groupOwner.requestKey(operator, groupID, latestHash, data)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("could not rekey file %s: %w", file.FileName, err)
 		}
-		newFilePaths = append(newFilePaths, decryptedFilePath)
-		err = ipfs.DeleteFileFromIPFS(operator.sh, file.Handle)
+		dataKey, err := openReleasedKey(releasedKey, groupOwner.privateKey)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("could not rekey file %s: %w", file.FileName, err)
 		}
+		previous = append(previous, data)
+		previousIds = append(previousIds, latestHash)
+		dataKeys = append(dataKeys, dataKey)
 	}
 
-	group.publicKey = public
-	group.privateKey = private
-	proxy.groups[groupID] = group
+	request, err := groupOwner.signGroupRequest(operator.proxy, GroupRequest{action: GROUP_ROTATE_KEY, groupId: groupID})
+	if err != nil {
+		return nil, err
+	}
+	public, err := operator.proxy.RotateGroupKey(request)
+	if err != nil {
+		return nil, err
+	}
 
+	//the files still have to be rekeyed when the record can't be written, the error is returned once they are
+	_, recordErr := groupOwner.recordOnLedger(operator.blockchain, Data{
+		groupId:  groupID,
+		groupKey: keyFingerprint(public),
+		kind:     TX_KEY_ROTATED,
+	})
+
+	//a file that can't be rewrapped stays listed, the error says which ones are left under the old key
+	rekeyErrs := []error{}
+	if recordErr != nil {
+		rekeyErrs = append(rekeyErrs, fmt.Errorf("could not record key rotation: %w", recordErr))
+	}
 	groupOwner.groupsOwned[groupIdx].files = []File{}
+	for idx, file := range oldFiles {
+		if reencrypt {
+			reencrypted, err := groupOwner.reencryptWithDataKey(operator, groupID, file, previousIds[idx], previous[idx], dataKeys[idx])
+			if reencrypted.TransactionID != "" {
+				if err != nil {
+					rekeyErrs = append(rekeyErrs, fmt.Errorf("%s: %w", file.FileName, err))
+				}
+				groupOwner.groupsOwned[groupIdx].files = append(groupOwner.groupsOwned[groupIdx].files, reencrypted)
+				continue
+			}
+			rekeyErrs = append(rekeyErrs, fmt.Errorf("could not re-encrypt file %s, it is left stale: %w", file.FileName, err))
+		}
 
-	for _, newFilePath := range newFilePaths {
-		newFilePath, _ = strings.CutSuffix(newFilePath, "-decrypted")
-		transactionID, _, err := groupOwner.UploadFile(operator, groupID, newFilePath)
+		//a file stays stale until it is re-encrypted, however often it is rekeyed in between
+		stale := revoking || previous[idx].stale
+		fileKey, err := wrapDataKey(dataKeys[idx], public)
+		if err == nil {
+			//same file, same tags, only the data key is new
+			file.TransactionID, err = groupOwner.recordOnLedger(operator.blockchain, Data{
+				groupId:       groupID,
+				fileHash:      previous[idx].fileHash,
+				IPFSHash:      previous[idx].IPFSHash,
+				fileExtension: previous[idx].fileExtension,
+				kind:          TX_FILE_REKEYED,
+				previousId:    previousIds[idx],
+				tags:          previous[idx].tags,
+				fileKey:       fileKey,
+				stale:         stale,
+			})
+		}
 		if err != nil {
-			continue
+			rekeyErrs = append(rekeyErrs, fmt.Errorf("could not rekey file %s: %w", file.FileName, err))
+			file.TransactionID = oldFiles[idx].TransactionID
 		}
-		fmt.Println("NEW TRANSACTION", transactionID)
-
+		file.Stale = file.Stale || stale
+		groupOwner.groupsOwned[groupIdx].files = append(groupOwner.groupsOwned[groupIdx].files, file)
 	}
-
-	fmt.Println(groupOwner.groupsOwned[groupIdx].files)
-
-	return oldFiles, nil
+	return oldFiles, errors.Join(rekeyErrs...)
 }
 
-func (proxy IPFSProxy) getGroupPrivateKey(groupID string) ([]byte, error) {
-	group, ok := proxy.groups[groupID]
-	if !ok {
-		return nil, errors.New("group does not exist")
+// userKeys is every key userId is on file with, one per group they are in
+func (proxy IPFSProxy) userKeys(userId string) [][]byte {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	userKeys := [][]byte{}
+	for _, group := range proxy.groups {
+		for _, user := range group.users {
+			if user.uuid == userId {
+				userKeys = append(userKeys, user.publicKey)
+			}
+		}
 	}
+	return userKeys
+}
 
-	return group.privateKey, nil
+// group is the metadata of groupID as it is now, changes replace the metadata as a whole so the copy stays consistent
+func (proxy IPFSProxy) group(groupID string) (GroupMetadata, bool) {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	group, ok := proxy.groups[groupID]
+	return group, ok
 }
 
 func (proxy IPFSProxy) VerifyDownloadReqSignature(downloadRequest DownloadRequest, signature []byte) ([]byte, error) {
 	requestedUserPublicKey, err := proxy.getUserPublicKey(downloadRequest.groupId, downloadRequest.requestedUserId)
+	if errors.Is(err, ErrNotMember) {
+		return nil, denyDownload(ErrNotMember, downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -212,32 +398,21 @@ func (proxy IPFSProxy) VerifyDownloadReqSignature(downloadRequest DownloadReques
 		return nil, err
 	}
 
-	return signature, nil
-}
-
-func (proxy IPFSProxy) DownloadFileFromIPFS(sh *shell.Shell, downloadRequest DownloadRequest) (string, []byte, error) {
-	err := ipfs.DownloadFileFromIPFS(sh, downloadRequest.IPFSHandle, downloadRequest.fileExtension)
-	if err != nil {
-		return "", nil, err
-	}
-
-	encryptedFileName := downloadRequest.IPFSHandle + downloadRequest.fileExtension
-	groupPrivateKey, err := proxy.getGroupPrivateKey(downloadRequest.groupId)
+	//only checked once the signature is, so nobody can fill the cache with nonces they made up
+	err = proxy.replays.admit(downloadRequest.requestedUserId, downloadRequest.nonce, downloadRequest.issuedAt, downloadRequest.expiresAt, time.Now())
 	if err != nil {
-		return "", nil, err
-	}
-
-	encryptedGroupPrivateKey, err := utils.EncryptKey(groupPrivateKey, downloadRequest.requestedUserPublicKey)
-	if err != nil {
-		return "", nil, err
+		denial := &DownloadDeniedError{}
+		if errors.As(err, &denial) {
+			denial.UserId, denial.GroupId, denial.TransactionId = downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId
+		}
+		return nil, err
 	}
 
-	return encryptedFileName, encryptedGroupPrivateKey, nil
-
+	return signature, nil
 }
 
 func (proxy IPFSProxy) getUserPublicKey(groupID string, uuid string) ([]byte, error) {
-	group, ok := proxy.groups[groupID]
+	group, ok := proxy.group(groupID)
 	if !ok {
 		return nil, errors.New("group does not exist")
 	}
@@ -246,11 +421,25 @@ func (proxy IPFSProxy) getUserPublicKey(groupID string, uuid string) ([]byte, er
 			return m.publicKey, nil
 		}
 	}
-	return nil, errors.New("user is not a member of the group")
+	return nil, ErrNotMember
+}
+
+// hadUserKey is true when key is (or was, before they were removed) the key on file for the user in the group
+func (proxy IPFSProxy) hadUserKey(groupID string, uuid string, key []byte) bool {
+	group, ok := proxy.group(groupID)
+	if !ok {
+		return false
+	}
+	for _, m := range append(group.users, group.formerUsers...) {
+		if m.uuid == uuid && bytes.Equal(m.publicKey, key) {
+			return true
+		}
+	}
+	return false
 }
 
 func (proxy IPFSProxy) getGroupPublicKey(groupID string) ([]byte, error) {
-	group, ok := proxy.groups[groupID]
+	group, ok := proxy.group(groupID)
 	if !ok {
 		return nil, errors.New("group does not exist")
 	}
@@ -272,19 +461,46 @@ func (proxy IPFSProxy) VerifySignature(signature []byte, uploadReq UploadRequest
 	return nil
 }
 
-func (proxy IPFSProxy) UploadFileToIPFS(sh *shell.Shell, uploadReq UploadRequest) (string, string, error) {
-	groupPublicKey, err := proxy.getGroupPublicKey(uploadReq.groupID)
-	if err != nil {
-		return "", "", err
+// UploadFileToIPFS encrypts the file under a new data key wrapped for the group key and adds it to IPFS. The files of a
+// threshold group come encrypted already, the proxy adds the ciphertext as it is after checking that its share of the
+// data key is there for it: it never gets to see those files or more than its share of their keys.
+func (proxy IPFSProxy) UploadFileToIPFS(sh *shell.Shell, uploadReq UploadRequest) (string, string, []byte, error) {
+	group, ok := proxy.group(uploadReq.groupID)
+	if !ok {
+		return "", "", nil, errors.New("group does not exist")
 	}
 
-	handle, checksum, err := ipfs.UploadFileToIPFS(sh, uploadReq.filePath, groupPublicKey)
+	if group.shareIndex != 0 {
+		if uploadReq.fileKey == nil {
+			return "", "", nil, errors.New("files of a threshold group have to be encrypted by the uploader")
+		}
+		share, err := unwrapDataKeyShare(uploadReq.fileKey, group.shareIndex, group.privateKey)
+		if err != nil {
+			return "", "", nil, err
+		}
+		clear(share)
+		handle, err := ipfs.AddFileToIPFS(sh, uploadReq.filePath)
+		if err != nil {
+			return "", "", nil, &proxyFailure{err}
+		}
+		return handle, uploadReq.checksum, uploadReq.fileKey, nil
+	}
+	if uploadReq.fileKey != nil {
+		return "", "", nil, errors.New("group is not split over threshold proxies, the proxy encrypts its files")
+	}
 
-	return handle, checksum, nil
+	handle, checksum, fileKey, err := ipfs.UploadFileToIPFS(sh, uploadReq.filePath, func(dataKey []byte) ([]byte, error) {
+		return wrapDataKey(dataKey, group.publicKey)
+	})
+	if err != nil {
+		return "", "", nil, &proxyFailure{err}
+	}
+	return handle, checksum, fileKey, nil
 }
 
 func (proxy IPFSProxy) PrintUsers(groupID string) {
-	for _, m := range proxy.groups[groupID].users {
+	group, _ := proxy.group(groupID)
+	for _, m := range group.users {
 		fmt.Println(m.uuid)
 	}
 }
@@ -0,0 +1,321 @@
+package entities
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KEY_STORE_FILE  = "proxy-keystore.json"
+	MASTER_KEY_SIZE = 32 //AES-256
+	SCRYPT_N        = 1 << 15
+	SCRYPT_R        = 8
+	SCRYPT_P        = 1
+)
+
+// the check value sealed in every key store, a master key that can't open it is the wrong one
+const keyStoreCheck = "blockchain-fileshare proxy key store"
+
+// MasterKey unseals the proxy key store. It is either derived from a passphrase (with scrypt, the salt is kept in the
+// store) or read from a key file made with CreateMasterKeyFile, a store only opens with the kind it was created with.
+type MasterKey struct {
+	passphrase string
+	key        []byte
+}
+
+func MasterKeyFromPassphrase(passphrase string) MasterKey {
+	return MasterKey{passphrase: passphrase}
+}
+
+// CreateMasterKeyFile writes a new random master key to path, which must not exist yet
+func CreateMasterKeyFile(path string) (MasterKey, error) {
+	key := make([]byte, MASTER_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return MasterKey{}, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return MasterKey{}, err
+	}
+	if _, err := file.Write([]byte(hex.EncodeToString(key) + "\n")); err != nil {
+		file.Close()
+		return MasterKey{}, err
+	}
+	return MasterKey{key: key}, closeSynced(file)
+}
+
+func ReadMasterKeyFile(path string) (MasterKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return MasterKey{}, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != MASTER_KEY_SIZE {
+		return MasterKey{}, errors.New("master key file does not hold a master key")
+	}
+	return MasterKey{key: key}, nil
+}
+
+// the key store on disk: everything the proxy knows about its groups, with each group private key sealed with
+// AES-GCM under the master key. The rest of a group's entry is authenticated along with its key (see groupLabel), so
+// members can't be added to the file or dropped from FormerUsers without the master key.
+type keyStoreFile struct {
+	KDF    string        `json:"kdf"` //"scrypt" for a passphrase, "key-file" otherwise
+	Salt   []byte        `json:"salt,omitempty"`
+	Check  []byte        `json:"check"`
+	Groups []storedGroup `json:"groups"`
+}
+
+type storedGroup struct {
+	GroupId          string       `json:"groupId"`
+	OwnerId          string       `json:"ownerId"`
+	PublicKey        []byte       `json:"publicKey"`
+	SealedPrivateKey []byte       `json:"sealedPrivateKey"` //or the proxy's own key in a threshold group when ShareIndex is set
+	ShareIndex       int          `json:"shareIndex,omitempty"`
+	Users            []storedUser `json:"users"`
+	FormerUsers      []storedUser `json:"formerUsers,omitempty"`
+}
+
+type storedUser struct {
+	UserId    string `json:"userId"`
+	PublicKey []byte `json:"publicKey"`
+}
+
+type proxyKeyStore struct {
+	path   string
+	header keyStoreFile //KDF, salt and check, the groups are filled in on every save
+	aead   cipher.AEAD
+}
+
+// OpenIPFSProxy is CreateIPFSProxy for a proxy that outlives its process: its groups are kept in dir and every change
+// is written there before it takes effect. The group private keys are only ever on disk sealed under master, the
+// first open creates the store and seals it to whichever master key it was given.
+func OpenIPFSProxy(dir string, master MasterKey) (*IPFSProxy, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, KEY_STORE_FILE)
+	proxy := CreateIPFSProxy()
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		store, err := createKeyStore(path, master)
+		if err != nil {
+			return nil, err
+		}
+		proxy.store = store
+		return proxy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := keyStoreFile{}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("proxy key store is corrupted: %w", err)
+	}
+	aead, err := master.aead(header)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := unseal(aead, header.Check, "check"); err != nil || string(check) != keyStoreCheck {
+		return nil, errors.New("wrong master key for the proxy key store")
+	}
+
+	for _, group := range header.Groups {
+		label, err := groupLabel(group)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := unseal(aead, group.SealedPrivateKey, label)
+		if err != nil {
+			return nil, fmt.Errorf("group %s does not unseal, its entry was changed or damaged: %w", group.GroupId, err)
+		}
+		users := []UserMetadata{}
+		for _, user := range group.Users {
+			users = append(users, UserMetadata{uuid: user.UserId, publicKey: user.PublicKey})
+		}
+		formerUsers := []UserMetadata{}
+		for _, user := range group.FormerUsers {
+			formerUsers = append(formerUsers, UserMetadata{uuid: user.UserId, publicKey: user.PublicKey})
+		}
+		proxy.groups[group.GroupId] = GroupMetadata{
+			ownerUuid:   group.OwnerId,
+			groupUuid:   group.GroupId,
+			publicKey:   group.PublicKey,
+			privateKey:  privateKey,
+			shareIndex:  group.ShareIndex,
+			users:       users,
+			formerUsers: formerUsers,
+		}
+	}
+	header.Groups = nil
+	proxy.store = &proxyKeyStore{path: path, header: header, aead: aead}
+	return proxy, nil
+}
+
+func createKeyStore(path string, master MasterKey) (*proxyKeyStore, error) {
+	header := keyStoreFile{KDF: "key-file"}
+	if master.key == nil {
+		header.KDF = "scrypt"
+		header.Salt = make([]byte, 16)
+		if _, err := rand.Read(header.Salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := master.aead(header)
+	if err != nil {
+		return nil, err
+	}
+	header.Check, err = seal(aead, []byte(keyStoreCheck), "check")
+	if err != nil {
+		return nil, err
+	}
+
+	store := &proxyKeyStore{path: path, header: header, aead: aead}
+	return store, store.save(map[string]GroupMetadata{})
+}
+
+// aead derives the key that seals the store described by header
+func (m MasterKey) aead(header keyStoreFile) (cipher.AEAD, error) {
+	key := m.key
+	switch {
+	case header.KDF == "scrypt" && m.key == nil:
+		var err error
+		key, err = scrypt.Key([]byte(m.passphrase), header.Salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, MASTER_KEY_SIZE)
+		if err != nil {
+			return nil, err
+		}
+	case header.KDF == "scrypt":
+		return nil, errors.New("proxy key store is sealed with a passphrase, not a key file")
+	case header.KDF == "key-file" && m.key == nil:
+		return nil, errors.New("proxy key store is sealed with a key file, not a passphrase")
+	case header.KDF != "key-file":
+		return nil, fmt.Errorf("proxy key store uses an unknown key derivation %q", header.KDF)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a fresh nonce in front, label is authenticated with it so a sealed key can't be passed
+// off as another group's
+func seal(aead cipher.AEAD, plaintext []byte, label string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(label)), nil
+}
+
+func unseal(aead cipher.AEAD, sealed []byte, label string) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed key is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(label))
+}
+
+// groupLabel is what a group's private key is sealed with: the whole entry but the sealed key itself, so the key only
+// unseals next to the owner, members and former members it was saved with
+func groupLabel(group storedGroup) (string, error) {
+	group.SealedPrivateKey = nil
+	if group.Users == nil {
+		group.Users = []storedUser{}
+	}
+	raw, err := json.Marshal(group)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// save replaces the store with groups, the new file is written next to the old one and renamed over it so a crash
+// leaves one or the other
+func (s *proxyKeyStore) save(groups map[string]GroupMetadata) error {
+	contents := s.header
+	contents.Groups = []storedGroup{}
+	groupIds := []string{}
+	for groupId := range groups {
+		groupIds = append(groupIds, groupId)
+	}
+	sort.Strings(groupIds)
+	for _, groupId := range groupIds {
+		group := groups[groupId]
+		stored := storedGroup{
+			GroupId:    group.groupUuid,
+			OwnerId:    group.ownerUuid,
+			PublicKey:  group.publicKey,
+			ShareIndex: group.shareIndex,
+			Users:      []storedUser{},
+		}
+		for _, user := range group.users {
+			stored.Users = append(stored.Users, storedUser{UserId: user.uuid, PublicKey: user.publicKey})
+		}
+		for _, user := range group.formerUsers {
+			stored.FormerUsers = append(stored.FormerUsers, storedUser{UserId: user.uuid, PublicKey: user.publicKey})
+		}
+		label, err := groupLabel(stored)
+		if err != nil {
+			return err
+		}
+		if stored.SealedPrivateKey, err = seal(s.aead, group.privateKey, label); err != nil {
+			return err
+		}
+		contents.Groups = append(contents.Groups, stored)
+	}
+	raw, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := closeSynced(file); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// putGroup is how the proxy changes a group: the change is saved to the key store first when there is one, and
+// undone when it can't be. proxy.mu must be held.
+func (proxy *IPFSProxy) putGroup(groupMetadata GroupMetadata) error {
+	previous, existed := proxy.groups[groupMetadata.groupUuid]
+	proxy.groups[groupMetadata.groupUuid] = groupMetadata
+	if proxy.store == nil {
+		return nil
+	}
+	if err := proxy.store.save(proxy.groups); err != nil {
+		if existed {
+			proxy.groups[groupMetadata.groupUuid] = previous
+		} else {
+			delete(proxy.groups, groupMetadata.groupUuid)
+		}
+		return &proxyFailure{fmt.Errorf("could not save the proxy key store: %w", err)}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package entities
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// what CreateTransaction returns for a transaction it has seen before
+var (
+	ErrAlreadyOnLedger = errors.New("transaction is already on the ledger")
+	ErrAlreadyPending  = errors.New("transaction is already pending")
+)
+
+// Ledger is where the records of uploads and group changes end up. *Blockchain is the built-in ledger, EVMLedger keeps
+// the same records in a contract on an Ethereum compatible chain.
+type Ledger interface {
+	//CreateTransaction checks the signature on data and submits it, the returned ID is the hex sha256 of the encoded data
+	CreateTransaction(data Data) (string, error)
+	GetTransactionByHash(transactionId string) (Data, error)
+	//ResolveLatestTransaction follows re-encryptions from an old transaction ID to the one of the current file version
+	ResolveLatestTransaction(transactionId string) (string, error)
+	//WaitForConfirmation blocks until the transaction is committed, a zero timeout waits for as long as it takes
+	WaitForConfirmation(transactionId string, timeout time.Duration) error
+	//Query returns the transactions matching q in chain order, a page at a time
+	Query(q LedgerQuery) (QueryResult, error)
+	//UseKeyRegistry makes the ledger check every new transaction's signer against the keys registered in the proxy
+	UseKeyRegistry(proxy *IPFSProxy)
+}
+
+// checkRegisteredSigner makes sure data was signed with the key the proxy has on file for its signer
+func checkRegisteredSigner(registry *IPFSProxy, data Data) error {
+	if registry == nil {
+		return nil
+	}
+	registeredKey, err := registry.getUserPublicKey(data.groupId, data.userId)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(registeredKey, data.signerKey) {
+		return errors.New("transaction is not signed with the key registered for this user")
+	}
+	return nil
+}
+
+// checkRecordedSigner is checkRegisteredSigner for a record made earlier, on another node or before a restart: its
+// signer may have been removed from the group since, the key the proxy had on file for them then still counts
+func checkRecordedSigner(registry *IPFSProxy, data Data) error {
+	if registry == nil || registry.hadUserKey(data.groupId, data.userId, data.signerKey) {
+		return nil
+	}
+	return errors.New("transaction is not signed with a key registered for this user")
+}
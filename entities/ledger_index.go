@@ -0,0 +1,324 @@
+package entities
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what Query returns for a cursor whose block a fork switch took off the chain, the query has to start over
+var ErrStaleCursor = errors.New("cursor refers to a block that is no longer on the chain")
+
+const (
+	DEFAULT_QUERY_LIMIT = 100
+	MAX_QUERY_LIMIT     = 1000
+)
+
+// ledgerIndex keeps secondary indexes over every transaction on the chain. Transactions are numbered in chain order
+// (their sequence number) and every index is a posting list of sequence numbers, so the lists are always sorted and
+// both paging and dropping the tail after a fork switch are a binary search away.
+type ledgerIndex struct {
+	locations  []txLocation //sequence number -> where the transaction lives
+	blockStart []int        //block index -> sequence number of its first transaction
+	byGroup    map[string][]int
+	byUser     map[string][]int
+	byIPFSHash map[string][]int
+	byKind     map[TransactionKind][]int
+	byPrevious map[string][]int //transaction ID -> the re-encryptions that replaced it, deletions are not among them
+}
+
+func newLedgerIndex() *ledgerIndex {
+	return &ledgerIndex{
+		locations:  []txLocation{},
+		blockStart: []int{0}, //genesis
+		byGroup:    map[string][]int{},
+		byUser:     map[string][]int{},
+		byIPFSHash: map[string][]int{},
+		byKind:     map[TransactionKind][]int{},
+		byPrevious: map[string][]int{},
+	}
+}
+
+func (idx *ledgerIndex) add(block Block) {
+	idx.blockStart = append(idx.blockStart, len(idx.locations))
+	for position, tx := range block.Transactions {
+		seq := len(idx.locations)
+		idx.locations = append(idx.locations, txLocation{block: block.Header.Index, tx: position})
+		if tx.Pruned {
+			continue //keeps its sequence number so the rest still line up, but there is nothing to look it up by
+		}
+		idx.byGroup[tx.Data.groupId] = append(idx.byGroup[tx.Data.groupId], seq)
+		idx.byUser[tx.Data.userId] = append(idx.byUser[tx.Data.userId], seq)
+		if tx.Data.IPFSHash != "" {
+			idx.byIPFSHash[tx.Data.IPFSHash] = append(idx.byIPFSHash[tx.Data.IPFSHash], seq)
+		}
+		idx.byKind[tx.Data.kind] = append(idx.byKind[tx.Data.kind], seq)
+		if tx.Data.previousId != "" && tx.Data.kind != TX_FILE_DELETED {
+			idx.byPrevious[tx.Data.previousId] = append(idx.byPrevious[tx.Data.previousId], seq)
+		}
+	}
+}
+
+// truncate forgets every block after index keep
+func (idx *ledgerIndex) truncate(keep int) {
+	if keep+1 >= len(idx.blockStart) {
+		return
+	}
+	cut := idx.blockStart[keep+1]
+	idx.blockStart = idx.blockStart[:keep+1]
+	idx.locations = idx.locations[:cut]
+
+	trimString := func(postings map[string][]int) {
+		for key, list := range postings {
+			list = list[:sort.SearchInts(list, cut)]
+			if len(list) == 0 {
+				delete(postings, key)
+			} else {
+				postings[key] = list
+			}
+		}
+	}
+	trimString(idx.byGroup)
+	trimString(idx.byUser)
+	trimString(idx.byIPFSHash)
+	trimString(idx.byPrevious)
+	for kind, list := range idx.byKind {
+		idx.byKind[kind] = list[:sort.SearchInts(list, cut)]
+	}
+}
+
+// LedgerQuery filters transactions, every field left at its zero value matches everything
+type LedgerQuery struct {
+	GroupId  string
+	UserId   string
+	IPFSHash string
+	Kinds    []TransactionKind
+	From     time.Time //inclusive, compared against the time the block was sealed
+	To       time.Time //inclusive
+	Cursor   string    //NextCursor of the previous page, see queryCursor
+	Limit    int       //DEFAULT_QUERY_LIMIT when 0, capped at MAX_QUERY_LIMIT
+}
+
+type LedgerEntry struct {
+	BlockIndex  int
+	Timestamp   int64
+	Transaction Transaction
+}
+
+type QueryResult struct {
+	Entries    []LedgerEntry
+	NextCursor string //empty when there are no more results
+}
+
+// Query returns transactions matching q in chain order, a page at a time
+func (b *Blockchain) Query(q LedgerQuery) (QueryResult, error) {
+	cursor, limit, err := q.page()
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	after := -1
+	if cursor != nil {
+		block := b.indexOfHash(cursor.blockHash)
+		if block == -1 || cursor.position >= len(b.blocks[block].Transactions) {
+			return QueryResult{}, ErrStaleCursor
+		}
+		after = b.index.blockStart[block] + cursor.position
+	}
+	lo, hi := b.sequenceRange(q.From, q.To)
+	if after+1 > lo {
+		lo = after + 1
+	}
+
+	candidates := b.index.candidates(q, lo)
+	result := QueryResult{Entries: []LedgerEntry{}}
+	for seq, ok := candidates.next(); ok && seq < hi; seq, ok = candidates.next() {
+		location := b.index.locations[seq]
+		block := b.blocks[location.block]
+		tx := block.Transactions[location.tx]
+		if tx.Pruned || !q.matches(tx.Data) {
+			continue
+		}
+
+		if len(result.Entries) == limit {
+			last := b.index.locations[seq-1]
+			result.NextCursor = queryCursor{blockHash: b.blocks[last.block].Header.Hash, position: last.tx}.String()
+			break
+		}
+		result.Entries = append(result.Entries, LedgerEntry{BlockIndex: block.Header.Index, Timestamp: block.Header.Timestamp, Transaction: tx})
+	}
+	return result, nil
+}
+
+// queryCursor is the last transaction a page went up to, by the hash of its block and its position in there. Unlike a
+// plain count of transactions it can't silently point somewhere else once a fork switch replaced that block.
+type queryCursor struct {
+	blockHash string
+	position  int
+}
+
+func (c queryCursor) String() string {
+	return c.blockHash + ":" + strconv.Itoa(c.position)
+}
+
+// page turns the cursor and limit of q into the last transaction already seen (nil on the first page) and the page size
+func (q LedgerQuery) page() (*queryCursor, int, error) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = DEFAULT_QUERY_LIMIT
+	}
+	if limit < 0 || limit > MAX_QUERY_LIMIT {
+		limit = MAX_QUERY_LIMIT
+	}
+
+	if q.Cursor == "" {
+		return nil, limit, nil
+	}
+	blockHash, position, found := strings.Cut(q.Cursor, ":")
+	cursor := queryCursor{blockHash: blockHash}
+	var err error
+	if cursor.position, err = strconv.Atoi(position); !found || blockHash == "" || err != nil || cursor.position < 0 {
+		return nil, 0, errors.New("invalid cursor")
+	}
+	return &cursor, limit, nil
+}
+
+// QueryAll collects every page of q
+func QueryAll(ledger Ledger, q LedgerQuery) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	for {
+		result, err := ledger.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, result.Entries...)
+		if result.NextCursor == "" {
+			return entries, nil
+		}
+		q.Cursor = result.NextCursor
+	}
+}
+
+func (q LedgerQuery) matches(data Data) bool {
+	if q.GroupId != "" && data.groupId != q.GroupId {
+		return false
+	}
+	if q.UserId != "" && data.userId != q.UserId {
+		return false
+	}
+	if q.IPFSHash != "" && data.IPFSHash != q.IPFSHash {
+		return false
+	}
+	if len(q.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range q.Kinds {
+		if data.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// sequenceRange turns a time range into a range of sequence numbers [lo, hi), block timestamps never go backwards
+// (see checkBlockTime)
+func (b *Blockchain) sequenceRange(from time.Time, to time.Time) (int, int) {
+	lo, hi := 0, len(b.index.locations)
+	if !from.IsZero() {
+		first := sort.Search(len(b.blocks), func(i int) bool { return b.blocks[i].Header.Timestamp >= from.UnixNano() })
+		lo = b.index.startOf(first)
+	}
+	if !to.IsZero() {
+		past := sort.Search(len(b.blocks), func(i int) bool { return b.blocks[i].Header.Timestamp > to.UnixNano() })
+		hi = b.index.startOf(past)
+	}
+	return lo, hi
+}
+
+func (idx *ledgerIndex) startOf(block int) int {
+	if block >= len(idx.blockStart) {
+		return len(idx.locations)
+	}
+	return idx.blockStart[block]
+}
+
+// candidates picks the shortest posting list that the query pins down and walks it from lo.
+// Several kinds are walked together as one merged list. With no usable index every sequence number is a candidate.
+func (idx *ledgerIndex) candidates(q LedgerQuery, lo int) *postingCursor {
+	lists := [][]int{}
+	if q.GroupId != "" {
+		lists = append(lists, idx.byGroup[q.GroupId])
+	}
+	if q.UserId != "" {
+		lists = append(lists, idx.byUser[q.UserId])
+	}
+	if q.IPFSHash != "" {
+		lists = append(lists, idx.byIPFSHash[q.IPFSHash])
+	}
+
+	if len(lists) > 0 {
+		shortest := lists[0]
+		for _, list := range lists[1:] {
+			if len(list) < len(shortest) {
+				shortest = list
+			}
+		}
+		return newPostingCursor([][]int{shortest}, lo)
+	}
+
+	if len(q.Kinds) > 0 {
+		kindLists := [][]int{}
+		for _, kind := range q.Kinds {
+			kindLists = append(kindLists, idx.byKind[kind])
+		}
+		return newPostingCursor(kindLists, lo)
+	}
+
+	return &postingCursor{scan: true, pos: lo, end: len(idx.locations)}
+}
+
+// postingCursor yields sequence numbers in ascending order from one or more sorted posting lists
+type postingCursor struct {
+	lists     [][]int
+	positions []int
+
+	scan bool //no lists, just count from pos to end
+	pos  int
+	end  int
+}
+
+func newPostingCursor(lists [][]int, lo int) *postingCursor {
+	positions := make([]int, len(lists))
+	for i, list := range lists {
+		positions[i] = sort.SearchInts(list, lo)
+	}
+	return &postingCursor{lists: lists, positions: positions}
+}
+
+func (c *postingCursor) next() (int, bool) {
+	if c.scan {
+		if c.pos >= c.end {
+			return 0, false
+		}
+		c.pos++
+		return c.pos - 1, true
+	}
+
+	best := -1
+	for i, list := range c.lists {
+		if c.positions[i] < len(list) && (best == -1 || list[c.positions[i]] < c.lists[best][c.positions[best]]) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	seq := c.lists[best][c.positions[best]]
+	c.positions[best]++
+	return seq, true
+}
@@ -0,0 +1,317 @@
+package entities
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	MAX_BLOCKS_PER_MESSAGE = 500
+	GOSSIP_QUEUE_SIZE      = 1024
+)
+
+// nodeMessage is the one message shape nodes exchange, one JSON object per line
+//
+//	status:     "this is my tip", sent on connect and whenever a peer offered us a chain we did not prefer
+//	block:      a block that was just appended to the sender's chain
+//	get_blocks: "send me what you have after the first of these hashes you know"
+//	blocks:     the answer to get_blocks
+//	transactions: transactions waiting to be sealed, sent when the sender accepted them and to every new peer
+type nodeMessage struct {
+	Type         string   `json:"type"`
+	Height       int      `json:"height,omitempty"`
+	Tip          string   `json:"tip,omitempty"`
+	Locator      []string `json:"locator,omitempty"`
+	Blocks       [][]byte `json:"blocks,omitempty"`
+	Transactions [][]byte `json:"transactions,omitempty"`
+}
+
+type peerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	encoder *json.Encoder
+}
+
+func (p *peerConn) send(msg nodeMessage) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.encoder.Encode(msg)
+}
+
+// LedgerNode replicates a Blockchain to other nodes over TCP. Every block appended locally is gossiped to all peers,
+// blocks coming from peers are fully verified before they are applied, and competing forks are settled with prefersChain.
+// Transactions that are left pending (waiting in the mempool or for this validator's turn) are gossiped too and go
+// through CreateTransaction on the other end, so whichever validator gets to seal next has them.
+type LedgerNode struct {
+	chain    *Blockchain
+	listener net.Listener
+
+	mu     sync.Mutex
+	peers  map[*peerConn]bool
+	closed bool
+
+	outgoing    chan Block
+	outgoingTxs chan Transaction
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func StartLedgerNode(chain *Blockchain, listenAddr string) (*LedgerNode, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &LedgerNode{
+		chain:       chain,
+		listener:    listener,
+		peers:       map[*peerConn]bool{},
+		outgoing:    make(chan Block, GOSSIP_QUEUE_SIZE),
+		outgoingTxs: make(chan Transaction, GOSSIP_QUEUE_SIZE),
+		done:        make(chan struct{}),
+	}
+	chain.onAppend(func(block Block) {
+		//never block the chain on the network, a peer that misses a block catches up on the next one through get_blocks
+		select {
+		case node.outgoing <- block:
+		default:
+		}
+	})
+	chain.onPending(func(tx Transaction) {
+		//a transaction that misses a peer here still lands in a block the peer gets
+		select {
+		case node.outgoingTxs <- tx:
+		default:
+		}
+	})
+
+	node.wg.Add(2)
+	go node.acceptLoop()
+	go node.gossipLoop()
+	return node, nil
+}
+
+func (n *LedgerNode) Addr() string {
+	return n.listener.Addr().String()
+}
+
+func (n *LedgerNode) Chain() *Blockchain {
+	return n.chain
+}
+
+// Connect dials another node, both ends then exchange their tips and the one that is behind catches up
+func (n *LedgerNode) Connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return n.addPeer(conn)
+}
+
+func (n *LedgerNode) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	for peer := range n.peers {
+		peer.conn.Close()
+	}
+	n.mu.Unlock()
+
+	err := n.listener.Close()
+	close(n.done)
+	n.wg.Wait()
+	return err
+}
+
+func (n *LedgerNode) acceptLoop() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.addPeer(conn)
+	}
+}
+
+func (n *LedgerNode) addPeer(conn net.Conn) error {
+	peer := &peerConn{conn: conn, encoder: json.NewEncoder(conn)}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		conn.Close()
+		return errors.New("ledger node is closed")
+	}
+	n.peers[peer] = true
+	n.wg.Add(1)
+	n.mu.Unlock()
+
+	go n.readLoop(peer)
+	if err := n.sendStatus(peer); err != nil {
+		return err
+	}
+	if pending := n.chain.pendingTransactions(); len(pending) > 0 {
+		return peer.send(transactionsMessage(pending))
+	}
+	return nil
+}
+
+func transactionsMessage(transactions []Transaction) nodeMessage {
+	msg := nodeMessage{Type: "transactions", Transactions: make([][]byte, 0, len(transactions))}
+	for _, tx := range transactions {
+		msg.Transactions = append(msg.Transactions, tx.Data.encode())
+	}
+	return msg
+}
+
+func (n *LedgerNode) dropPeer(peer *peerConn) {
+	n.mu.Lock()
+	delete(n.peers, peer)
+	n.mu.Unlock()
+	peer.conn.Close()
+}
+
+func (n *LedgerNode) gossipLoop() {
+	defer n.wg.Done()
+	for {
+		var msg nodeMessage
+		select {
+		case block := <-n.outgoing:
+			msg = nodeMessage{Type: "block", Blocks: [][]byte{encodeBlock(block)}}
+		case tx := <-n.outgoingTxs:
+			msg = transactionsMessage([]Transaction{tx})
+		case <-n.done:
+			return
+		}
+
+		n.mu.Lock()
+		peers := make([]*peerConn, 0, len(n.peers))
+		for peer := range n.peers {
+			peers = append(peers, peer)
+		}
+		n.mu.Unlock()
+
+		for _, peer := range peers {
+			if err := peer.send(msg); err != nil {
+				n.dropPeer(peer)
+			}
+		}
+	}
+}
+
+func (n *LedgerNode) readLoop(peer *peerConn) {
+	defer n.wg.Done()
+	defer n.dropPeer(peer)
+
+	scanner := bufio.NewScanner(peer.conn)
+	scanner.Buffer(make([]byte, 64*1024), 256<<20)
+	for scanner.Scan() {
+		msg := nodeMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return
+		}
+		if err := n.handle(peer, msg); err != nil {
+			//a peer sending blocks that do not verify is either broken or lying, either way we stop listening to it
+			fmt.Println("dropping ledger peer", peer.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (n *LedgerNode) handle(peer *peerConn, msg nodeMessage) error {
+	switch msg.Type {
+	case "status":
+		//how many blocks were sealed in turn only counts from where two chains split, so a peer at our height with
+		//another tip is asked for its blocks and adoptBlocks settles it
+		height, tip := n.chain.tip()
+		if msg.Tip != tip && msg.Height >= height {
+			return n.requestBlocks(peer)
+		}
+		return nil
+
+	case "get_blocks":
+		blocks := n.chain.blocksAfter(msg.Locator, MAX_BLOCKS_PER_MESSAGE)
+		reply := nodeMessage{Type: "blocks", Blocks: make([][]byte, 0, len(blocks))}
+		for _, block := range blocks {
+			reply.Blocks = append(reply.Blocks, encodeBlock(block))
+		}
+		return peer.send(reply)
+
+	case "block", "blocks":
+		blocks := make([]Block, 0, len(msg.Blocks))
+		for _, raw := range msg.Blocks {
+			block, err := decodeBlock(raw)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+		return n.receiveBlocks(peer, msg.Type, blocks)
+
+	case "transactions":
+		for _, raw := range msg.Transactions {
+			data, err := decodeData(raw)
+			if err != nil {
+				return err
+			}
+			//one we already have ends the relay, one we turn down (not our group's registry, not in turn for a
+			//follower) is for some other node to seal, neither says anything about the peer
+			n.chain.CreateTransaction(data)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown message type %q", msg.Type)
+}
+
+func (n *LedgerNode) receiveBlocks(peer *peerConn, msgType string, blocks []Block) error {
+	n.chain.mu.RLock()
+	known := n.chain.indexOfHash(blocks[len(blocks)-1].Header.Hash) != -1
+	connects := n.chain.indexOfHash(blocks[0].Header.PrevHash) != -1
+	n.chain.mu.RUnlock()
+
+	if known {
+		return nil
+	}
+	if !connects {
+		//we are missing whatever this block builds on, ask the peer for everything after our common ancestor
+		return n.requestBlocks(peer)
+	}
+
+	adopted, err := n.chain.adoptBlocks(blocks)
+	if errors.Is(err, errBlocksDoNotConnect) {
+		return n.requestBlocks(peer) //our chain moved underneath us in the meantime
+	}
+	if err != nil {
+		return err
+	}
+	if adopted {
+		if msgType == "blocks" && len(blocks) == MAX_BLOCKS_PER_MESSAGE {
+			return n.requestBlocks(peer) //there is more where that came from
+		}
+		return nil
+	}
+
+	//we prefer our own chain, let the peer know so it can come and get it
+	return n.sendStatus(peer)
+}
+
+func (n *LedgerNode) requestBlocks(peer *peerConn) error {
+	return peer.send(nodeMessage{Type: "get_blocks", Locator: n.chain.locator()})
+}
+
+func (n *LedgerNode) sendStatus(peer *peerConn) error {
+	height, tip := n.chain.tip()
+	return peer.send(nodeMessage{Type: "status", Height: height, Tip: tip})
+}
@@ -0,0 +1,469 @@
+package entities
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	SEGMENT_MAX_BYTES   = 64 << 20 //a new segment file is started once the current one grows past this
+	SEGMENT_FILE_FORMAT = "segment-%08d.log"
+	PRUNED_FILE_FORMAT  = "pruned-%08d.log" //segments being written by Prune, they only become real once the checkpoint names them
+	CHECKPOINT_FILE     = "checkpoint"
+	RECORD_HEADER_SIZE  = 8 //4 bytes payload length + 4 bytes crc32 of the payload
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is a damaged record that runs up to the end of its segment, which is what an interrupted append leaves
+var errTornRecord = errors.New("torn record at the end of the segment")
+
+// segmentStore is an append-only log of blocks spread over numbered segment files.
+// Each record is [length][crc32][encoded block] and is fsync'd before the block becomes visible in memory.
+type segmentStore struct {
+	dir         string
+	segment     int
+	file        *os.File
+	segmentSize int64
+	records     []recordPosition //where each stored block starts, used to cut the log back when the node switches forks
+	broken      error            //set when a failed append could not be cut back off, nothing is appended after it
+}
+
+type recordPosition struct {
+	segment int
+	offset  int64
+}
+
+func segmentPath(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf(SEGMENT_FILE_FORMAT, segment))
+}
+
+func listSegments(dir string, format string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []int{}
+	for _, entry := range entries {
+		var segment int
+		if _, err := fmt.Sscanf(entry.Name(), format, &segment); err == nil && !entry.IsDir() {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// openSegmentStore replays every segment in dir and returns the blocks found in them, and the checkpoint when the
+// ledger has been pruned. A torn or corrupted record at the tail of the last segment is what a crash mid-write looks
+// like, so the segment is truncated right before it. The same damage anywhere else is reported as an error.
+func openSegmentStore(dir string) (*segmentStore, []Block, *Checkpoint, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, nil, nil, err
+	}
+	checkpoint, err := recoverPruning(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	store, blocks, err := replaySegments(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return store, blocks, checkpoint, nil
+}
+
+func replaySegments(dir string) (*segmentStore, []Block, error) {
+	segments, err := listSegments(dir, SEGMENT_FILE_FORMAT)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(segments) == 0 {
+		segments = []int{1}
+	}
+
+	blocks := []Block{}
+	records := []recordPosition{}
+	for i, segment := range segments {
+		isLast := i == len(segments)-1
+		segmentBlocks, offsets, goodSize, err := readSegment(segmentPath(dir, segment))
+		if err != nil && (!isLast || !errors.Is(err, errTornRecord)) {
+			return nil, nil, fmt.Errorf("segment %d is corrupted: %w", segment, err)
+		}
+		if err != nil {
+			if err := truncateSegment(segmentPath(dir, segment), goodSize); err != nil {
+				return nil, nil, err
+			}
+		}
+		blocks = append(blocks, segmentBlocks...)
+		for _, offset := range offsets {
+			records = append(records, recordPosition{segment: segment, offset: offset})
+		}
+	}
+
+	last := segments[len(segments)-1]
+	file, err := os.OpenFile(segmentPath(dir, last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &segmentStore{dir: dir, segment: last, file: file, segmentSize: info.Size(), records: records}, blocks, nil
+}
+
+// readSegment returns the blocks of every intact record, where each of them starts and the byte offset right after the
+// last one. A damaged record that reaches the end of the file is reported as errTornRecord, one with intact records
+// after it is corruption.
+func readSegment(path string) ([]Block, []int64, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	size := info.Size()
+
+	blocks := []Block{}
+	offsets := []int64{}
+	offset := int64(0)
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		_, err := io.ReadFull(file, header)
+		if err == io.EOF {
+			return blocks, offsets, offset, nil
+		}
+		if err != nil {
+			return blocks, offsets, offset, fmt.Errorf("%w: short record header", errTornRecord)
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		checksum := binary.BigEndian.Uint32(header[4:])
+		end := offset + RECORD_HEADER_SIZE + int64(length)
+		damaged := func(reason string) error {
+			if end >= size {
+				return fmt.Errorf("%w: %s", errTornRecord, reason)
+			}
+			return fmt.Errorf("record at offset %d: %s", offset, reason)
+		}
+		if length > SEGMENT_MAX_BYTES {
+			return blocks, offsets, offset, damaged("record length out of range")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(file, payload); err != nil {
+			return blocks, offsets, offset, damaged("short record payload")
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return blocks, offsets, offset, damaged("record checksum mismatch")
+		}
+
+		block, err := decodeBlock(payload)
+		if err != nil {
+			return blocks, offsets, offset, damaged(err.Error())
+		}
+		blocks = append(blocks, block)
+		offsets = append(offsets, offset)
+		offset = end
+	}
+}
+
+func truncateSegment(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+func (s *segmentStore) append(block Block) error {
+	if s.broken != nil {
+		return s.broken
+	}
+	if s.file == nil {
+		if err := s.finishRewrite(); err != nil {
+			return err
+		}
+	}
+	payload := encodeBlock(block)
+	if len(payload) > SEGMENT_MAX_BYTES {
+		return errors.New("block is too large for a segment")
+	}
+	if s.segmentSize > 0 && s.segmentSize+RECORD_HEADER_SIZE+int64(len(payload)) > SEGMENT_MAX_BYTES {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := encodeRecord(payload)
+
+	if _, err := s.file.Write(record); err != nil {
+		return s.abandon(err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return s.abandon(err)
+	}
+	s.records = append(s.records, recordPosition{segment: s.segment, offset: s.segmentSize})
+	s.segmentSize += int64(len(record))
+	return nil
+}
+
+// abandon cuts what a failed append wrote back off the segment, so the next record lands where s.records expects it
+// and a reload does not bring back a block the caller was told failed. When that fails too the segment no longer
+// matches what is in memory and the store refuses any further append.
+func (s *segmentStore) abandon(err error) error {
+	cutErr := s.file.Truncate(s.segmentSize)
+	if cutErr == nil {
+		cutErr = s.file.Sync()
+	}
+	if cutErr != nil {
+		s.broken = fmt.Errorf("ledger store is unusable, a failed append could not be undone: %w", cutErr)
+		return errors.Join(err, s.broken)
+	}
+	return err
+}
+
+// truncate drops every stored block after the first keep ones, this is the only way anything leaves the log
+// and it only happens when the fork choice rule swaps the tail of the chain
+func (s *segmentStore) truncate(keep int) error {
+	if keep >= len(s.records) {
+		return nil
+	}
+	if s.file == nil {
+		if err := s.finishRewrite(); err != nil {
+			return err
+		}
+	}
+
+	cut := s.records[keep]
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	for segment := s.segment; segment > cut.segment; segment-- {
+		if err := os.Remove(segmentPath(s.dir, segment)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := truncateSegment(segmentPath(s.dir, cut.segment), cut.offset); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(segmentPath(s.dir, cut.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.segment = cut.segment
+	s.segmentSize = cut.offset
+	s.records = s.records[:keep]
+	return nil
+}
+
+func (s *segmentStore) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(segmentPath(s.dir, s.segment+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	s.segment++
+	s.file = file
+	s.segmentSize = 0
+	return nil
+}
+
+func (s *segmentStore) close() error {
+	if s.file == nil {
+		return nil //a rewrite left cleaning up to recoverPruning
+	}
+	return s.file.Close()
+}
+
+func encodeBlock(block Block) []byte {
+	header := block.Header
+	buf := []byte{}
+	buf = binary.AppendUvarint(buf, uint64(header.Index))
+	buf = binary.AppendVarint(buf, header.Timestamp)
+	buf = appendString(buf, header.PrevHash)
+	buf = appendString(buf, header.MerkleRoot)
+	buf = appendString(buf, header.Sealer)
+	buf = appendString(buf, header.Hash)
+	buf = appendString(buf, string(header.Seal))
+
+	buf = binary.AppendUvarint(buf, uint64(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		buf = appendString(buf, tx.ID)
+		if tx.Pruned {
+			buf = appendString(buf, "") //no real transaction encodes to nothing
+			continue
+		}
+		buf = appendString(buf, string(tx.Data.encode()))
+	}
+	return buf
+}
+
+func decodeBlock(buf []byte) (Block, error) {
+	r := &byteReader{buf: buf}
+	block := Block{}
+	block.Header.Index = int(r.uvarint())
+	block.Header.Timestamp = r.varint()
+	block.Header.PrevHash = r.string()
+	block.Header.MerkleRoot = r.string()
+	block.Header.Sealer = r.string()
+	block.Header.Hash = r.string()
+	block.Header.Seal = []byte(r.string())
+
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(buf)) {
+		return Block{}, errors.New("malformed block: transaction count out of range")
+	}
+	block.Transactions = make([]Transaction, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id, encoded := r.string(), r.string()
+		if r.err == nil && encoded == "" {
+			block.Transactions = append(block.Transactions, Transaction{ID: id, Pruned: true})
+			continue
+		}
+		data, err := decodeData([]byte(encoded))
+		if err != nil {
+			return Block{}, err
+		}
+		block.Transactions = append(block.Transactions, Transaction{ID: id, Data: data})
+	}
+	if r.err != nil {
+		return Block{}, fmt.Errorf("malformed block: %w", r.err)
+	}
+	return block, nil
+}
+
+func decodeData(buf []byte) (Data, error) {
+	r := &byteReader{buf: buf}
+	data := Data{
+		userId:        r.string(),
+		groupId:       r.string(),
+		fileHash:      r.string(),
+		IPFSHash:      r.string(),
+		fileExtension: r.string(),
+		kind:          TransactionKind(r.uvarint()),
+		memberId:      r.string(),
+		groupKey:      r.string(),
+		publicKey:     []byte(r.string()),
+		previousId:    r.string(),
+	}
+	tagCount := r.uvarint()
+	for i := uint64(0); i < tagCount && r.err == nil; i++ {
+		data.tags = append(data.tags, r.string())
+	}
+	data.policy = r.string()
+	data.fileKey = []byte(r.string())
+	data.fileId = r.string()
+	data.nonce = r.string()
+	data.stale = r.uvarint() == 1
+	data.createdAt = r.varint()
+	data.signerKey = []byte(r.string())
+	data.signature = []byte(r.string())
+	if r.err != nil {
+		return Data{}, fmt.Errorf("malformed transaction: %w", r.err)
+	}
+	return data, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// byteReader reads the length-prefixed encoding back, the first error sticks so callers only check once at the end
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("bad uvarint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("bad varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) string() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.buf)) {
+		r.err = errors.New("string runs past the end of the record")
+		return ""
+	}
+	s := string(r.buf[:length])
+	r.buf = r.buf[length:]
+	return s
+}
@@ -0,0 +1,149 @@
+package entities
+
+import (
+	"errors"
+)
+
+// checkPrevious makes sure a record that replaces another one points at a file record of the same group
+// that is already on the ledger, and that its signer may replace that record (see mayReplace). A deletion always
+// names the version it deletes, so only whoever may replace that version may delete it.
+func checkPrevious(data Data, previous Data, found bool, registry *IPFSProxy) error {
+	if data.previousId == "" {
+		if data.kind == TX_FILE_DELETED {
+			return errors.New("deletion record must reference the file version it deletes")
+		}
+		return nil
+	}
+	if data.kind != TX_FILE_REENCRYPTED && data.kind != TX_FILE_REKEYED && data.kind != TX_FILE_UPDATED && data.kind != TX_FILE_DELETED {
+		return errors.New("only re-encryption, rekey, update and deletion records may reference a previous transaction")
+	}
+	if !found {
+		return errors.New("previous transaction is not on the ledger")
+	}
+	if !isFileRecord(previous) {
+		return errors.New("previous transaction is not a file record")
+	}
+	if previous.groupId != data.groupId {
+		return errors.New("previous transaction belongs to another group")
+	}
+	//a rekey only replaces the data key, the ciphertext stays where it was
+	if data.kind == TX_FILE_REKEYED && (data.IPFSHash != previous.IPFSHash || data.fileHash != previous.fileHash) {
+		return errors.New("rekey record does not refer to the same file as the previous transaction")
+	}
+	if data.kind == TX_FILE_DELETED && data.IPFSHash != previous.IPFSHash {
+		return errors.New("deletion record does not refer to the same file as the previous transaction")
+	}
+	if !mayReplace(registry, data, previous) {
+		return errors.New("previous transaction can only be replaced by whoever recorded it or the group owner")
+	}
+	return nil
+}
+
+// mayReplace is true when the signer of data is the one who recorded previous or the owner of the group. Without a
+// registry signers are not tied to users (see checkRecordedSigner) so there is no telling, and anyone may.
+func mayReplace(registry *IPFSProxy, data Data, previous Data) bool {
+	if registry == nil || data.userId == previous.userId {
+		return true
+	}
+	owner, err := registry.OwnerOf(data.groupId)
+	return err == nil && data.userId == owner
+}
+
+// isFileRecord is true for the records that make a version of a file
+func isFileRecord(data Data) bool {
+	switch data.kind {
+	case TX_FILE_UPLOADED, TX_FILE_REENCRYPTED, TX_FILE_REKEYED, TX_FILE_UPDATED:
+		return true
+	}
+	return false
+}
+
+// ResolveLatestTransaction follows re-encryptions, rekeys and updates forward from transactionId and returns the ID of the current
+// version of the file, which is transactionId itself when it was never re-encrypted. If a file was re-encrypted more
+// than once from the same version, the newest re-encryption wins.
+func (b *Blockchain) ResolveLatestTransaction(transactionId string) (string, error) {
+	if transactionId == "" {
+		return "", errors.New("transaction ID should not be an empty string")
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	location, ok := b.txs[transactionId]
+	if !ok {
+		return "", errors.New("could not locate transaction")
+	}
+	return b.resolveLatest(b.index.blockStart[location.block] + location.tx)
+}
+
+// resolveLatest is ResolveLatestTransaction by sequence number for callers already holding the chain lock
+func (b *Blockchain) resolveLatest(seq int) (string, error) {
+	for {
+		successors := b.index.byPrevious[b.transactionAt(seq).ID]
+		if len(successors) == 0 {
+			break
+		}
+		seq = successors[len(successors)-1]
+	}
+
+	latest := b.transactionAt(seq)
+	if latest.Pruned {
+		return "", ErrFileDeleted //records are only pruned once no live file needs them
+	}
+	for _, later := range b.index.byIPFSHash[latest.Data.IPFSHash] {
+		data := b.transactionAt(later).Data
+		if later > seq && data.kind == TX_FILE_DELETED && data.groupId == latest.Data.groupId {
+			return "", ErrFileDeleted
+		}
+	}
+	return latest.ID, nil
+}
+
+func (b *Blockchain) transactionAt(seq int) Transaction {
+	location := b.index.locations[seq]
+	return b.blocks[location.block].Transactions[location.tx]
+}
+
+// resolveLatestIn is ResolveLatestTransaction over a plain list of transactions in chain order,
+// for ledgers that don't keep an index. Only versions checkPrevious accepts count as a successor, and only deletions
+// it accepts delete.
+func resolveLatestIn(transactions []Transaction, transactionId string, registry *IPFSProxy) (string, error) {
+	position := map[string]int{}
+	successor := map[string]int{}
+	deletions := map[int]bool{}
+	for i, tx := range transactions {
+		position[tx.ID] = i
+		if tx.Data.previousId == "" {
+			continue
+		}
+		previous, found := position[tx.Data.previousId]
+		if !found || checkPrevious(tx.Data, transactions[previous].Data, true, registry) != nil {
+			continue
+		}
+		if tx.Data.kind == TX_FILE_DELETED {
+			deletions[i] = true
+		} else {
+			successor[tx.Data.previousId] = i //later ones overwrite earlier ones, the newest wins
+		}
+	}
+
+	current, ok := position[transactionId]
+	if !ok {
+		return "", errors.New("could not locate transaction")
+	}
+	for {
+		next, ok := successor[transactions[current].ID]
+		if !ok {
+			break
+		}
+		current = next
+	}
+
+	latest := transactions[current]
+	for i, tx := range transactions[current+1:] {
+		if deletions[current+1+i] && tx.Data.IPFSHash == latest.Data.IPFSHash && tx.Data.groupId == latest.Data.groupId {
+			return "", ErrFileDeleted
+		}
+	}
+	return latest.ID, nil
+}
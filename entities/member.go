@@ -4,6 +4,7 @@ import (
 	"blockchain-fileshare/utils"
 	"errors"
 	"path/filepath"
+	"sync"
 )
 
 type GroupMember struct {
@@ -28,11 +29,9 @@ func (g GroupMember) GetUuid() string {
 	return g.uuid
 }
 
-func (g GroupMember) IsMemberOf(proxy *IPFSProxy, groupID string) (bool, error) {
-	for _, m := range proxy.groups[groupID].users {
-		if m.uuid == g.GetUuid() {
-			return true, nil
-		}
+func (g GroupMember) IsMemberOf(proxy Proxy, groupID string) (bool, error) {
+	if proxy.IsMember(groupID, g.GetUuid()) {
+		return true, nil
 	}
 
 	return false, errors.New("is not a member")
@@ -48,30 +47,25 @@ func (g GroupMember) SignSignature(filePath string) ([]byte, error) {
 	return signature, nil
 }
 
-func (g *GroupMember) UploadFile(operator *Operators, groupOwner *GroupOwner, groupID string, filePath string) (string, string, error) {
-	if isMember, err := g.IsMemberOf(operator.proxy, groupID); !isMember {
-		return "", "", err
-	}
+// SignTransaction attributes the ledger record to this user and signs it, the ledger refuses unsigned records
+func (g GroupMember) SignTransaction(data Data) (Data, error) {
+	data.userId = g.GetUuid()
+	return signTransaction(data, g.publicKey, g.privateKey)
+}
 
-	signature, err := utils.SignSignature(filePath, g.privateKey)
-	if err != nil {
+// tags go on the ledger with the file so group policies can refer to them
+func (g *GroupMember) UploadFile(operator *Operators, groupOwner *GroupOwner, groupID string, filePath string, tags ...string) (string, string, error) {
+	if isMember, err := g.IsMemberOf(operator.proxy, groupID); !isMember {
 		return "", "", err
 	}
 
-	uploadReq := UploadRequest{
-		filePath:          filePath,
-		groupID:           groupID,
-		requestedUserUuid: g.GetUuid(),
-		signature:         signature,
-	}
-
-	err = operator.proxy.VerifySignature(signature, uploadReq)
+	uploadReq, done, err := signUpload(operator.proxy, groupID, g.GetUuid(), filePath, g.privateKey)
 	if err != nil {
 		return "", "", err
 	}
+	defer done()
 
-	//a good implementation should have VerifySignature wrapped inside UploadFileToIPFS
-	handle, checksum, err := operator.proxy.UploadFileToIPFS(operator.sh, uploadReq)
+	handle, checksum, fileKey, err := operator.proxy.Upload(uploadReq)
 	if err != nil {
 		return "", "", err
 	}
@@ -82,8 +76,17 @@ func (g *GroupMember) UploadFile(operator *Operators, groupOwner *GroupOwner, gr
 		fileHash:      checksum,
 		IPFSHash:      handle,
 		fileExtension: filepath.Ext(filePath),
+		tags:          tags,
+		fileKey:       fileKey,
+	}
+	transactionData, err = g.SignTransaction(transactionData)
+	if err != nil {
+		return "", "", err
+	}
+	transactionHash, err := operator.recordUpload(transactionData)
+	if err != nil {
+		return "", "", err
 	}
-	transactionHash := operator.blockchain.CreateTransaction(transactionData)
 
 	file := File{
 		fileExtension: filepath.Ext(filePath),
@@ -93,6 +96,8 @@ func (g *GroupMember) UploadFile(operator *Operators, groupOwner *GroupOwner, gr
 		TransactionID: transactionHash,
 	}
 
+	groupOwner.mu.Lock()
+	defer groupOwner.mu.Unlock()
 	groupIdx := -1
 	for idx, group := range groupOwner.groupsOwned {
 		if group.groupID == groupID {
@@ -114,54 +119,53 @@ func (g GroupMember) ReadFile(operator *Operators, groupID string, handle string
 }
 
 func (g GroupMember) DownloadFile(operator *Operators, groupID string, transactionHash string) (string, string, error) {
-	data, err := operator.blockchain.GetTransactionByHash(transactionHash)
+	//a bookmarked ID may point at a version of the file that has since been re-encrypted
+	latestHash, err := operator.blockchain.ResolveLatestTransaction(transactionHash)
 	if err != nil {
 		return "", "", err
 	}
-
-	downloadRequest := DownloadRequest{
-		requestedUserId:        g.GetUuid(),
-		groupId:                groupID,
-		IPFSHandle:             data.IPFSHash,
-		requestedUserPublicKey: g.GetPublicKey(),
-	}
-
-	signature, err := SignDownloadRequest(downloadRequest, g.privateKey)
+	data, err := operator.blockchain.GetTransactionByHash(latestHash)
 	if err != nil {
 		return "", "", err
 	}
 
-	_, err = operator.proxy.VerifyDownloadReqSignature(downloadRequest, signature)
+	downloadRequest := newDownloadRequest(g.GetUuid(), groupID, data.IPFSHash, g.GetPublicKey(), latestHash)
+	downloadRequest.keyRelease, err = g.SignTransaction(Data{
+		groupId:  groupID,
+		IPFSHash: data.IPFSHash,
+		kind:     TX_KEY_RELEASED,
+		fileId:   latestHash,
+		nonce:    downloadRequest.nonce,
+	})
 	if err != nil {
 		return "", "", err
 	}
 
-	file, encryptedGroupPrivateKey, err := operator.proxy.DownloadFileFromIPFS(operator.sh, downloadRequest)
-	if err != nil {
-		return "", "", err
-	}
-
-	decryptedGroupPrivateKey, err := utils.DecryptKey(encryptedGroupPrivateKey, g.privateKey)
+	signature, err := SignDownloadRequest(downloadRequest, g.privateKey)
 	if err != nil {
 		return "", "", err
 	}
 
-	decryptedFilePath, checksumHash, err := utils.DecryptFile(file, decryptedGroupPrivateKey)
+	releasedKey, err := operator.proxy.ReleaseKey(downloadRequest, signature)
 	if err != nil {
 		return "", "", err
 	}
 
-	return decryptedFilePath, checksumHash, nil
+	return downloadAndDecrypt(operator.sh, downloadRequest, releasedKey, g.privateKey)
 }
 
-func (g GroupMember) DeleteFile(operator *Operators, groupID string, handle string) error {
-
-	return nil
+// DeleteFile deletes a file of the group, transactionID may be any version of it. A member can only delete a file
+// whose current version they recorded.
+func (g GroupMember) DeleteFile(operator *Operators, groupOwner *GroupOwner, groupID string, transactionID string) error {
+	return deleteFile(operator, groupOwner, groupID, transactionID, g.SignTransaction)
 }
 
 func CreateIPFSProxy() *IPFSProxy {
 	return &IPFSProxy{
-		groups: map[string]GroupMetadata{},
+		mu:       &sync.RWMutex{},
+		groups:   map[string]GroupMetadata{},
+		replays:  newReplayCache(REPLAY_CACHE_SIZE, REPLAY_CACHE_PER_USER, MAX_DOWNLOAD_REQUEST_LIFETIME),
+		releases: newReleaseGate(),
 	}
 }
 
@@ -0,0 +1,259 @@
+package entities
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_BLOCK_TRANSACTIONS = 100
+	DEFAULT_MAX_BLOCK_DELAY        = 500 * time.Millisecond
+	DEFAULT_MAX_PENDING            = 10000
+)
+
+type TransactionStatus uint8
+
+const (
+	TX_STATUS_UNKNOWN   TransactionStatus = iota //never seen, or dropped
+	TX_STATUS_PENDING                            //accepted, waiting in the mempool (or re-queued after a fork switch)
+	TX_STATUS_COMMITTED                          //in a block on the chain
+)
+
+func (s TransactionStatus) String() string {
+	switch s {
+	case TX_STATUS_PENDING:
+		return "pending"
+	case TX_STATUS_COMMITTED:
+		return "committed"
+	}
+	return "unknown"
+}
+
+// MempoolConfig decides when pending transactions are sealed, zero fields fall back to the defaults
+type MempoolConfig struct {
+	MaxBlockTransactions int           //a block is sealed as soon as this many transactions are waiting
+	MaxBlockDelay        time.Duration //otherwise whatever is waiting is sealed once the oldest has waited this long
+	MaxPending           int           //new transactions are turned away while this many are waiting
+}
+
+type mempool struct {
+	config  MempoolConfig
+	pending []Transaction
+	ids     map[string]bool
+	oldest  time.Time //when the first transaction still pending arrived
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// EnableMempool stops CreateTransaction from sealing a block per transaction. Transactions are validated and queued
+// instead, and a background sealer turns them into blocks by size or age. CreateTransaction then returns as soon as the
+// transaction is pending, callers that need it to be durable wait with WaitForConfirmation.
+func (b *Blockchain) EnableMempool(config MempoolConfig) error {
+	if config.MaxBlockTransactions < 0 || config.MaxBlockDelay < 0 || config.MaxPending < 0 {
+		return errors.New("mempool limits must not be negative")
+	}
+	if config.MaxBlockTransactions == 0 {
+		config.MaxBlockTransactions = DEFAULT_MAX_BLOCK_TRANSACTIONS
+	}
+	if config.MaxBlockDelay == 0 {
+		config.MaxBlockDelay = DEFAULT_MAX_BLOCK_DELAY
+	}
+	if config.MaxPending == 0 {
+		config.MaxPending = DEFAULT_MAX_PENDING
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mempool != nil {
+		return errors.New("mempool is already enabled")
+	}
+
+	b.mempool = &mempool{
+		config: config,
+		ids:    map[string]bool{},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	b.mempool.wg.Add(1)
+	go b.runMempool(b.mempool)
+	return nil
+}
+
+// queue adds an already validated transaction to the mempool, the chain lock must be held
+func (b *Blockchain) queue(tx Transaction) error {
+	pool := b.mempool
+	if pool.ids[tx.ID] {
+		return ErrAlreadyPending
+	}
+	if len(pool.pending) >= pool.config.MaxPending {
+		return errors.New("mempool is full")
+	}
+
+	if len(pool.pending) == 0 {
+		pool.oldest = time.Now()
+	}
+	pool.pending = append(pool.pending, tx)
+	pool.ids[tx.ID] = true
+	if len(pool.pending) == 1 || len(pool.pending) >= pool.config.MaxBlockTransactions {
+		select {
+		case pool.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *Blockchain) runMempool(pool *mempool) {
+	defer pool.wg.Done()
+
+	timer := time.NewTimer(pool.config.MaxBlockDelay)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		wait := pool.config.MaxBlockDelay
+		if len(pool.pending) == 0 && len(b.orphans) > 0 {
+			b.flushMempool()
+		} else if len(pool.pending) > 0 {
+			due := pool.config.MaxBlockDelay - time.Since(pool.oldest)
+			if due <= 0 || len(pool.pending) >= pool.config.MaxBlockTransactions {
+				//on failure (typically not our turn under proof of authority) retry after a full delay or once the chain moves
+				b.flushMempool()
+			} else {
+				wait = due
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-pool.wake:
+		case <-changed:
+		case <-timer.C:
+		case <-pool.done:
+			return
+		}
+	}
+}
+
+// flushMempool seals everything pending (orphans of a fork switch first) into blocks of at most MaxBlockTransactions,
+// the chain lock must be held. Whatever could not be sealed stays pending.
+func (b *Blockchain) flushMempool() error {
+	pool := b.mempool
+	for {
+		b.dropCommitted()
+		if len(pool.pending) == 0 {
+			return b.sealPending(nil)
+		}
+
+		batch := pool.pending
+		if len(batch) > pool.config.MaxBlockTransactions {
+			batch = batch[:pool.config.MaxBlockTransactions]
+		}
+		if err := b.sealPending(append([]Transaction{}, batch...)); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Blockchain) dropCommitted() {
+	pool := b.mempool
+	remaining := []Transaction{}
+	for _, tx := range pool.pending {
+		if _, exists := b.txs[tx.ID]; exists {
+			delete(pool.ids, tx.ID)
+			continue
+		}
+		remaining = append(remaining, tx)
+	}
+	pool.pending = remaining
+}
+
+// Flush seals every pending transaction right away instead of waiting for the size or age limit
+func (b *Blockchain) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mempool == nil {
+		return b.sealPending(nil)
+	}
+	return b.flushMempool()
+}
+
+// stopMempool ends the background sealer, it must be called without the chain lock held
+func (b *Blockchain) stopMempool() {
+	b.mu.RLock()
+	pool := b.mempool
+	b.mu.RUnlock()
+	if pool == nil {
+		return
+	}
+
+	select {
+	case <-pool.done:
+	default:
+		close(pool.done)
+	}
+	pool.wg.Wait()
+}
+
+// TransactionStatus tells whether a transaction is on the chain, waiting to be sealed or not known at all
+func (b *Blockchain) TransactionStatus(transactionId string) TransactionStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.transactionStatus(transactionId)
+}
+
+func (b *Blockchain) transactionStatus(transactionId string) TransactionStatus {
+	if _, ok := b.txs[transactionId]; ok {
+		return TX_STATUS_COMMITTED
+	}
+	if b.mempool != nil && b.mempool.ids[transactionId] {
+		return TX_STATUS_PENDING
+	}
+	for _, tx := range b.orphans {
+		if tx.ID == transactionId {
+			return TX_STATUS_PENDING
+		}
+	}
+	return TX_STATUS_UNKNOWN
+}
+
+// WaitForConfirmation blocks until the transaction is in a block on the chain or timeout runs out.
+// A zero timeout waits for as long as it takes.
+func (b *Blockchain) WaitForConfirmation(transactionId string, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		b.mu.RLock()
+		status := b.transactionStatus(transactionId)
+		changed := b.changed
+		b.mu.RUnlock()
+
+		switch status {
+		case TX_STATUS_COMMITTED:
+			return nil
+		case TX_STATUS_UNKNOWN:
+			return errors.New("transaction is not pending or on the ledger")
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return errors.New("timed out waiting for the transaction to be committed")
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package entities
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// merkleRoot folds the hashed transaction IDs of a block pairwise until one hash is left and commits to that together
+// with the number of transactions, so a proof can't claim another shape of the tree. When a level has an odd number
+// of nodes, the last one is carried up as is instead of being paired with itself.
+func merkleRoot(transactionIDs []string) string {
+	if len(transactionIDs) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	level := merkleLeaves(transactionIDs)
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+	return hex.EncodeToString(commitMerkleTree(level[0], len(transactionIDs)))
+}
+
+func merkleLeaves(transactionIDs []string) [][]byte {
+	leaves := make([][]byte, 0, len(transactionIDs))
+	for _, id := range transactionIDs {
+		leaf, err := hex.DecodeString(id)
+		if err != nil {
+			leaf = []byte(id) //a malformed ID still has to produce a (wrong) root rather than panic
+		}
+		leaves = append(leaves, hashMerkleLeaf(leaf))
+	}
+	return leaves
+}
+
+func hashMerkleLeaf(transactionID []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00}) //domain separation from inner nodes (0x01), neither can be passed off as the other
+	h.Write(transactionID)
+	return h.Sum(nil)
+}
+
+func commitMerkleTree(top []byte, leafCount int) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x02})
+	h.Write(binary.AppendUvarint(nil, uint64(leafCount)))
+	h.Write(top)
+	return h.Sum(nil)
+}
+
+func nextMerkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, hashMerkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+func hashMerkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+type MerkleProofStep struct {
+	Sibling string //hex hash to combine with at this level
+	Left    bool   //whether Sibling goes on the left, which follows from Position
+}
+
+// MerkleProof shows that a transaction is the one at Position among the LeafCount transactions of the block at
+// BlockIndex, levels where the node was carried up without a sibling have no step
+type MerkleProof struct {
+	TransactionID string
+	BlockIndex    int
+	Position      int
+	LeafCount     int
+	Steps         []MerkleProofStep
+}
+
+func merkleProof(transactionIDs []string, position int) []MerkleProofStep {
+	level := merkleLeaves(transactionIDs)
+	steps := []MerkleProofStep{}
+	for len(level) > 1 {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			steps = append(steps, MerkleProofStep{Sibling: hex.EncodeToString(level[sibling]), Left: sibling < position})
+		}
+		level = nextMerkleLevel(level)
+		position /= 2
+	}
+	return steps
+}
+
+// GetInclusionProof returns the proof that a transaction is in the ledger together with the header of its block.
+// The header is all an auditor needs besides the proof, see VerifyInclusionProof.
+func (b *Blockchain) GetInclusionProof(transactionId string) (MerkleProof, BlockHeader, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	location, ok := b.txs[transactionId]
+	if !ok {
+		return MerkleProof{}, BlockHeader{}, errors.New("could not locate transaction")
+	}
+
+	block := b.blocks[location.block]
+	proof := MerkleProof{
+		TransactionID: transactionId,
+		BlockIndex:    location.block,
+		Position:      location.tx,
+		LeafCount:     len(block.Transactions),
+		Steps:         merkleProof(transactionIDs(block.Transactions), location.tx),
+	}
+	return proof, block.Header, nil
+}
+
+// VerifyInclusionProof checks a proof against a block header without access to the ledger. Whether the header itself
+// belongs to the chain is up to the caller, e.g. by following PrevHash links between headers they already trust.
+func VerifyInclusionProof(proof MerkleProof, header BlockHeader) error {
+	if proof.BlockIndex != header.Index {
+		return errors.New("proof is for a different block")
+	}
+	if header.Hash != header.computeHash() {
+		return errors.New("block header does not match its hash")
+	}
+
+	transactionID, err := hex.DecodeString(proof.TransactionID)
+	if err != nil {
+		return errors.New("malformed transaction ID")
+	}
+	if proof.Position < 0 || proof.Position >= proof.LeafCount {
+		return errors.New("proof position is out of range")
+	}
+
+	//the steps have to be exactly the ones the position calls for, on the side it calls for
+	node := hashMerkleLeaf(transactionID)
+	steps := proof.Steps
+	position, size := proof.Position, proof.LeafCount
+	for ; size > 1; position, size = position/2, (size+1)/2 {
+		sibling := position ^ 1
+		if sibling >= size {
+			continue
+		}
+		if len(steps) == 0 || steps[0].Left != (sibling < position) {
+			return errors.New("proof does not match the position of the transaction")
+		}
+		siblingHash, err := hex.DecodeString(steps[0].Sibling)
+		if err != nil {
+			return errors.New("malformed proof step")
+		}
+		if steps[0].Left {
+			node = hashMerkleNode(siblingHash, node)
+		} else {
+			node = hashMerkleNode(node, siblingHash)
+		}
+		steps = steps[1:]
+	}
+	if len(steps) > 0 {
+		return errors.New("proof does not match the position of the transaction")
+	}
+
+	if hex.EncodeToString(commitMerkleTree(node, proof.LeafCount)) != header.MerkleRoot {
+		return errors.New("transaction is not included in this block")
+	}
+	return nil
+}
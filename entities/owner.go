@@ -1,13 +1,12 @@
 package entities
 
 import (
-	keys "blockchain-fileshare/keys"
+	"blockchain-fileshare/ipfs"
 	"blockchain-fileshare/utils"
 	"errors"
 	"fmt"
 	"path/filepath"
-
-	"github.com/google/uuid"
+	"sync"
 )
 
 type GroupOwner struct {
@@ -15,13 +14,12 @@ type GroupOwner struct {
 	groupsOwned []Group
 	publicKey   []byte
 	privateKey  []byte
+	mu          *sync.Mutex //guards groupsOwned, a StaleFileSweeper changes the files in it from its own goroutine
 }
 
-func (g GroupOwner) IsMemberOf(proxy *IPFSProxy, groupID string) (bool, error) {
-	for _, m := range proxy.groups[groupID].users {
-		if m.uuid == g.GetUuid() {
-			return true, nil
-		}
+func (g GroupOwner) IsMemberOf(proxy Proxy, groupID string) (bool, error) {
+	if proxy.IsMember(groupID, g.GetUuid()) {
+		return true, nil
 	}
 
 	return false, errors.New("is not a member")
@@ -36,15 +34,59 @@ func (g GroupOwner) SignSignature(filePath string) ([]byte, error) {
 	return signature, nil
 }
 
-func (g *GroupOwner) RegisterNewGroup(proxy *IPFSProxy) string {
-	groupUuid := uuid.New().String()[:6]
-	public, private := keys.GenerateKeyPair(groupUuid)
+// SignTransaction attributes the ledger record to this user and signs it, the ledger refuses unsigned records
+func (g GroupOwner) SignTransaction(data Data) (Data, error) {
+	data.userId = g.GetUuid()
+	return signTransaction(data, g.publicKey, g.privateKey)
+}
 
+// signGroupRequest fills in the owner and signs request for proxy, the proxy only acts on group changes signed by the
+// owner
+func (g GroupOwner) signGroupRequest(proxy Proxy, request GroupRequest) (GroupRequest, error) {
+	request, err := proxy.prepareGroupRequest(request)
+	if err != nil {
+		return GroupRequest{}, err
+	}
+	request.ownerId = g.GetUuid()
+	signature, err := utils.SignBytes(request.signingBytes(), g.privateKey)
+	if err != nil {
+		return GroupRequest{}, err
+	}
+	request.signature = signature
+	return request, nil
+}
+
+// the proxy generates the group key pair and keeps the private half, the owner only learns the public one
+func (g *GroupOwner) RegisterNewGroup(proxy Proxy) string {
+	request, err := g.signGroupRequest(proxy, GroupRequest{action: GROUP_REGISTER, publicKey: g.publicKey})
+	if err != nil {
+		fmt.Println("could not sign group registration", err)
+		return ""
+	}
+	groupUuid, public, err := proxy.RegisterGroup(request)
+	if err != nil {
+		fmt.Println("could not register group", err)
+		return ""
+	}
+
+	//a group the ledger does not know about can't have files downloaded from it, so this fails the registration
+	_, err = g.recordOnLedger(proxy.connectedLedger(), Data{
+		groupId:  groupUuid,
+		memberId: g.GetUuid(),
+		groupKey: keyFingerprint(public),
+		kind:     TX_GROUP_CREATED,
+	})
+	if err != nil {
+		fmt.Println("could not record group creation", err)
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	newG := GroupOwner{
 		uuid:        g.GetUuid(),
 		groupsOwned: g.groupsOwned,
 		publicKey:   public,
-		privateKey:  private,
 	}
 	group := Group{ //this is stored with the group owner
 		groupID:      groupUuid,
@@ -52,30 +94,31 @@ func (g *GroupOwner) RegisterNewGroup(proxy *IPFSProxy) string {
 		files:        []File{},
 	}
 
-	groupMetadata := GroupMetadata{ //this is stored with IPFS Proxy
-		ownerUuid:  g.GetUuid(),
-		groupUuid:  groupUuid,
-		publicKey:  public,
-		privateKey: private,
-		users: []UserMetadata{
-			UserMetadata{
-				uuid:      g.GetUuid(),
-				publicKey: g.publicKey,
-			},
-		},
-	}
-
 	g.groupsOwned = append(g.groupsOwned, group)
-	(*proxy).groups[groupUuid] = groupMetadata
 	return groupUuid
 }
 
+// recordOnLedger signs a group lifecycle record as the owner and appends it, proxies that aren't wired to a ledger skip it
+func (g GroupOwner) recordOnLedger(ledger Ledger, data Data) (string, error) {
+	if ledger == nil {
+		return "", nil
+	}
+
+	data, err := g.SignTransaction(data)
+	if err != nil {
+		return "", err
+	}
+	return ledger.CreateTransaction(data)
+}
+
 func (g *GroupOwner) AddNewMember(groupID string, memberUuid string, allUsers []Member) error {
 	member, isValid := isValidMember(memberUuid, allUsers)
 	if !isValid {
 		return errors.New("invalid member/user uuid")
 	}
 
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for _, group := range g.groupsOwned {
 		if group.groupID == groupID {
 			group.groupMembers = append(group.groupMembers, member)
@@ -86,143 +129,127 @@ func (g *GroupOwner) AddNewMember(groupID string, memberUuid string, allUsers []
 	return errors.New("unexpected error while adding new member to the group")
 }
 
-func (g *GroupOwner) registerNewMemberInIPFSProxy(proxy *IPFSProxy, groupUuid string, member Member) error {
-	groupMetadata, exists := proxy.groups[groupUuid]
-	if !exists {
-		return errors.New("group does not exist!")
-	}
-
-	for _, m := range groupMetadata.users {
-		if m.uuid == member.GetUuid() {
-			return errors.New("user was already added!")
-		}
-	}
-
-	groupMetadata.users = append(groupMetadata.users, UserMetadata{
-		uuid:      member.GetUuid(),
+func (g *GroupOwner) registerNewMemberInIPFSProxy(proxy Proxy, groupUuid string, member Member) error {
+	request, err := g.signGroupRequest(proxy, GroupRequest{
+		action:    GROUP_ADD_MEMBER,
+		groupId:   groupUuid,
+		memberId:  member.GetUuid(),
 		publicKey: member.GetPublicKey(),
 	})
-
-	proxy.groups[groupUuid] = groupMetadata
-	return nil
+	if err != nil {
+		return err
+	}
+	return proxy.AddMember(request)
 }
 
 func (g GroupOwner) ListFiles(groupID string) ([]File, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for _, group := range g.groupsOwned {
 		if group.groupID == groupID {
-			return group.files, nil
+			return append([]File{}, group.files...), nil
 		}
 	}
 	return nil, errors.New("unable to locate files")
 }
 
-func (g *GroupOwner) removeMemberInIPFSProxy(proxy *IPFSProxy, groupUuid string, member Member) error {
-	groupMetadata, exists := proxy.groups[groupUuid]
-	if !exists {
-		return errors.New("group does not exist!")
-	}
-
-	i := -1
-	for idx, m := range groupMetadata.users {
-		if m.uuid == member.GetUuid() {
-			i = idx
-			break
-		}
-	}
-	if i == -1 {
-		return errors.New("user not found!")
+func (g *GroupOwner) removeMemberInIPFSProxy(proxy Proxy, groupUuid string, member Member) error {
+	request, err := g.signGroupRequest(proxy, GroupRequest{
+		action:   GROUP_REMOVE_MEMBER,
+		groupId:  groupUuid,
+		memberId: member.GetUuid(),
+	})
+	if err != nil {
+		return err
 	}
-
-	groupMetadata.users = append(groupMetadata.users[:i], groupMetadata.users[i+1:]...)
-	proxy.groups[groupUuid] = groupMetadata
-	return nil
+	return proxy.RemoveMember(request)
 }
 
-func (g *GroupOwner) AddNewMemberObj(proxy *IPFSProxy, groupID string, member Member) error {
+func (g *GroupOwner) AddNewMemberObj(proxy Proxy, groupID string, member Member) error {
 	fmt.Println("group to find", groupID)
+	g.mu.Lock()
 	fmt.Println(g.groupsOwned)
-	for idx, group := range g.groupsOwned {
-
-		if group.groupID == groupID {
-			group.groupMembers = append(group.groupMembers, member)
-			g.groupsOwned[idx].groupMembers = group.groupMembers
-			g.registerNewMemberInIPFSProxy(proxy, groupID, member)
-			return nil
-		}
+	groupIdx := g.ownedGroupIndex(groupID)
+	if groupIdx != -1 {
+		g.groupsOwned[groupIdx].groupMembers = append(g.groupsOwned[groupIdx].groupMembers, member)
+	}
+	g.mu.Unlock()
+	if groupIdx == -1 {
+		return errors.New("unexpected error while adding new member to the group")
 	}
 
-	return errors.New("unexpected error while adding new member to the group")
+	if err := g.registerNewMemberInIPFSProxy(proxy, groupID, member); err != nil {
+		return err
+	}
+	_, err := g.recordOnLedger(proxy.connectedLedger(), Data{
+		groupId:  groupID,
+		memberId: member.GetUuid(),
+		kind:     TX_MEMBER_ADDED,
+	})
+	return err
 }
 
 func (g *GroupOwner) RemoveMemberObj(operator *Operators, groupID string, member Member) error {
-	memberToBeRemoved := GroupMember{}
-	groupsOwned := g.groupsOwned
-	gIndex := -1
-	mIndex := -1
-	fmt.Println("Member id", member.GetUuid())
-	for gIdx, group := range groupsOwned {
-		if group.groupID == groupID {
-			gIndex = gIdx
-			members := group.groupMembers
-			fmt.Println("memers", members)
-			for idx, m := range members {
-
-				if m.GetUuid() == member.GetUuid() {
+	_, err := g.dropMember(operator, groupID, member)
+	return err
+}
 
-					mIndex = idx
-					break
-				}
-			}
+func (g *GroupOwner) RemoveMemberObjAndSecureFiles(operator *Operators, groupID string, member Member) error {
+	gIndex, err := g.dropMember(operator, groupID, member)
+	if err != nil {
+		return err
+	}
+	//this is the most crucial part for our threat model: the removed member can't get the new data keys, and the files
+	//they might have the data key of are re-encrypted now or later depending on the group's RevocationMode
+	_, err = rotateGroupKey(operator, g, gIndex, groupID, true)
+	return err
+}
 
-			break
-		}
+// dropMember takes member out of the group on the proxy, in g and on the ledger and returns the index of the group in
+// groupsOwned. g.mu is only held while groupsOwned is looked at, never across the proxy or the ledger.
+func (g *GroupOwner) dropMember(operator *Operators, groupID string, member Member) (int, error) {
+	fmt.Println("Member id", member.GetUuid())
+	g.mu.Lock()
+	gIndex, mIndex := g.ownedGroupIndex(groupID), -1
+	if gIndex != -1 {
+		mIndex = g.memberIndex(gIndex, member.GetUuid())
 	}
+	g.mu.Unlock()
 
 	fmt.Println("group index", gIndex, "m index", mIndex)
 	if gIndex == -1 || mIndex == -1 {
-		fmt.Println("Group INdex", gIndex, "M index", mIndex)
-		return errors.New("unexpected error while removing member from the group")
+		return -1, errors.New("unexpected error while removing member from the group")
 	}
 
-	g.removeMemberInIPFSProxy(operator.proxy, groupID, memberToBeRemoved)
-	g.groupsOwned[gIndex].groupMembers = append(g.groupsOwned[gIndex].groupMembers[:mIndex], g.groupsOwned[gIndex].groupMembers[mIndex+1:]...)
-	return nil
+	if err := g.removeMemberInIPFSProxy(operator.proxy, groupID, member); err != nil {
+		return -1, err
+	}
+	g.mu.Lock()
+	//groups are only ever added to groupsOwned, gIndex still holds but the members may have changed in the meantime
+	if mIndex = g.memberIndex(gIndex, member.GetUuid()); mIndex != -1 {
+		g.groupsOwned[gIndex].groupMembers = append(g.groupsOwned[gIndex].groupMembers[:mIndex], g.groupsOwned[gIndex].groupMembers[mIndex+1:]...)
+	}
+	g.mu.Unlock()
+	_, err := g.recordOnLedger(operator.blockchain, Data{
+		groupId:  groupID,
+		memberId: member.GetUuid(),
+		kind:     TX_MEMBER_REMOVED,
+	})
+	if err != nil {
+		return -1, err
+	}
+	return gIndex, nil
 }
 
-func (g *GroupOwner) RemoveMemberObjAndSecureFiles(operator *Operators, groupID string, member Member) error {
-	memberToBeRemoved := GroupMember{}
-	groupsOwned := g.groupsOwned
-	gIndex := -1
-	mIndex := -1
-	fmt.Println("Member id", member.GetUuid())
-	for gIdx, group := range groupsOwned {
-		if group.groupID == groupID {
-			gIndex = gIdx
-			members := group.groupMembers
-			fmt.Println("memers", members)
-			for idx, m := range members {
-
-				if m.GetUuid() == member.GetUuid() {
-
-					mIndex = idx
-					break
-				}
-			}
-
-			break
+// memberIndex is the index of memberId in the members of groupsOwned[groupIdx], -1 when it is not one. The caller holds
+// g.mu.
+func (g *GroupOwner) memberIndex(groupIdx int, memberId string) int {
+	for idx, m := range g.groupsOwned[groupIdx].groupMembers {
+		if m.GetUuid() == memberId {
+			return idx
 		}
 	}
-
-	fmt.Println("group index", gIndex, "m index", mIndex)
-	if gIndex == -1 || mIndex == -1 {
-		fmt.Println("Group INdex", gIndex, "M index", mIndex)
-		return errors.New("unexpected error while removing member from the group")
-	}
-
-	g.removeMemberInIPFSProxy(operator.proxy, groupID, memberToBeRemoved)
-	g.groupsOwned[gIndex].groupMembers = append(g.groupsOwned[gIndex].groupMembers[:mIndex], g.groupsOwned[gIndex].groupMembers[mIndex+1:]...)
-	operator.proxy.ChangeKeyAndSecureFiles(operator, g, gIndex, groupID) //this is the most crucial part for our threat model
-	return nil
+	return -1
 }
 
 func (g *GroupOwner) RemoveMember(groupID string, memberUuid string, allUsers []Member) error {
@@ -231,6 +258,8 @@ func (g *GroupOwner) RemoveMember(groupID string, memberUuid string, allUsers []
 		return errors.New("invalid member/user UUID")
 	}
 
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for i, group := range g.groupsOwned {
 		if group.groupID == groupID {
 
@@ -266,70 +295,92 @@ When they do click the file they intend to download, only transactionHash is use
 *
 */
 func (g GroupOwner) DownloadFile(operator *Operators, groupID string, transactionHash string) (string, string, error) {
-	data, err := operator.blockchain.GetTransactionByHash(transactionHash)
+	//a bookmarked ID may point at a version of the file that has since been re-encrypted
+	latestHash, err := operator.blockchain.ResolveLatestTransaction(transactionHash)
 	if err != nil {
-		return "", "", nil
+		return "", "", err
 	}
-
-	downloadRequest := DownloadRequest{
-		requestedUserId: g.GetUuid(),
-		groupId:         groupID,
-		IPFSHandle:      data.IPFSHash,
-		requestedUserPublicKey: g.GetPublicKey(),
+	data, err := operator.blockchain.GetTransactionByHash(latestHash)
+	if err != nil {
+		return "", "", nil
 	}
 
-	signature, err := SignDownloadRequest(downloadRequest, g.privateKey)
+	downloadRequest, releasedKey, err := g.requestKey(operator, groupID, latestHash, data)
 	if err != nil {
 		return "", "", err
 	}
 
-	_, err = operator.proxy.VerifyDownloadReqSignature(downloadRequest, signature)
+	return downloadAndDecrypt(operator.sh, downloadRequest, releasedKey, g.privateKey)
+}
+
+// requestKey asks the proxy for the key of the file version latestHash (data is its record), the released key still
+// has to be opened with openReleasedKey
+func (g GroupOwner) requestKey(operator *Operators, groupID string, latestHash string, data Data) (DownloadRequest, []byte, error) {
+	downloadRequest := newDownloadRequest(g.GetUuid(), groupID, data.IPFSHash, g.GetPublicKey(), latestHash)
+	var err error
+	downloadRequest.keyRelease, err = g.SignTransaction(Data{
+		groupId:  groupID,
+		IPFSHash: data.IPFSHash,
+		kind:     TX_KEY_RELEASED,
+		fileId:   latestHash,
+		nonce:    downloadRequest.nonce,
+	})
 	if err != nil {
-		return "", "", err
+		return DownloadRequest{}, nil, err
 	}
 
-	file, encryptedGroupPrivateKey, err := operator.proxy.DownloadFileFromIPFS(operator.sh, downloadRequest)
+	signature, err := SignDownloadRequest(downloadRequest, g.privateKey)
 	if err != nil {
-		return "", "", err
+		return DownloadRequest{}, nil, err
 	}
 
-	decryptedGroupPrivateKey, err := utils.DecryptKey(encryptedGroupPrivateKey, g.privateKey)
-	
-	decryptedFilePath, checksumHash, err := utils.DecryptFile(file, decryptedGroupPrivateKey)
+	releasedKey, err := operator.proxy.ReleaseKey(downloadRequest, signature)
 	if err != nil {
-		return "", "", err
+		return DownloadRequest{}, nil, err
 	}
-
-	return decryptedFilePath, checksumHash, nil
+	return downloadRequest, releasedKey, nil
 }
 
-func (g *GroupOwner) UploadFile(operator *Operators, groupID string, filePath string) (string, string, error) {
-	if isMember, err := g.IsMemberOf(operator.proxy, groupID); !isMember {
+// tags go on the ledger with the file so group policies can refer to them
+func (g *GroupOwner) UploadFile(operator *Operators, groupID string, filePath string, tags ...string) (string, string, error) {
+	file, err := g.upload(operator, groupID, filePath, TX_FILE_UPLOADED, "", tags)
+	if err != nil {
 		return "", "", err
 	}
 
-	signature, err := utils.SignSignature(filePath, g.privateKey)
-	if err != nil {
-		fmt.Println("here")
-		return "", "", err
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groupIdx := -1
+	for idx, group := range g.groupsOwned {
+		if group.groupID == groupID {
+			groupIdx = idx
+			break
+		}
+	}
+	if groupIdx == -1 {
+		return "", "", errors.New("unexpected error while finding group to insert the uploaded file metadata into")
 	}
 
-	uploadReq := UploadRequest{
-		filePath:          filePath,
-		groupID:           groupID,
-		requestedUserUuid: g.GetUuid(),
-		signature:         signature,
+	g.groupsOwned[groupIdx].files = append(g.groupsOwned[groupIdx].files, file)
+	return file.TransactionID, file.Handle, nil
+}
+
+// upload puts the file on IPFS and its record on the ledger, the caller decides what becomes of the group's file list.
+// New versions of a file are not new files, they name the transaction of the version they replace in previousId.
+func (g *GroupOwner) upload(operator *Operators, groupID string, filePath string, kind TransactionKind, previousId string, tags []string) (File, error) {
+	if isMember, err := g.IsMemberOf(operator.proxy, groupID); !isMember {
+		return File{}, err
 	}
 
-	err = operator.proxy.VerifySignature(signature, uploadReq)
+	uploadReq, done, err := signUpload(operator.proxy, groupID, g.GetUuid(), filePath, g.privateKey)
 	if err != nil {
-		return "", "", err
+		return File{}, err
 	}
+	defer done()
 
-	//a good implementation should have VerifySignature wrapped inside UploadFileToIPFS
-	handle, checksum, err := operator.proxy.UploadFileToIPFS(operator.sh, uploadReq)
+	handle, checksum, fileKey, err := operator.proxy.Upload(uploadReq)
 	if err != nil {
-		return "", "", err
+		return File{}, err
 	}
 
 	transactionData := Data{
@@ -338,33 +389,97 @@ func (g *GroupOwner) UploadFile(operator *Operators, groupID string, filePath st
 		fileHash:      checksum,
 		IPFSHash:      handle,
 		fileExtension: filepath.Ext(filePath),
+		kind:          kind,
+		previousId:    previousId,
+		tags:          tags,
+		fileKey:       fileKey,
+	}
+	transactionData, err = g.SignTransaction(transactionData)
+	if err != nil {
+		return File{}, err
+	}
+	transactionHash, err := operator.recordUpload(transactionData)
+	if err != nil {
+		return File{}, err
 	}
-	transactionHash := operator.blockchain.CreateTransaction(transactionData)
 
-	file := File{
+	return File{
 		fileExtension: filepath.Ext(filePath),
 		fileOwner:     g,
 		FileName:      filepath.Base(filePath),
 		Handle:        handle,
 		TransactionID: transactionHash,
+	}, nil
+}
+
+// SetPolicy replaces the access policy of the group, see ParsePolicy for the language. The policy is checked before it
+// goes on the ledger so proxies never have to deal with one that does not parse.
+func (g *GroupOwner) SetPolicy(operator *Operators, groupID string, policy string) error {
+	if _, err := ParsePolicy(policy); err != nil {
+		return err
+	}
+	if ownerId, err := operator.proxy.OwnerOf(groupID); err != nil || ownerId != g.GetUuid() {
+		return errors.New("only the group owner can set its policy")
 	}
 
-	groupIdx := -1
-	for idx, group := range g.groupsOwned {
-		if group.groupID == groupID {
-			groupIdx = idx
-			break
-		}
+	transactionHash, err := g.recordOnLedger(operator.blockchain, Data{
+		groupId: groupID,
+		policy:  policy,
+		kind:    TX_POLICY_SET,
+	})
+	if err != nil {
+		return err
 	}
+	return operator.blockchain.WaitForConfirmation(transactionHash, KEY_RELEASE_TIMEOUT)
+}
+
+// DeleteFile deletes a file of the group, transactionID may be any version of it. The owner can delete any file of
+// their group.
+func (g *GroupOwner) DeleteFile(operator *Operators, groupID string, transactionID string) error {
+	return deleteFile(operator, g, groupID, transactionID, g.SignTransaction)
+}
+
+// deleteFile records that the current version of a file of groupOwner's group is deleted, with the record signed by
+// sign, drops the file from the group and takes its ciphertext off IPFS. The ledger decides who may delete it (see
+// checkPrevious), nothing else happens when it refuses.
+func deleteFile(operator *Operators, groupOwner *GroupOwner, groupID string, transactionID string, sign func(data Data) (Data, error)) error {
+	groupOwner.mu.Lock()
+	defer groupOwner.mu.Unlock()
+
+	groupIdx := groupOwner.ownedGroupIndex(groupID)
 	if groupIdx == -1 {
-		return "", "", errors.New("unexpected error while finding group to insert the uploaded file metadata into")
+		return errors.New("group not found")
+	}
+	latestHash, err := operator.blockchain.ResolveLatestTransaction(transactionID)
+	if err != nil {
+		return err
+	}
+	data, err := operator.blockchain.GetTransactionByHash(latestHash)
+	if err != nil {
+		return err
+	}
+	if data.groupId != groupID {
+		return errors.New("file is not one of the group's files")
 	}
 
-	g.groupsOwned[groupIdx].files = append(g.groupsOwned[groupIdx].files, file)
-	return transactionHash, handle, nil
-}
+	deletion, err := sign(CreateDeleteData(groupID, data.IPFSHash, data.fileExtension, latestHash))
+	if err != nil {
+		return err
+	}
+	if _, err := operator.blockchain.CreateTransaction(deletion); err != nil {
+		return err
+	}
 
-func (g GroupOwner) DeleteFile(operator *Operators, groupID string, filename string) error {
+	files := groupOwner.groupsOwned[groupIdx].files
+	for idx, file := range files {
+		if file.TransactionID == latestHash {
+			groupOwner.groupsOwned[groupIdx].files = append(files[:idx], files[idx+1:]...)
+			break
+		}
+	}
+	if err := ipfs.DeleteFileFromIPFS(operator.sh, data.IPFSHash); err != nil {
+		return fmt.Errorf("could not delete the file from IPFS: %w", err)
+	}
 	return nil
 }
 
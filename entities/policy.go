@@ -0,0 +1,334 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const KEY_RELEASE_TIMEOUT = 30 * time.Second //how long the proxy waits for a key release or policy record to be committed
+
+/*
+*
+A group policy is a small text document, one rule per line. Blank lines and lines starting with # are ignored.
+
+	role <role> <userId>...          give users an extra role, every member has "member"
+	allow [conditions]               when there are allow rules, at least one of them has to match
+	deny [conditions]                any matching deny rule refuses the download
+	max-downloads <n> [conditions]   refuse once the user has had n keys released for the file
+
+Conditions narrow a rule down, a rule without conditions matches every download:
+
+	role <role>[,<role>...]          the user has one of the roles
+	tag <tag>[,<tag>...]             the file carries one of the tags
+	hours <HH:MM>-<HH:MM>            UTC time of day, the end is exclusive and the window may wrap past midnight
+	days <day>[,<day>...]            UTC day of the week, mon tue wed thu fri sat sun
+
+Policies are set by the group owner as ledger transactions and every proxy evaluates the latest one with Evaluate,
+which only looks at the policy and the AccessRequest, so two proxies with the same ledger make the same decision.
+The group owner is not bound by the policy, they can replace it whenever they like anyway.
+*
+*/
+type Policy struct {
+	roles map[string][]string //userId -> roles given by role lines
+	rules []policyRule
+}
+
+type policyRule struct {
+	line   int
+	effect string //allow, deny or max-downloads
+	limit  int    //for max-downloads
+
+	roles []string
+	tags  []string
+	hours []int //start and end as minutes into the day, nil when not restricted
+	days  map[time.Weekday]bool
+}
+
+// AccessRequest is everything a policy decision is based on
+type AccessRequest struct {
+	UserId    string
+	Roles     []string  //"member" for everyone in the group, the policy's role lines add to these
+	Tags      []string  //tags of the file
+	At        time.Time //when the download request was issued, not when a proxy got to it
+	Downloads int       //keys already released to the user for this file
+}
+
+var policyDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func ParsePolicy(source string) (Policy, error) {
+	policy := Policy{roles: map[string][]string{}, rules: []policyRule{}}
+	for idx, line := range strings.Split(source, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		lineNumber := idx + 1
+		switch fields[0] {
+		case "role":
+			if len(fields) < 3 {
+				return Policy{}, fmt.Errorf("policy line %d: role needs a role name and at least one user", lineNumber)
+			}
+			for _, userId := range fields[2:] {
+				policy.roles[userId] = append(policy.roles[userId], fields[1])
+			}
+		case "allow", "deny":
+			rule, err := parseConditions(fields[1:])
+			if err != nil {
+				return Policy{}, fmt.Errorf("policy line %d: %w", lineNumber, err)
+			}
+			rule.line, rule.effect = lineNumber, fields[0]
+			policy.rules = append(policy.rules, rule)
+		case "max-downloads":
+			if len(fields) < 2 {
+				return Policy{}, fmt.Errorf("policy line %d: max-downloads needs a number", lineNumber)
+			}
+			limit, err := strconv.Atoi(fields[1])
+			if err != nil || limit < 0 {
+				return Policy{}, fmt.Errorf("policy line %d: %q is not a download count", lineNumber, fields[1])
+			}
+			rule, err := parseConditions(fields[2:])
+			if err != nil {
+				return Policy{}, fmt.Errorf("policy line %d: %w", lineNumber, err)
+			}
+			rule.line, rule.effect, rule.limit = lineNumber, fields[0], limit
+			policy.rules = append(policy.rules, rule)
+		default:
+			return Policy{}, fmt.Errorf("policy line %d: unknown rule %q", lineNumber, fields[0])
+		}
+	}
+	return policy, nil
+}
+
+func parseConditions(fields []string) (policyRule, error) {
+	rule := policyRule{}
+	if len(fields)%2 != 0 {
+		return rule, errors.New("every condition needs a value")
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fields[i], fields[i+1]
+		switch key {
+		case "role":
+			rule.roles = append(rule.roles, strings.Split(value, ",")...)
+		case "tag":
+			rule.tags = append(rule.tags, strings.Split(value, ",")...)
+		case "hours":
+			start, end, ok := strings.Cut(value, "-")
+			startMinute, startErr := parseClock(start)
+			endMinute, endErr := parseClock(end)
+			if !ok || startErr != nil || endErr != nil {
+				return rule, fmt.Errorf("%q is not a HH:MM-HH:MM window", value)
+			}
+			rule.hours = []int{startMinute, endMinute}
+		case "days":
+			rule.days = map[time.Weekday]bool{}
+			for _, name := range strings.Split(value, ",") {
+				day, ok := policyDays[name]
+				if !ok {
+					return rule, fmt.Errorf("%q is not a day", name)
+				}
+				rule.days[day] = true
+			}
+		default:
+			return rule, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+	return rule, nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Evaluate decides a download, nil means the key may be released
+func (p Policy) Evaluate(request AccessRequest) error {
+	roles := append(append([]string{}, request.Roles...), p.roles[request.UserId]...)
+
+	hasAllow, allowed := false, false
+	for _, rule := range p.rules {
+		if rule.effect == "allow" {
+			hasAllow = true
+			allowed = allowed || rule.matches(roles, request)
+		}
+	}
+	for _, rule := range p.rules {
+		if !rule.matches(roles, request) {
+			continue
+		}
+		if rule.effect == "deny" {
+			return fmt.Errorf("download denied by policy line %d", rule.line)
+		}
+		if rule.effect == "max-downloads" && request.Downloads >= rule.limit {
+			return fmt.Errorf("download limit of %d reached (policy line %d)", rule.limit, rule.line)
+		}
+	}
+	if hasAllow && !allowed {
+		return errors.New("no policy rule allows this download")
+	}
+	return nil
+}
+
+func (rule policyRule) matches(roles []string, request AccessRequest) bool {
+	if len(rule.roles) > 0 && !intersects(rule.roles, roles) {
+		return false
+	}
+	if len(rule.tags) > 0 && !intersects(rule.tags, request.Tags) {
+		return false
+	}
+
+	at := request.At.UTC()
+	if rule.days != nil && !rule.days[at.Weekday()] {
+		return false
+	}
+	if rule.hours != nil {
+		minute := at.Hour()*60 + at.Minute()
+		start, end := rule.hours[0], rule.hours[1]
+		if start <= end && (minute < start || minute >= end) {
+			return false
+		}
+		if start > end && minute < start && minute >= end {
+			return false
+		}
+	}
+	return true
+}
+
+func intersects(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeKeyRelease evaluates the group's latest policy for a download of file (already checked by AuthorizeDownload)
+// and puts the user's key release record on the ledger before the key is handed over, so the record is also what later
+// max-downloads checks count
+func (proxy IPFSProxy) authorizeKeyRelease(downloadRequest DownloadRequest, file Data) error {
+	group, ok := proxy.group(downloadRequest.groupId)
+	if !ok {
+		return errors.New("group does not exist")
+	}
+
+	//the record names the request's file version and nonce, so a release that is already on the ledger can't be passed
+	//off as the one for a new request
+	release := downloadRequest.keyRelease
+	if release.kind != TX_KEY_RELEASED || release.userId != downloadRequest.requestedUserId ||
+		release.groupId != downloadRequest.groupId || release.IPFSHash != downloadRequest.IPFSHandle ||
+		release.fileId != downloadRequest.transactionId || release.nonce != downloadRequest.nonce {
+		return errors.New("download request does not carry a matching key release record")
+	}
+	//checked here so that the ledger turning the record down below is down to the ledger
+	if err := verifyTransactionSignature(release); err != nil {
+		return err
+	}
+	if err := checkRegisteredSigner(&proxy, release); err != nil {
+		return err
+	}
+
+	//one release per user and file at a time, see releaseGate
+	releases := proxy.releases.enter(downloadRequest.requestedUserId, downloadRequest.IPFSHandle)
+	defer proxy.releases.leave(downloadRequest.requestedUserId, downloadRequest.IPFSHandle, releases)
+
+	//the owner writes the policy and could change it at any time, it only restricts the other members
+	if downloadRequest.requestedUserId != group.ownerUuid {
+		policy, err := proxy.groupPolicy(group)
+		if err != nil {
+			return &proxyFailure{err}
+		}
+		request, err := proxy.accessRequest(downloadRequest, file, releases.unconfirmed)
+		if err != nil {
+			return &proxyFailure{err}
+		}
+		if err := policy.Evaluate(request); err != nil {
+			denial := denyDownload(ErrPolicyDenied, downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId)
+			denial.cause = err
+			return denial
+		}
+	}
+
+	//in a threshold group every proxy that releases its share records the same release, the first one does. This proxy
+	//took the nonce only once, so anywhere else the release being recorded already means the request was used before.
+	transactionHash, err := proxy.ledger.CreateTransaction(release)
+	if errors.Is(err, ErrAlreadyOnLedger) || errors.Is(err, ErrAlreadyPending) {
+		if group.shareIndex == 0 {
+			return denyDownload(ErrReplayedRequest, downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId)
+		}
+		transactionHash, err = release.hash(), nil
+	}
+	if err != nil {
+		return &proxyFailure{err}
+	}
+	if err := proxy.ledger.WaitForConfirmation(transactionHash, KEY_RELEASE_TIMEOUT); err != nil {
+		releases.unconfirmed[transactionHash] = true
+		return &proxyFailure{err}
+	}
+	delete(releases.unconfirmed, transactionHash)
+	return nil
+}
+
+// groupPolicy is the latest policy the group owner put on the ledger, an empty policy allows every download
+func (proxy IPFSProxy) groupPolicy(group GroupMetadata) (Policy, error) {
+	records, err := QueryAll(proxy.ledger, LedgerQuery{
+		GroupId: group.groupUuid,
+		UserId:  group.ownerUuid,
+		Kinds:   []TransactionKind{TX_POLICY_SET},
+	})
+	if err != nil {
+		return Policy{}, err
+	}
+	if len(records) == 0 {
+		return ParsePolicy("")
+	}
+	return ParsePolicy(records[len(records)-1].Transaction.Data.policy)
+}
+
+// accessRequest gathers what the ledger knows about the download, everything else comes from the proxy itself.
+// unconfirmed are the releases of the file this proxy submitted without seeing them committed, they count as well.
+func (proxy IPFSProxy) accessRequest(downloadRequest DownloadRequest, file Data, unconfirmed map[string]bool) (AccessRequest, error) {
+	//a re-encrypted file has a new IPFS hash, so its download count starts over, a rekeyed one keeps counting
+	releases, err := QueryAll(proxy.ledger, LedgerQuery{
+		GroupId:  downloadRequest.groupId,
+		UserId:   downloadRequest.requestedUserId,
+		IPFSHash: downloadRequest.IPFSHandle,
+		Kinds:    []TransactionKind{TX_KEY_RELEASED},
+	})
+	if err != nil {
+		return AccessRequest{}, err
+	}
+	//in a threshold group the other proxies may have recorded this very download already, it is not an earlier one
+	downloads := 0
+	for _, release := range releases {
+		if release.Transaction.ID != downloadRequest.keyRelease.hash() {
+			downloads++
+		}
+		delete(unconfirmed, release.Transaction.ID) //counted now that it is on the ledger
+	}
+	for id := range unconfirmed {
+		if id != downloadRequest.keyRelease.hash() {
+			downloads++
+		}
+	}
+
+	return AccessRequest{
+		UserId:    downloadRequest.requestedUserId,
+		Roles:     []string{"member"},
+		Tags:      file.tags,
+		At:        time.Unix(0, downloadRequest.issuedAt), //signed and checked by admit, every proxy sees the same time
+		Downloads: downloads,
+	}, nil
+}
@@ -0,0 +1,373 @@
+package entities
+
+import (
+	"blockchain-fileshare/ipfs"
+	keys "blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/uuid"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// what an owner can ask the proxy to do to one of their groups, part of what a GroupRequest signature covers so a
+// request to add someone can't be replayed as a request to remove them
+const (
+	GROUP_REGISTER      = "register"
+	GROUP_ADD_MEMBER    = "add-member"
+	GROUP_REMOVE_MEMBER = "remove-member"
+	GROUP_ROTATE_KEY    = "rotate-key"
+)
+
+// proxyFailure is an error of the proxy's own IPFS node, ledger or key store rather than of the request, a ProxyServer
+// answers it with a 500 instead of a 4xx
+type proxyFailure struct {
+	err error
+}
+
+func (f *proxyFailure) Error() string {
+	return f.err.Error()
+}
+
+func (f *proxyFailure) Unwrap() error {
+	return f.err
+}
+
+// Proxy is the part of the system that holds the group keys. *IPFSProxy is the proxy itself, running in the same
+// process as its users, ProxyClient talks to one running on another host through a ProxyServer. Owners and members
+// only ever go through this interface so they work the same with either.
+type Proxy interface {
+	//RegisterGroup creates a group owned by whoever signed the request and returns its ID and public key
+	RegisterGroup(request GroupRequest) (string, []byte, error)
+	AddMember(request GroupRequest) error
+	RemoveMember(request GroupRequest) error
+	//RotateGroupKey replaces the key pair of the group and returns the new public key, data keys encrypted with the old
+	//one can no longer be released so the owner has to rewrap them (see ChangeKeyAndSecureFiles)
+	RotateGroupKey(request GroupRequest) ([]byte, error)
+	OwnerOf(groupId string) (string, error)
+	//GroupKey is the public key of the group, in a threshold group the public key of every proxy (see ThresholdProxy)
+	GroupKey(groupId string) ([]byte, error)
+	IsMember(groupId string, userId string) bool
+	//Upload encrypts the file under a data key of its own and adds it to IPFS, it returns the IPFS handle, the file
+	//checksum and the data key encrypted with the group public key, which goes on the ledger with the file. The files
+	//of a threshold group come encrypted by the uploader already (see prepareUpload).
+	Upload(uploadReq UploadRequest) (string, string, []byte, error)
+	//ReleaseKey authorizes a signed download request and returns the data key of the file encrypted for the requester,
+	//the requester fetches the ciphertext from IPFS on their own
+	ReleaseKey(downloadRequest DownloadRequest, signature []byte) ([]byte, error)
+	//Connect wires the proxy to the IPFS node and ledger it works with, a client only keeps the ledger so its owners
+	//can record their group changes, the proxy it talks to has its own
+	Connect(sh *shell.Shell, ledger Ledger)
+	connectedLedger() Ledger
+	//prepareGroupRequest fills in whatever the proxy needs in a request before the owner signs it, a ThresholdProxy
+	//deals the new group key here
+	prepareGroupRequest(request GroupRequest) (GroupRequest, error)
+	//prepareUpload does whatever has to happen to a file before the user signs the upload, a ThresholdProxy encrypts it
+	//so no proxy sees it in the clear
+	prepareUpload(uploadReq UploadRequest) (UploadRequest, error)
+}
+
+// GroupRequest is an owner asking the proxy to change one of their groups. It is signed with the owner's key so the
+// proxy can tell the owner apart from anyone else who can reach it.
+type GroupRequest struct {
+	action    string
+	ownerId   string
+	groupId   string //empty when registering, the proxy picks the ID
+	memberId  string
+	publicKey []byte //the owner's own key when registering a group, the new member's key when adding one
+	signature []byte
+
+	//set when the client dealt the group key instead of the proxy generating it, see ThresholdProxy
+	groupKey     []byte     //the public keys of every proxy
+	shareDigests [][]byte   //sha256 of every proxy's private key, in index order
+	shares       []keyShare //the proxies' private keys, not signed, each is checked against its digest. A proxy is only ever sent its own one
+}
+
+func (r GroupRequest) signingBytes() []byte {
+	buf := []byte{}
+	for _, field := range []string{r.action, r.ownerId, r.groupId, r.memberId, string(r.publicKey), string(r.groupKey)} {
+		buf = appendString(buf, field)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(r.shareDigests)))
+	for _, digest := range r.shareDigests {
+		buf = appendString(buf, string(digest))
+	}
+	return buf
+}
+
+// dealtShare is the proxy's part of the group key request carries (its own private key), if the client dealt the key
+func (r GroupRequest) dealtShare() (keyShare, bool, error) {
+	if r.groupKey == nil && len(r.shares) == 0 {
+		return keyShare{}, false, nil
+	}
+	if len(r.shares) != 1 {
+		return keyShare{}, false, errors.New("a proxy holds exactly one share of a group key")
+	}
+	share := r.shares[0]
+	if r.groupKey == nil || share.index < 1 || share.index > len(r.shareDigests) {
+		return keyShare{}, false, errors.New("key share does not match the dealt group key")
+	}
+	digest := sha256.Sum256(share.value)
+	if !bytes.Equal(digest[:], r.shareDigests[share.index-1]) {
+		return keyShare{}, false, errors.New("key share does not match the dealt group key")
+	}
+	return share, true, nil
+}
+
+func (proxy *IPFSProxy) prepareGroupRequest(request GroupRequest) (GroupRequest, error) {
+	return request, nil
+}
+
+func (proxy *IPFSProxy) prepareUpload(uploadReq UploadRequest) (UploadRequest, error) {
+	return uploadReq, nil
+}
+
+func (proxy *IPFSProxy) Connect(sh *shell.Shell, ledger Ledger) {
+	ledger.UseKeyRegistry(proxy)
+	proxy.sh = sh
+	proxy.ledger = ledger
+}
+
+func (proxy *IPFSProxy) connectedLedger() Ledger {
+	return proxy.ledger
+}
+
+func (proxy *IPFSProxy) RegisterGroup(request GroupRequest) (string, []byte, error) {
+	if request.action != GROUP_REGISTER {
+		return "", nil, errors.New("not a group registration request")
+	}
+	//nobody is registered yet, the owner proves they hold the key they are registering with
+	if err := utils.VerifyBytesSignature(request.signingBytes(), request.signature, request.publicKey); err != nil {
+		return "", nil, errors.New("group registration is not signed with the owner's key")
+	}
+
+	share, dealt, err := request.dealtShare()
+	if err != nil {
+		return "", nil, err
+	}
+	groupUuid, shareIndex := uuid.New().String()[:6], 0
+	var public, private []byte
+	if dealt {
+		groupUuid, public, private, shareIndex = request.groupId, request.groupKey, share.value, share.index
+	} else {
+		public, private = keys.GenerateKeyPairInMemory()
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if _, exists := proxy.groups[groupUuid]; exists || groupUuid == "" {
+		return "", nil, errors.New("group already exists")
+	}
+	err = proxy.putGroup(GroupMetadata{
+		ownerUuid:  request.ownerId,
+		groupUuid:  groupUuid,
+		publicKey:  public,
+		privateKey: private,
+		shareIndex: shareIndex,
+		users: []UserMetadata{
+			UserMetadata{
+				uuid:      request.ownerId,
+				publicKey: request.publicKey,
+			},
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return groupUuid, public, nil
+}
+
+// verifyGroupRequest checks that request is for action and signed by the owner of the group it names, proxy.mu must
+// be held
+func (proxy *IPFSProxy) verifyGroupRequest(request GroupRequest, action string) (GroupMetadata, error) {
+	if request.action != action {
+		return GroupMetadata{}, errors.New("request is for another action")
+	}
+	groupMetadata, exists := proxy.groups[request.groupId]
+	if !exists {
+		return GroupMetadata{}, errors.New("group does not exist!")
+	}
+	if groupMetadata.ownerUuid != request.ownerId {
+		return GroupMetadata{}, errors.New("only the group owner can change the group")
+	}
+	var ownerKey []byte
+	for _, m := range groupMetadata.users {
+		if m.uuid == request.ownerId {
+			ownerKey = m.publicKey
+		}
+	}
+	if err := utils.VerifyBytesSignature(request.signingBytes(), request.signature, ownerKey); err != nil {
+		return GroupMetadata{}, errors.New("only the group owner can change the group")
+	}
+	return groupMetadata, nil
+}
+
+func (proxy *IPFSProxy) AddMember(request GroupRequest) error {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	groupMetadata, err := proxy.verifyGroupRequest(request, GROUP_ADD_MEMBER)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range groupMetadata.users {
+		if m.uuid == request.memberId {
+			return errors.New("user was already added!")
+		}
+	}
+
+	groupMetadata.users = append(groupMetadata.users, UserMetadata{
+		uuid:      request.memberId,
+		publicKey: request.publicKey,
+	})
+
+	return proxy.putGroup(groupMetadata)
+}
+
+func (proxy *IPFSProxy) RemoveMember(request GroupRequest) error {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	groupMetadata, err := proxy.verifyGroupRequest(request, GROUP_REMOVE_MEMBER)
+	if err != nil {
+		return err
+	}
+
+	i := -1
+	for idx, m := range groupMetadata.users {
+		if m.uuid == request.memberId {
+			i = idx
+			break
+		}
+	}
+	if i == -1 {
+		return errors.New("user not found!")
+	}
+
+	//a copy, the current list stays as it is in case the change can't be saved
+	users := append([]UserMetadata{}, groupMetadata.users[:i]...)
+	groupMetadata.formerUsers = append(append([]UserMetadata{}, groupMetadata.formerUsers...), groupMetadata.users[i])
+	groupMetadata.users = append(users, groupMetadata.users[i+1:]...)
+	return proxy.putGroup(groupMetadata)
+}
+
+func (proxy *IPFSProxy) RotateGroupKey(request GroupRequest) ([]byte, error) {
+	proxy.mu.RLock()
+	_, err := proxy.verifyGroupRequest(request, GROUP_ROTATE_KEY)
+	proxy.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	share, dealt, err := request.dealtShare()
+	if err != nil {
+		return nil, err
+	}
+	public, private, shareIndex := request.groupKey, share.value, share.index
+	if !dealt {
+		public, private = keys.GenerateKeyPairInMemory()
+		shareIndex = 0
+	}
+
+	//the key pair is made without holding up everyone else, the members may have changed in the meantime
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	groupMetadata, err := proxy.verifyGroupRequest(request, GROUP_ROTATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	groupMetadata.publicKey, groupMetadata.privateKey, groupMetadata.shareIndex = public, private, shareIndex
+	if err := proxy.putGroup(groupMetadata); err != nil {
+		return nil, err
+	}
+	return public, nil
+}
+
+func (proxy *IPFSProxy) OwnerOf(groupId string) (string, error) {
+	group, ok := proxy.group(groupId)
+	if !ok {
+		return "", errors.New("group does not exist")
+	}
+	return group.ownerUuid, nil
+}
+
+func (proxy *IPFSProxy) GroupKey(groupId string) ([]byte, error) {
+	return proxy.getGroupPublicKey(groupId)
+}
+
+func (proxy *IPFSProxy) IsMember(groupId string, userId string) bool {
+	_, err := proxy.getUserPublicKey(groupId, userId)
+	return err == nil
+}
+
+func (proxy *IPFSProxy) Upload(uploadReq UploadRequest) (string, string, []byte, error) {
+	if err := proxy.VerifySignature(uploadReq.signature, uploadReq); err != nil {
+		return "", "", nil, err
+	}
+	return proxy.UploadFileToIPFS(proxy.sh, uploadReq)
+}
+
+func (proxy *IPFSProxy) ReleaseKey(downloadRequest DownloadRequest, signature []byte) ([]byte, error) {
+	if _, err := proxy.VerifyDownloadReqSignature(downloadRequest, signature); err != nil {
+		return nil, err
+	}
+	return proxy.releaseKey(downloadRequest)
+}
+
+// releaseKey authorizes the download against the ledger and re-encrypts the data key of the file for the requester:
+// the data key on the file's ledger record is decrypted with the group private key and encrypted again with the
+// requester's public key. The requester can decrypt that one file with it and the group private key never leaves the
+// proxy. A proxy of a threshold group only holds a share of the data key, it releases that share the same way. The
+// caller has already checked who signed the request.
+func (proxy IPFSProxy) releaseKey(downloadRequest DownloadRequest) ([]byte, error) {
+	record, err := proxy.AuthorizeDownload(downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId)
+	if err != nil {
+		return nil, err
+	}
+	if record.IPFSHash != downloadRequest.IPFSHandle {
+		return nil, denyDownload(ErrHandleMismatch, downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId)
+	}
+	if err := proxy.authorizeKeyRelease(downloadRequest, record); err != nil {
+		return nil, err
+	}
+
+	group, ok := proxy.group(downloadRequest.groupId)
+	if !ok {
+		return nil, errors.New("group does not exist")
+	}
+	groupPrivateKey := group.privateKey
+	if len(record.fileKey) == 0 {
+		return nil, errors.New("file was uploaded without a data key of its own, it has to be uploaded again")
+	}
+	if group.shareIndex != 0 {
+		share, err := unwrapDataKeyShare(record.fileKey, group.shareIndex, groupPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(share)
+		return utils.EncryptKey(share, downloadRequest.requestedUserPublicKey)
+	}
+
+	dataKey, err := utils.DecryptKey(record.fileKey, groupPrivateKey)
+	if err != nil {
+		return nil, errors.New("data key of the file is not encrypted with the current group key")
+	}
+	defer clear(dataKey)
+	return utils.EncryptKey(dataKey, downloadRequest.requestedUserPublicKey)
+}
+
+// downloadAndDecrypt fetches the ciphertext of a file straight from IPFS and decrypts it with the data key the proxy
+// released for privateKey's owner (see openReleasedKey)
+func downloadAndDecrypt(sh *shell.Shell, downloadRequest DownloadRequest, releasedKey []byte, privateKey []byte) (string, string, error) {
+	if err := ipfs.DownloadFileFromIPFS(sh, downloadRequest.IPFSHandle, downloadRequest.fileExtension); err != nil {
+		return "", "", err
+	}
+	dataKey, err := openReleasedKey(releasedKey, privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	defer clear(dataKey)
+	return utils.DecryptFileWithDataKey(downloadRequest.IPFSHandle+downloadRequest.fileExtension, dataKey)
+}
@@ -0,0 +1,243 @@
+package entities
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+const PROXY_CLIENT_TIMEOUT = 2 * KEY_RELEASE_TIMEOUT //a key release waits for the ledger, give it room to answer
+
+// ProxyClient is a Proxy that lives on another host behind a ProxyServer. Hand it to CreateOperator in place of an
+// *IPFSProxy and owners and members work exactly as they do in process.
+type ProxyClient struct {
+	baseURL    string
+	httpClient *http.Client
+	ledger     Ledger
+}
+
+func CreateProxyClient(baseURL string) *ProxyClient {
+	return &ProxyClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: PROXY_CLIENT_TIMEOUT},
+	}
+}
+
+// Connect only keeps the ledger, the remote proxy has its own IPFS node and ledger connection
+func (c *ProxyClient) Connect(sh *shell.Shell, ledger Ledger) {
+	c.ledger = ledger
+}
+
+func (c *ProxyClient) connectedLedger() Ledger {
+	return c.ledger
+}
+
+func (c *ProxyClient) prepareGroupRequest(request GroupRequest) (GroupRequest, error) {
+	return request, nil
+}
+
+func (c *ProxyClient) prepareUpload(uploadReq UploadRequest) (UploadRequest, error) {
+	return uploadReq, nil
+}
+
+// withDealtKey adds the group key request carries to message, never more than one share of it leaves the client
+func withDealtKey(message groupRequestMessage, request GroupRequest) (groupRequestMessage, error) {
+	if len(request.shares) > 1 {
+		return groupRequestMessage{}, errors.New("a proxy holds exactly one share of a group key")
+	}
+	message.GroupKey = request.groupKey
+	message.ShareDigests = request.shareDigests
+	if len(request.shares) == 1 {
+		message.ShareIndex = request.shares[0].index
+		message.Share = request.shares[0].value
+	}
+	return message, nil
+}
+
+func (c *ProxyClient) RegisterGroup(request GroupRequest) (string, []byte, error) {
+	message, err := withDealtKey(groupRequestMessage{
+		OwnerId:   request.ownerId,
+		GroupId:   request.groupId,
+		PublicKey: request.publicKey,
+		Signature: request.signature,
+	}, request)
+	if err != nil {
+		return "", nil, err
+	}
+	group := groupMessage{}
+	err = c.call(http.MethodPost, "/groups", message, &group)
+	if err != nil {
+		return "", nil, err
+	}
+	return group.GroupId, group.PublicKey, nil
+}
+
+func (c *ProxyClient) AddMember(request GroupRequest) error {
+	return c.call(http.MethodPost, "/groups/"+url.PathEscape(request.groupId)+"/members", groupRequestMessage{
+		OwnerId:   request.ownerId,
+		MemberId:  request.memberId,
+		PublicKey: request.publicKey,
+		Signature: request.signature,
+	}, nil)
+}
+
+func (c *ProxyClient) RemoveMember(request GroupRequest) error {
+	return c.call(http.MethodDelete, "/groups/"+url.PathEscape(request.groupId)+"/members/"+url.PathEscape(request.memberId), groupRequestMessage{
+		OwnerId:   request.ownerId,
+		Signature: request.signature,
+	}, nil)
+}
+
+func (c *ProxyClient) RotateGroupKey(request GroupRequest) ([]byte, error) {
+	message, err := withDealtKey(groupRequestMessage{
+		OwnerId:   request.ownerId,
+		Signature: request.signature,
+	}, request)
+	if err != nil {
+		return nil, err
+	}
+	group := groupMessage{}
+	err = c.call(http.MethodPost, "/groups/"+url.PathEscape(request.groupId)+"/key", message, &group)
+	if err != nil {
+		return nil, err
+	}
+	return group.PublicKey, nil
+}
+
+func (c *ProxyClient) OwnerOf(groupId string) (string, error) {
+	group := groupMessage{}
+	if err := c.call(http.MethodGet, "/groups/"+url.PathEscape(groupId), nil, &group); err != nil {
+		return "", err
+	}
+	return group.OwnerId, nil
+}
+
+func (c *ProxyClient) GroupKey(groupId string) ([]byte, error) {
+	group := groupMessage{}
+	if err := c.call(http.MethodGet, "/groups/"+url.PathEscape(groupId), nil, &group); err != nil {
+		return nil, err
+	}
+	return group.PublicKey, nil
+}
+
+// IsMember is false when the proxy can't be reached too, nobody is a member of a group nobody can vouch for
+func (c *ProxyClient) IsMember(groupId string, userId string) bool {
+	return c.call(http.MethodGet, "/groups/"+url.PathEscape(groupId)+"/members/"+url.PathEscape(userId), nil, nil) == nil
+}
+
+// Upload sends the file itself, the remote proxy can't read the caller's disk. A file the caller encrypted goes with
+// its checksum and wrapped data key.
+func (c *ProxyClient) Upload(uploadReq UploadRequest) (string, string, []byte, error) {
+	content, err := os.ReadFile(uploadReq.filePath)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	result := uploadResultMessage{}
+	err = c.call(http.MethodPost, "/groups/"+url.PathEscape(uploadReq.groupID)+"/files", uploadMessage{
+		UserId:    uploadReq.requestedUserUuid,
+		FileName:  filepath.Base(uploadReq.filePath),
+		Content:   content,
+		Signature: uploadReq.signature,
+		Checksum:  []byte(uploadReq.checksum),
+		FileKey:   uploadReq.fileKey,
+	}, &result)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return result.Handle, string(result.Checksum), result.FileKey, nil
+}
+
+func (c *ProxyClient) ReleaseKey(downloadRequest DownloadRequest, signature []byte) ([]byte, error) {
+	released := releasedKeyMessage{}
+	err := c.call(http.MethodPost, "/groups/"+url.PathEscape(downloadRequest.groupId)+"/keys", keyReleaseMessage{
+		UserId:        downloadRequest.requestedUserId,
+		IPFSHandle:    downloadRequest.IPFSHandle,
+		FileExtension: downloadRequest.fileExtension,
+		PublicKey:     downloadRequest.requestedUserPublicKey,
+		TransactionId: downloadRequest.transactionId,
+		KeyRelease:    downloadRequest.keyRelease.encode(),
+		Nonce:         downloadRequest.nonce,
+		IssuedAt:      downloadRequest.issuedAt,
+		ExpiresAt:     downloadRequest.expiresAt,
+		Signature:     signature,
+	}, &released)
+
+	denial := &DownloadDeniedError{}
+	if errors.As(err, &denial) {
+		denial.UserId, denial.GroupId, denial.TransactionId = downloadRequest.requestedUserId, downloadRequest.groupId, downloadRequest.transactionId
+	}
+	if err != nil {
+		return nil, err
+	}
+	return released.EncryptedKey, nil
+}
+
+// call sends body as JSON and decodes a successful answer into into, a refusal comes back as the error the proxy
+// gave so callers can tell reasons apart with errors.Is just like in process
+func (c *ProxyClient) call(method string, path string, body any, into any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not reach the proxy: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		message := proxyErrorMessage{}
+		if err := json.NewDecoder(response.Body).Decode(&message); err != nil || message.Error == "" {
+			return fmt.Errorf("proxy answered %s", response.Status)
+		}
+		return remoteProxyError(message)
+	}
+	if into == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(into)
+}
+
+// remoteProxyError turns an error the server sent back into the one the proxy returned, the message is kept as is
+func remoteProxyError(message proxyErrorMessage) error {
+	if reason, ok := downloadDenials[message.Denied]; ok {
+		denial := &DownloadDeniedError{Reason: reason}
+		if message.Error != reason.Error() {
+			denial.cause = errors.New(message.Error)
+		}
+		return denial
+	}
+	for _, reason := range downloadDenials {
+		if message.Error == reason.Error() {
+			return reason
+		}
+	}
+	return errors.New(message.Error)
+}
+
+// ChangeKeyAndSecureFiles is IPFSProxy.ChangeKeyAndSecureFiles for a remote proxy, the owner rewraps the data keys itself
+func (c *ProxyClient) ChangeKeyAndSecureFiles(operator *Operators, groupOwner *GroupOwner, groupIdx int, groupID string) ([]File, error) {
+	return changeKeyAndSecureFiles(operator, groupOwner, groupIdx, groupID)
+}
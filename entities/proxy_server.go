@@ -0,0 +1,385 @@
+package entities
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const MAX_PROXY_REQUEST_BYTES = 64 << 20 //uploads carry the whole file
+
+// the JSON bodies ProxyServer and ProxyClient exchange, IDs that are in the path are not repeated in the body
+type groupRequestMessage struct {
+	OwnerId   string `json:"ownerId"`
+	GroupId   string `json:"groupId,omitempty"` //only when registering a group whose key the client dealt
+	MemberId  string `json:"memberId,omitempty"`
+	PublicKey []byte `json:"publicKey,omitempty"`
+	Signature []byte `json:"signature"`
+
+	//the group key the client dealt and this proxy's share of it, see ThresholdProxy
+	GroupKey     []byte   `json:"groupKey,omitempty"`
+	ShareDigests [][]byte `json:"shareDigests,omitempty"`
+	ShareIndex   int      `json:"shareIndex,omitempty"`
+	Share        []byte   `json:"share,omitempty"`
+}
+
+// dealtKey copies the dealt group key of message into request
+func (message groupRequestMessage) dealtKey(request GroupRequest) GroupRequest {
+	request.groupKey = message.GroupKey
+	request.shareDigests = message.ShareDigests
+	if message.Share != nil {
+		request.shares = []keyShare{{index: message.ShareIndex, value: message.Share}}
+	}
+	return request
+}
+
+type groupMessage struct {
+	GroupId   string `json:"groupId"`
+	OwnerId   string `json:"ownerId,omitempty"`
+	PublicKey []byte `json:"publicKey,omitempty"`
+}
+
+type uploadMessage struct {
+	UserId    string `json:"userId"`
+	FileName  string `json:"fileName"`
+	Content   []byte `json:"content"`
+	Signature []byte `json:"signature"`
+	Checksum  []byte `json:"checksum,omitempty"` //only for content the client encrypted, of the plaintext
+	FileKey   []byte `json:"fileKey,omitempty"`  //only for content the client encrypted, its wrapped data key
+}
+
+type uploadResultMessage struct {
+	Handle   string `json:"handle"`
+	Checksum []byte `json:"checksum"` //the checksum is raw md5 bytes, not text
+	FileKey  []byte `json:"fileKey"`  //the file's data key encrypted with the group public key
+}
+
+type keyReleaseMessage struct {
+	UserId        string `json:"userId"`
+	IPFSHandle    string `json:"ipfsHandle"`
+	FileExtension string `json:"fileExtension,omitempty"`
+	PublicKey     []byte `json:"publicKey"`
+	TransactionId string `json:"transactionId"`
+	KeyRelease    []byte `json:"keyRelease"` //the signed ledger record, in the ledger's own encoding
+	Nonce         string `json:"nonce"`
+	IssuedAt      int64  `json:"issuedAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+	Signature     []byte `json:"signature"`
+}
+
+type releasedKeyMessage struct {
+	EncryptedKey []byte `json:"encryptedKey"`
+}
+
+type proxyErrorMessage struct {
+	Error  string `json:"error"`
+	Denied string `json:"denied,omitempty"` //set when a download was denied, names the Err* reason
+}
+
+// downloadDenials names the reasons a download can be denied on the wire so clients get the same errors back
+var downloadDenials = map[string]error{
+	"not-member":          ErrNotMember,
+	"unknown-transaction": ErrUnknownTransaction,
+	"not-a-file":          ErrNotAFile,
+	"wrong-group":         ErrWrongGroup,
+	"handle-mismatch":     ErrHandleMismatch,
+	"superseded":          ErrSuperseded,
+	"file-deleted":        ErrFileDeleted,
+	"policy-denied":       ErrPolicyDenied,
+	"stale-request":       ErrStaleRequest,
+	"replayed-request":    ErrReplayedRequest,
+	"too-many-requests":   ErrTooManyRequests,
+}
+
+// ProxyServer serves an IPFSProxy over HTTP so it can run on its own host, ProxyClient is the other end.
+//
+//	POST   /groups                          register a group
+//	GET    /groups/{groupId}                who owns the group
+//	POST   /groups/{groupId}/members        add a member
+//	GET    /groups/{groupId}/members/{id}   200 when id is a member, 404 otherwise
+//	DELETE /groups/{groupId}/members/{id}   remove a member
+//	POST   /groups/{groupId}/key            rotate the group key
+//	POST   /groups/{groupId}/files          upload a file
+//	POST   /groups/{groupId}/keys           release the group key for a download
+//
+// Every change is signed by the user asking for it, the server checks the signatures exactly like the proxy does
+// in process. Served over TLS with TLSConfig, the connection also has to present a certificate bound to the key of the
+// user the request is made for.
+type ProxyServer struct {
+	proxy    *IPFSProxy
+	mux      *http.ServeMux
+	mu       sync.RWMutex      //guards enrolled, requests themselves are handled side by side
+	enrolled map[string][]byte //users allowed to connect before they are in any group, see Enroll
+}
+
+// identityKey is where ServeHTTP leaves the user a TLS connection was authenticated as
+type identityKey struct{}
+
+// CreateProxyServer serves proxy, which should already be connected to its IPFS node and ledger (see IPFSProxy.Connect)
+func CreateProxyServer(proxy *IPFSProxy) *ProxyServer {
+	s := &ProxyServer{proxy: proxy, mux: http.NewServeMux(), enrolled: map[string][]byte{}}
+
+	s.mux.HandleFunc("POST /groups", s.registerGroup)
+	s.mux.HandleFunc("GET /groups/{groupId}", s.groupOwner)
+	s.mux.HandleFunc("POST /groups/{groupId}/members", s.addMember)
+	s.mux.HandleFunc("GET /groups/{groupId}/members/{userId}", s.isMember)
+	s.mux.HandleFunc("DELETE /groups/{groupId}/members/{userId}", s.removeMember)
+	s.mux.HandleFunc("POST /groups/{groupId}/key", s.rotateKey)
+	s.mux.HandleFunc("POST /groups/{groupId}/files", s.upload)
+	s.mux.HandleFunc("POST /groups/{groupId}/keys", s.releaseKey)
+	return s
+}
+
+func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_PROXY_REQUEST_BYTES)
+	identity, err := s.authenticate(r)
+	if err != nil {
+		writeProxyJSON(w, http.StatusForbidden, proxyErrorMessage{Error: err.Error()})
+		return
+	}
+	s.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+}
+
+func (s *ProxyServer) registerGroup(w http.ResponseWriter, r *http.Request) {
+	message := groupRequestMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.OwnerId) {
+		return
+	}
+	//the group is registered under the key the owner connected with, not just any key they can sign for
+	if identity, _ := r.Context().Value(identityKey{}).(string); identity != "" && !s.hasKey(identity, parsePublicKey(message.PublicKey)) {
+		writeProxyJSON(w, http.StatusForbidden, proxyErrorMessage{Error: "group has to be registered with the key of the client certificate"})
+		return
+	}
+	groupId, public, err := s.proxy.RegisterGroup(message.dealtKey(GroupRequest{
+		action:    GROUP_REGISTER,
+		ownerId:   message.OwnerId,
+		groupId:   message.GroupId,
+		publicKey: message.PublicKey,
+		signature: message.Signature,
+	}))
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	writeProxyJSON(w, http.StatusCreated, groupMessage{GroupId: groupId, OwnerId: message.OwnerId, PublicKey: public})
+}
+
+func (s *ProxyServer) groupOwner(w http.ResponseWriter, r *http.Request) {
+	ownerId, err := s.proxy.OwnerOf(r.PathValue("groupId"))
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	public, err := s.proxy.GroupKey(r.PathValue("groupId"))
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	writeProxyJSON(w, http.StatusOK, groupMessage{GroupId: r.PathValue("groupId"), OwnerId: ownerId, PublicKey: public})
+}
+
+func (s *ProxyServer) addMember(w http.ResponseWriter, r *http.Request) {
+	message := groupRequestMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.OwnerId) {
+		return
+	}
+	err := s.proxy.AddMember(GroupRequest{
+		action:    GROUP_ADD_MEMBER,
+		ownerId:   message.OwnerId,
+		groupId:   r.PathValue("groupId"),
+		memberId:  message.MemberId,
+		publicKey: message.PublicKey,
+		signature: message.Signature,
+	})
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ProxyServer) isMember(w http.ResponseWriter, r *http.Request) {
+	if !s.proxy.IsMember(r.PathValue("groupId"), r.PathValue("userId")) {
+		writeProxyJSON(w, http.StatusNotFound, proxyErrorMessage{Error: ErrNotMember.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ProxyServer) removeMember(w http.ResponseWriter, r *http.Request) {
+	message := groupRequestMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.OwnerId) {
+		return
+	}
+	err := s.proxy.RemoveMember(GroupRequest{
+		action:    GROUP_REMOVE_MEMBER,
+		ownerId:   message.OwnerId,
+		groupId:   r.PathValue("groupId"),
+		memberId:  r.PathValue("userId"),
+		signature: message.Signature,
+	})
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ProxyServer) rotateKey(w http.ResponseWriter, r *http.Request) {
+	message := groupRequestMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.OwnerId) {
+		return
+	}
+	public, err := s.proxy.RotateGroupKey(message.dealtKey(GroupRequest{
+		action:    GROUP_ROTATE_KEY,
+		ownerId:   message.OwnerId,
+		groupId:   r.PathValue("groupId"),
+		signature: message.Signature,
+	}))
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	writeProxyJSON(w, http.StatusOK, groupMessage{GroupId: r.PathValue("groupId"), PublicKey: public})
+}
+
+// upload puts the file in a scratch directory under the name the client gave it (the extension ends up on the
+// ledger) and hands that to the proxy like a local upload
+func (s *ProxyServer) upload(w http.ResponseWriter, r *http.Request) {
+	message := uploadMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.UserId) {
+		return
+	}
+	fileName := filepath.Base(message.FileName)
+	if fileName == "." || fileName == string(filepath.Separator) {
+		writeProxyJSON(w, http.StatusBadRequest, proxyErrorMessage{Error: "upload needs a file name"})
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "proxy-upload-")
+	if err != nil {
+		writeProxyJSON(w, http.StatusInternalServerError, proxyErrorMessage{Error: err.Error()})
+		return
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, fileName)
+	if err := os.WriteFile(filePath, message.Content, 0600); err != nil {
+		writeProxyJSON(w, http.StatusInternalServerError, proxyErrorMessage{Error: err.Error()})
+		return
+	}
+
+	handle, checksum, fileKey, err := s.proxy.Upload(UploadRequest{
+		filePath:          filePath,
+		groupID:           r.PathValue("groupId"),
+		requestedUserUuid: message.UserId,
+		signature:         message.Signature,
+		checksum:          string(message.Checksum),
+		fileKey:           message.FileKey,
+	})
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	writeProxyJSON(w, http.StatusCreated, uploadResultMessage{Handle: handle, Checksum: []byte(checksum), FileKey: fileKey})
+}
+
+func (s *ProxyServer) releaseKey(w http.ResponseWriter, r *http.Request) {
+	message := keyReleaseMessage{}
+	if !readProxyMessage(w, r, &message) || !speaksFor(w, r, message.UserId) {
+		return
+	}
+	keyRelease, err := decodeData(message.KeyRelease)
+	if err != nil {
+		writeProxyJSON(w, http.StatusBadRequest, proxyErrorMessage{Error: err.Error()})
+		return
+	}
+
+	encryptedKey, err := s.proxy.ReleaseKey(DownloadRequest{
+		requestedUserId:        message.UserId,
+		groupId:                r.PathValue("groupId"),
+		IPFSHandle:             message.IPFSHandle,
+		fileExtension:          message.FileExtension,
+		requestedUserPublicKey: message.PublicKey,
+		keyRelease:             keyRelease,
+		transactionId:          message.TransactionId,
+		nonce:                  message.Nonce,
+		issuedAt:               message.IssuedAt,
+		expiresAt:              message.ExpiresAt,
+	}, message.Signature)
+	if err != nil {
+		writeProxyError(w, err)
+		return
+	}
+	writeProxyJSON(w, http.StatusOK, releasedKeyMessage{EncryptedKey: encryptedKey})
+}
+
+// parsePublicKey is nil for anything that is not a PEM encoded RSA public key
+func parsePublicKey(publicKeyBytes []byte) crypto.PublicKey {
+	publicKeyBlock, _ := pem.Decode(publicKeyBytes)
+	if publicKeyBlock == nil {
+		return nil
+	}
+	publicKey, err := x509.ParsePKCS1PublicKey(publicKeyBlock.Bytes)
+	if err != nil {
+		return nil
+	}
+	return publicKey
+}
+
+func readProxyMessage(w http.ResponseWriter, r *http.Request, into any) bool {
+	if err := json.NewDecoder(r.Body).Decode(into); err != nil {
+		writeProxyJSON(w, http.StatusBadRequest, proxyErrorMessage{Error: "malformed request: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// speaksFor refuses a request made on behalf of anyone but the user the connection's certificate belongs to, on plain
+// HTTP there is no certificate and only the request signatures are checked
+func speaksFor(w http.ResponseWriter, r *http.Request, userId string) bool {
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	if identity != "" && identity != userId {
+		writeProxyJSON(w, http.StatusForbidden, proxyErrorMessage{Error: "client certificate does not belong to the requesting user"})
+		return false
+	}
+	return true
+}
+
+// writeProxyError sends err back with the denial reason when there is one. What the proxy refuses is the client's to fix
+// so it is a 4xx, a failure of its IPFS node, ledger or key store is a 500.
+func writeProxyError(w http.ResponseWriter, err error) {
+	message := proxyErrorMessage{Error: err.Error()}
+	failure := &proxyFailure{}
+	if errors.As(err, &failure) {
+		writeProxyJSON(w, http.StatusInternalServerError, message)
+		return
+	}
+	denial := &DownloadDeniedError{}
+	if errors.As(err, &denial) {
+		for name, reason := range downloadDenials {
+			if reason == denial.Reason {
+				message.Denied = name
+			}
+		}
+		if denial.Reason == ErrTooManyRequests {
+			writeProxyJSON(w, http.StatusTooManyRequests, message) //nothing wrong with the request, it can be sent again
+			return
+		}
+		writeProxyJSON(w, http.StatusForbidden, message)
+		return
+	}
+	writeProxyJSON(w, http.StatusBadRequest, message)
+}
+
+func writeProxyJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,191 @@
+package entities
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+const PROXY_CERTIFICATE_VALIDITY = 365 * 24 * time.Hour
+
+var errUnknownIdentity = errors.New("client certificate is not bound to a registered key")
+
+// Certificate is the TLS client certificate of this user. It is self-signed with the same key the user registers with
+// the proxy and names the user's uuid, so there is nothing to issue: the proxy trusts it because the key matches the
+// one it has on file.
+func (g GroupMember) Certificate() (tls.Certificate, error) {
+	return userCertificate(g.GetUuid(), g.privateKey)
+}
+
+func (g GroupOwner) Certificate() (tls.Certificate, error) {
+	return userCertificate(g.GetUuid(), g.privateKey)
+}
+
+func userCertificate(uuid string, privateKeyBytes []byte) (tls.Certificate, error) {
+	privateKeyBlock, _ := pem.Decode(privateKeyBytes)
+	if privateKeyBlock == nil {
+		return tls.Certificate{}, errors.New("invalid private key")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+	if err != nil {
+		return tls.Certificate{}, errors.New("error parsing private key")
+	}
+
+	template := certificateTemplate(uuid)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return selfSign(template, privateKey)
+}
+
+// CreateProxyCertificate makes the proxy's own TLS certificate for the given host names or IPs. It is self-signed,
+// clients pin it (see CreateTLSProxyClient) instead of going through a CA.
+func CreateProxyCertificate(hosts ...string) (tls.Certificate, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := certificateTemplate("ipfs-proxy")
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.IsCA = true //so clients can put it in their root pool as is
+	template.BasicConstraintsValid = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return selfSign(template, privateKey)
+}
+
+func certificateTemplate(commonName string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour), //a little slack for clocks that are behind
+		NotAfter:     now.Add(PROXY_CERTIFICATE_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+func selfSign(template *x509.Certificate, privateKey crypto.Signer) (tls.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey, Leaf: leaf}, nil
+}
+
+// TLSConfig is what the server should be served with to require client certificates: a connection only gets through
+// the handshake when its certificate names a user whose registered key (or enrolled key, for owners who have no group
+// yet) is the one in the certificate. Requests are then only accepted on behalf of that user.
+func (s *ProxyServer) TLSConfig(certificate tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS13,
+		//the certificates are self-signed, VerifyPeerCertificate checks them against the registry instead of a CA
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errUnknownIdentity
+			}
+			certificate, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			//identify only takes read locks on the membership data, a handshake never waits for requests being handled
+			_, err = s.identify(certificate)
+			return err
+		},
+	}
+}
+
+// Enroll lets a user who is not in any group yet connect, so that they can register their first group. It is for
+// whoever runs the proxy host to decide who may become an owner.
+func (s *ProxyServer) Enroll(userId string, publicKey []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enrolled[userId] = publicKey
+}
+
+// identify returns the user a client certificate belongs to, it is still valid and its key is the one registered for
+// the user it names
+func (s *ProxyServer) identify(certificate *x509.Certificate) (string, error) {
+	now := time.Now()
+	if now.Before(certificate.NotBefore) || now.After(certificate.NotAfter) {
+		return "", errors.New("client certificate has expired or is not valid yet")
+	}
+	userId := certificate.Subject.CommonName
+	if !s.hasKey(userId, certificate.PublicKey) {
+		return "", errUnknownIdentity
+	}
+	return userId, nil
+}
+
+// hasKey tells whether publicKey is one of the keys the proxy knows userId by
+func (s *ProxyServer) hasKey(userId string, publicKey crypto.PublicKey) bool {
+	for _, registeredKey := range s.registeredKeys(userId) {
+		if registered, ok := parsePublicKey(registeredKey).(*rsa.PublicKey); ok && registered.Equal(publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// registeredKeys is every key the proxy knows userId by, from each group they are in and their enrollment
+func (s *ProxyServer) registeredKeys(userId string) [][]byte {
+	registered := s.proxy.userKeys(userId)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok := s.enrolled[userId]; ok {
+		registered = append(registered, key)
+	}
+	return registered
+}
+
+// authenticate checks the connection's certificate again for every request, a member removed since the handshake is
+// turned away on a kept-alive connection too. It returns the user the connection belongs to, empty on plain HTTP.
+func (s *ProxyServer) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil {
+		return "", nil
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return "", errUnknownIdentity
+	}
+	return s.identify(r.TLS.PeerCertificates[0])
+}
+
+// CreateTLSProxyClient is CreateProxyClient over mutual TLS: certificate is the user's own (see
+// GroupMember.Certificate), proxyCertificate is the one the proxy was set up with. A client speaks for one user only.
+func CreateTLSProxyClient(baseURL string, certificate tls.Certificate, proxyCertificate *x509.Certificate) *ProxyClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyCertificate)
+
+	client := CreateProxyClient(baseURL)
+	client.httpClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      roots,
+			MinVersion:   tls.VersionTLS13,
+		},
+	}
+	return client
+}
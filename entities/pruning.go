@@ -0,0 +1,345 @@
+package entities
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint is a block a pruned ledger trusts without replaying what came before it. Every header up to it is still
+// kept and hash-links up to Hash, so anyone who got Height and Hash from a source they trust (an archival node, another
+// operator) can check the rest of the chain with VerifyFromCheckpoint. Validators is the proof of authority set in
+// effect after the checkpoint, nil when the chain does not run proof of authority.
+type Checkpoint struct {
+	Height     int
+	Hash       string
+	Validators []Validator
+}
+
+// Prune turns the ledger into a pruned one: every block more than keepRecent blocks below the tip keeps its header and
+// transaction IDs (so merkle roots and inclusion proofs still work) but loses the data of every transaction no live file
+// needs. What stays is
+//   - the current version of every file that has not been deleted, and the re-encryptions leading up to it
+//   - the key releases for those files, the policy engine counts them
+//   - the latest policy each user set for each group
+//   - the creation of every group, later membership records are checked against its signer
+//
+// Membership history, group key rotations and validator changes below the checkpoint are gone, MembersAt and snapshot
+// exports need an archival node. Forks can no longer reach back past the checkpoint, so keep enough recent blocks for
+// the network to settle. A ledger that is never pruned is an archival one, pruning can be repeated as the chain grows.
+func (b *Blockchain) Prune(keepRecent int) (Checkpoint, error) {
+	if keepRecent < 0 {
+		return Checkpoint{}, errors.New("number of recent blocks to keep must not be negative")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	height := len(b.blocks) - 1 - keepRecent
+	if height < 1 {
+		return Checkpoint{}, errors.New("chain is too short to prune")
+	}
+	if b.checkpoint != nil && height <= b.checkpoint.Height {
+		return *b.checkpoint, nil
+	}
+
+	live := b.liveTransactions()
+	blocks := append([]Block{}, b.blocks...)
+	for i := 1; i <= height; i++ {
+		//blocks handed out by GetBlock share their transactions, prune a copy
+		transactions := make([]Transaction, len(blocks[i].Transactions))
+		for position, tx := range blocks[i].Transactions {
+			if !live[tx.ID] {
+				tx = Transaction{ID: tx.ID, Pruned: true}
+			}
+			transactions[position] = tx
+		}
+		blocks[i].Transactions = transactions
+	}
+	checkpoint := Checkpoint{Height: height, Hash: blocks[height].Header.Hash, Validators: b.validatorSetAfter(height)}
+
+	if b.store != nil {
+		if err := b.store.rewrite(blocks[1:], checkpoint); err != nil {
+			return Checkpoint{}, err
+		}
+	}
+
+	b.blocks = blocks
+	b.checkpoint = &checkpoint
+	b.index = newLedgerIndex()
+	for _, block := range blocks[1:] {
+		b.index.add(block)
+	}
+	return checkpoint, nil
+}
+
+// Checkpoint is the checkpoint of a pruned ledger, false on an archival one
+func (b *Blockchain) Checkpoint() (Checkpoint, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.checkpoint == nil {
+		return Checkpoint{}, false
+	}
+	return *b.checkpoint, true
+}
+
+// VerifyFromCheckpoint is VerifyChain starting from a checkpoint obtained out of band, rather than the one the ledger
+// stored itself. It works for archival ledgers too, and fails when the ledger has pruned blocks above trusted.
+func (b *Blockchain) VerifyFromCheckpoint(trusted Checkpoint) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return verifyBlocks(b.blocks, b.genesisValidators(), &trusted, b.keyRegistry)
+}
+
+// verifyPrunedBlock checks a block at or below the checkpoint, its transactions may be pruned but the IDs still have to
+// add up to the merkle root and whatever data is left has to match its ID
+func verifyPrunedBlock(block Block, prev BlockHeader) error {
+	header := block.Header
+	if header.Index != prev.Index+1 {
+		return fmt.Errorf("block %d: expected index %d", header.Index, prev.Index+1)
+	}
+	if header.PrevHash != prev.Hash {
+		return fmt.Errorf("block %d: previous hash does not match block %d", header.Index, prev.Index)
+	}
+	for _, tx := range block.Transactions {
+		if tx.Pruned {
+			continue
+		}
+		if tx.ID != tx.Data.hash() {
+			return fmt.Errorf("block %d: transaction %s has been modified", header.Index, tx.ID)
+		}
+		if err := verifyTransactionSignature(tx.Data); err != nil {
+			return fmt.Errorf("block %d: transaction %s: %w", header.Index, tx.ID, err)
+		}
+	}
+	if header.MerkleRoot != merkleRoot(transactionIDs(block.Transactions)) {
+		return fmt.Errorf("block %d: merkle root does not match its transactions", header.Index)
+	}
+	if header.Hash != header.computeHash() {
+		return fmt.Errorf("block %d: block hash does not match its header", header.Index)
+	}
+	return nil
+}
+
+// liveTransactions is the set of transaction IDs Prune has to keep, see Prune
+func (b *Blockchain) liveTransactions() map[string]bool {
+	type fileKey struct{ groupId, IPFSHash string }
+	live := map[string]bool{}
+	liveFiles := map[fileKey]bool{}
+	policies := map[string]string{} //group and user -> their latest policy
+
+	for seq := range b.index.locations {
+		tx := b.transactionAt(seq)
+		if tx.Pruned {
+			continue
+		}
+		data := tx.Data
+		switch data.kind {
+		case TX_FILE_UPLOADED, TX_FILE_REENCRYPTED, TX_FILE_REKEYED, TX_FILE_UPDATED:
+			if latest, err := b.resolveLatest(seq); err != nil || latest != tx.ID {
+				continue
+			}
+			liveFiles[fileKey{data.groupId, data.IPFSHash}] = true
+			for id := tx.ID; id != ""; {
+				live[id] = true
+				previous, _ := b.lookup(id)
+				id = previous.previousId
+			}
+		case TX_POLICY_SET:
+			policies[data.groupId+"\x00"+data.userId] = tx.ID
+		case TX_GROUP_CREATED:
+			live[tx.ID] = true
+		}
+	}
+
+	for _, id := range policies {
+		live[id] = true
+	}
+	for _, seq := range b.index.byKind[TX_KEY_RELEASED] {
+		tx := b.transactionAt(seq)
+		if liveFiles[fileKey{tx.Data.groupId, tx.Data.IPFSHash}] {
+			live[tx.ID] = true
+		}
+	}
+	return live
+}
+
+// rewrite replaces the whole log with blocks (genesis excluded) and records checkpoint. The new log is written under
+// PRUNED_FILE_FORMAT names first, writing the checkpoint file is what commits it, recoverPruning finishes or undoes a
+// rewrite that was cut short.
+func (s *segmentStore) rewrite(blocks []Block, checkpoint Checkpoint) error {
+	first := s.segment + 1
+	segment, size := first, int64(0)
+	records := []recordPosition{}
+	file, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf(PRUNED_FILE_FORMAT, segment)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		record := encodeRecord(encodeBlock(block))
+		if size > 0 && size+int64(len(record)) > SEGMENT_MAX_BYTES {
+			if err := closeSynced(file); err != nil {
+				return err
+			}
+			segment, size = segment+1, 0
+			file, err = os.OpenFile(filepath.Join(s.dir, fmt.Sprintf(PRUNED_FILE_FORMAT, segment)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := file.Write(record); err != nil {
+			file.Close()
+			return err
+		}
+		records = append(records, recordPosition{segment: segment, offset: size})
+		size += int64(len(record))
+	}
+	if err := closeSynced(file); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if err := writeCheckpointFile(s.dir, checkpoint, first); err != nil {
+		return err
+	}
+
+	//committed, the pruned log is the ledger whatever happens below. The cleanup left is finished by the next write or,
+	//after a crash, by recoverPruning when the ledger is opened again.
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			fmt.Println("could not close the segment pruning replaced", err)
+		}
+		s.file = nil
+	}
+	s.segment, s.segmentSize, s.records = segment, size, records
+	if err := s.finishRewrite(); err != nil {
+		fmt.Println("could not finish pruning the ledger, the next write tries again", err)
+	}
+	return nil
+}
+
+// finishRewrite puts the segments of a committed rewrite in the place of the old log and opens the last one for
+// appending, s.file stays nil until it has worked
+func (s *segmentStore) finishRewrite() error {
+	if _, err := recoverPruning(s.dir); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(segmentPath(s.dir, s.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+func closeSynced(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// recoverPruning brings dir to a consistent state after a rewrite: segments written under PRUNED_FILE_FORMAT become the
+// log when the checkpoint file names them and are thrown away otherwise, and segments older than the checkpoint's
+// first one are removed. It returns the checkpoint, nil for an archival ledger.
+func recoverPruning(dir string) (*Checkpoint, error) {
+	checkpoint, first, err := readCheckpointFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := listSegments(dir, PRUNED_FILE_FORMAT)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range pending {
+		path := filepath.Join(dir, fmt.Sprintf(PRUNED_FILE_FORMAT, segment))
+		if checkpoint != nil && pending[0] == first {
+			err = os.Rename(path, segmentPath(dir, segment))
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if checkpoint != nil {
+		segments, err := listSegments(dir, SEGMENT_FILE_FORMAT)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range segments {
+			if segment < first {
+				if err := os.Remove(segmentPath(dir, segment)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return checkpoint, syncDir(dir)
+}
+
+// the checkpoint file is a single record like the ones in the segments: the first segment of the pruned log,
+// then the checkpoint itself
+func writeCheckpointFile(dir string, checkpoint Checkpoint, firstSegment int) error {
+	payload := binary.AppendUvarint(nil, uint64(firstSegment))
+	payload = binary.AppendUvarint(payload, uint64(checkpoint.Height))
+	payload = appendString(payload, checkpoint.Hash)
+	payload = binary.AppendUvarint(payload, uint64(len(checkpoint.Validators)))
+	for _, v := range checkpoint.Validators {
+		payload = appendString(payload, v.Id)
+		payload = appendString(payload, string(v.PublicKey))
+	}
+
+	tmp := filepath.Join(dir, CHECKPOINT_FILE+".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encodeRecord(payload)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := closeSynced(file); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, CHECKPOINT_FILE)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readCheckpointFile(dir string) (*Checkpoint, int, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, CHECKPOINT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(raw) < RECORD_HEADER_SIZE || int(binary.BigEndian.Uint32(raw[:4])) != len(raw)-RECORD_HEADER_SIZE ||
+		crc32.Checksum(raw[RECORD_HEADER_SIZE:], crcTable) != binary.BigEndian.Uint32(raw[4:RECORD_HEADER_SIZE]) {
+		return nil, 0, errors.New("checkpoint file is corrupted")
+	}
+
+	r := &byteReader{buf: raw[RECORD_HEADER_SIZE:]}
+	first := int(r.uvarint())
+	checkpoint := &Checkpoint{Height: int(r.uvarint()), Hash: r.string()}
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		checkpoint.Validators = append(checkpoint.Validators, Validator{Id: r.string(), PublicKey: []byte(r.string())})
+	}
+	if r.err != nil {
+		return nil, 0, fmt.Errorf("checkpoint file is corrupted: %w", r.err)
+	}
+	return checkpoint, first, nil
+}
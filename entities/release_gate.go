@@ -0,0 +1,48 @@
+package entities
+
+import "sync"
+
+// releaseGate lets one key release at a time through per user and file. A max-downloads rule counts the releases on
+// the ledger, two downloads evaluated side by side would both see the count from before either was recorded. A release
+// that was submitted but could not be confirmed keeps counting until the ledger has it.
+type releaseGate struct {
+	mu    sync.Mutex
+	files map[string]*fileReleases //user and IPFS hash -> its releases
+}
+
+type fileReleases struct {
+	mu          sync.Mutex
+	users       int             //requests holding or waiting for mu, the entry goes once there are none and nothing is unconfirmed
+	unconfirmed map[string]bool //IDs of release records that were submitted but not seen committed
+}
+
+func newReleaseGate() *releaseGate {
+	return &releaseGate{files: map[string]*fileReleases{}}
+}
+
+// enter waits until no other release for userId and IPFSHash is being evaluated, leave has to be called after
+func (g *releaseGate) enter(userId string, IPFSHash string) *fileReleases {
+	g.mu.Lock()
+	key := userId + "\x00" + IPFSHash
+	releases, ok := g.files[key]
+	if !ok {
+		releases = &fileReleases{unconfirmed: map[string]bool{}}
+		g.files[key] = releases
+	}
+	releases.users++
+	g.mu.Unlock()
+
+	releases.mu.Lock()
+	return releases
+}
+
+func (g *releaseGate) leave(userId string, IPFSHash string, releases *fileReleases) {
+	releases.mu.Unlock()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	releases.users--
+	if releases.users == 0 && len(releases.unconfirmed) == 0 {
+		delete(g.files, userId+"\x00"+IPFSHash)
+	}
+}
@@ -0,0 +1,130 @@
+package entities
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DOWNLOAD_REQUEST_LIFETIME     = time.Minute     //how long the requests members sign stay valid
+	MAX_DOWNLOAD_REQUEST_LIFETIME = 5 * time.Minute //the proxy refuses requests that claim to be valid for longer
+	MAX_CLOCK_SKEW                = 30 * time.Second
+	REPLAY_CACHE_SIZE             = 10000 //nonces of unexpired requests the proxy remembers
+	REPLAY_CACHE_PER_USER         = 100   //of which one user may hold at most this many
+)
+
+// replayCache remembers the nonce of every download request the proxy accepted until the request expires, a request
+// is only ever good for one key release. It never forgets a nonce that could still be used: when it is full of
+// unexpired ones new requests are turned away until some expire. One user can only hold a share of it, so a member
+// signing requests in a loop does not lock everyone else out.
+type replayCache struct {
+	mu          sync.Mutex
+	seen        map[string]int64 //user and nonce -> when the request expires
+	expiries    expiryHeap       //keys of seen, soonest to expire first
+	perUser     map[string]int   //user -> how many of seen are theirs
+	capacity    int
+	userLimit   int
+	maxLifetime time.Duration
+}
+
+type replayEntry struct {
+	key       string
+	userId    string
+	expiresAt int64
+}
+
+// expiryHeap is a min-heap of replay entries by expiry, requests can be valid for different lengths of time so the
+// order they were admitted in says nothing about which expires first
+type expiryHeap []replayEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiresAt < h[j].expiresAt }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func newReplayCache(capacity int, userLimit int, maxLifetime time.Duration) *replayCache {
+	return &replayCache{seen: map[string]int64{}, perUser: map[string]int{}, capacity: capacity, userLimit: userLimit,
+		maxLifetime: maxLifetime}
+}
+
+// admit checks that a request issued at issuedAt and valid until expiresAt (unix nanoseconds) is fresh and has not
+// been seen before, and remembers it
+func (c *replayCache) admit(userId string, nonce string, issuedAt int64, expiresAt int64, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := func(message string) error {
+		return &DownloadDeniedError{Reason: ErrStaleRequest, cause: errors.New(message)}
+	}
+	switch {
+	case nonce == "":
+		return stale("download request has no nonce")
+	case expiresAt <= issuedAt:
+		return stale("download request expires before it is issued")
+	case time.Duration(expiresAt-issuedAt) > c.maxLifetime:
+		return stale(fmt.Sprintf("download request is valid for longer than %s", c.maxLifetime))
+	case issuedAt > now.Add(MAX_CLOCK_SKEW).UnixNano():
+		return stale("download request is issued in the future")
+	case expiresAt < now.UnixNano():
+		return stale("download request has expired")
+	}
+
+	key := userId + "\x00" + nonce
+	if _, seen := c.seen[key]; seen {
+		return &DownloadDeniedError{Reason: ErrReplayedRequest}
+	}
+	for c.expiries.Len() > 0 && c.expiries[0].expiresAt < now.UnixNano() {
+		entry := heap.Pop(&c.expiries).(replayEntry)
+		delete(c.seen, entry.key)
+		c.perUser[entry.userId]--
+		if c.perUser[entry.userId] == 0 {
+			delete(c.perUser, entry.userId)
+		}
+	}
+	if c.perUser[userId] >= c.userLimit {
+		return &DownloadDeniedError{Reason: ErrTooManyRequests, cause: errors.New("too many download requests in flight for this user, try again later")}
+	}
+	if len(c.seen) >= c.capacity {
+		return &DownloadDeniedError{Reason: ErrTooManyRequests}
+	}
+	c.seen[key] = expiresAt
+	c.perUser[userId]++
+	heap.Push(&c.expiries, replayEntry{key: key, userId: userId, expiresAt: expiresAt})
+	return nil
+}
+
+// SetReplayWindow changes how long a download request may be valid for, how many unexpired requests the proxy
+// remembers and how many of those one user may hold, the nonces seen so far are forgotten
+func (proxy *IPFSProxy) SetReplayWindow(maxLifetime time.Duration, capacity int, perUser int) {
+	proxy.replays.reset(capacity, perUser, maxLifetime)
+}
+
+// reset is newReplayCache in place, so downloads being admitted meanwhile see either the old window or the new one
+func (c *replayCache) reset(capacity int, userLimit int, maxLifetime time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen = map[string]int64{}
+	c.expiries = nil
+	c.perUser = map[string]int{}
+	c.capacity = capacity
+	c.userLimit = userLimit
+	c.maxLifetime = maxLifetime
+}
+
+// newNonce is a random value that makes a signed request unique
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
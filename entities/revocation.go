@@ -0,0 +1,229 @@
+package entities
+
+import (
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RevocationMode is how a group deals with the files a removed member may have had the data key of. Either way removal
+// rotates the group key (see ChangeKeyAndSecureFiles), so the removed member can't get any more keys from the proxy,
+// what differs is when the files they could have read get new data keys.
+type RevocationMode uint8
+
+const (
+	REVOCATION_EAGER RevocationMode = iota //re-encrypt every file of the group as part of the removal
+	REVOCATION_LAZY                        //rewrap the data keys and record the files stale, each one is re-encrypted on its next write or by a sweep
+)
+
+// SetRevocationMode picks eager or lazy revocation for a group, groups are eager until told otherwise. Files that are
+// already stale stay stale when switching back to eager, SweepStaleFiles takes care of them.
+func (g *GroupOwner) SetRevocationMode(groupID string, mode RevocationMode) error {
+	if mode != REVOCATION_EAGER && mode != REVOCATION_LAZY {
+		return errors.New("unknown revocation mode")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groupIdx := g.ownedGroupIndex(groupID)
+	if groupIdx == -1 {
+		return errors.New("group not found")
+	}
+	g.groupsOwned[groupIdx].revocation = mode
+	return nil
+}
+
+// ownedGroupIndex is the index of the group in groupsOwned, -1 when g does not own it. The caller holds g.mu.
+func (g *GroupOwner) ownedGroupIndex(groupID string) int {
+	for idx, group := range g.groupsOwned {
+		if group.groupID == groupID {
+			return idx
+		}
+	}
+	return -1
+}
+
+// SweepStaleFiles re-encrypts up to limit stale files of the group (all of them when limit is 0) and returns how many
+// it did. A file that fails stays stale for the next sweep, the error says which ones.
+func (g *GroupOwner) SweepStaleFiles(operator *Operators, groupID string, limit int) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groupIdx := g.ownedGroupIndex(groupID)
+	if groupIdx == -1 {
+		return 0, errors.New("group not found")
+	}
+	return g.reencryptStaleFiles(operator, groupIdx, groupID, limit)
+}
+
+// reencryptStaleFiles is SweepStaleFiles for callers already holding g.mu
+func (g *GroupOwner) reencryptStaleFiles(operator *Operators, groupIdx int, groupID string, limit int) (int, error) {
+	files := g.groupsOwned[groupIdx].files
+	count := 0
+	errs := []error{}
+	for idx, file := range files {
+		if !file.Stale {
+			continue
+		}
+		if limit > 0 && count == limit {
+			break
+		}
+		reencrypted, err := g.reencryptFile(operator, groupID, file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file.FileName, err))
+		}
+		if reencrypted.TransactionID == "" {
+			continue
+		}
+		files[idx] = reencrypted
+		count++
+	}
+	return count, errors.Join(errs...)
+}
+
+// reencryptFile puts the content of file on IPFS again under a new data key and retires the old ciphertext
+func (g *GroupOwner) reencryptFile(operator *Operators, groupID string, file File) (File, error) {
+	latestHash, err := operator.blockchain.ResolveLatestTransaction(file.TransactionID)
+	if err != nil {
+		return File{}, err
+	}
+	data, err := operator.blockchain.GetTransactionByHash(latestHash)
+	if err != nil {
+		return File{}, err
+	}
+
+	_, releasedKey, err := g.requestKey(operator, groupID, latestHash, data)
+	if err != nil {
+		return File{}, err
+	}
+	dataKey, err := openReleasedKey(releasedKey, g.privateKey)
+	if err != nil {
+		return File{}, err
+	}
+	defer clear(dataKey)
+	return g.reencryptWithDataKey(operator, groupID, file, latestHash, data, dataKey)
+}
+
+// reencryptWithDataKey is reencryptFile for a file whose data key the owner already has, data is the current version
+// of the file (the record with ID latestHash)
+func (g *GroupOwner) reencryptWithDataKey(operator *Operators, groupID string, file File, latestHash string, data Data, dataKey []byte) (File, error) {
+	//a sweep runs next to downloads of the same file, which use the working directory, so it works in one of its own
+	dir, err := os.MkdirTemp("", "reencrypt-")
+	if err != nil {
+		return File{}, err
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, data.IPFSHash)
+	if err := ipfs.GetFileFromIPFS(operator.sh, data.IPFSHash, filePath); err != nil {
+		return File{}, err
+	}
+	decryptedFilePath, _, err := utils.DecryptFileWithDataKey(filePath, dataKey)
+	if err != nil {
+		return File{}, err
+	}
+	//put the plaintext where the old ciphertext was so the new version keeps its name
+	if err := os.Rename(decryptedFilePath, filePath); err != nil {
+		return File{}, err
+	}
+
+	return g.replaceVersion(operator, groupID, file, filePath, TX_FILE_REENCRYPTED, latestHash, data)
+}
+
+// UpdateFile writes new content for a file of the group, transactionID may be any version of it. The new version gets
+// a data key of its own, so this is also where a stale file of a lazy group stops being stale.
+func (g *GroupOwner) UpdateFile(operator *Operators, groupID string, transactionID string, filePath string) (string, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groupIdx := g.ownedGroupIndex(groupID)
+	if groupIdx == -1 {
+		return "", "", errors.New("group not found")
+	}
+	latestHash, err := operator.blockchain.ResolveLatestTransaction(transactionID)
+	if err != nil {
+		return "", "", err
+	}
+	data, err := operator.blockchain.GetTransactionByHash(latestHash)
+	if err != nil {
+		return "", "", err
+	}
+
+	files := g.groupsOwned[groupIdx].files
+	for idx, file := range files {
+		if file.TransactionID != latestHash {
+			continue
+		}
+		updated, err := g.replaceVersion(operator, groupID, file, filePath, TX_FILE_UPDATED, latestHash, data)
+		if updated.TransactionID != "" {
+			files[idx] = updated
+		}
+		return updated.TransactionID, updated.Handle, err
+	}
+	return "", "", errors.New("file is not one of the group's files")
+}
+
+// replaceVersion uploads filePath as the version of file that follows previous (the record with ID previousId) and
+// takes the old ciphertext off IPFS, the file keeps its name and tags. The new version is already on the ledger when
+// cleaning up after the old one fails, so the replacement comes back with that error and callers keep it.
+func (g *GroupOwner) replaceVersion(operator *Operators, groupID string, file File, filePath string, kind TransactionKind, previousId string, previous Data) (File, error) {
+	replacement, err := g.upload(operator, groupID, filePath, kind, previousId, previous.tags)
+	if err != nil {
+		return File{}, err
+	}
+	replacement.FileName = file.FileName
+	replacement.fileOwner = file.fileOwner
+
+	if err := ipfs.DeleteFileFromIPFS(operator.sh, previous.IPFSHash); err != nil {
+		return replacement, fmt.Errorf("could not delete the old version from IPFS: %w", err)
+	}
+	_, err = g.recordOnLedger(operator.blockchain, Data{
+		groupId:       groupID,
+		IPFSHash:      previous.IPFSHash,
+		fileExtension: previous.fileExtension,
+		kind:          TX_FILE_DELETED,
+		previousId:    previousId,
+	})
+	if err != nil {
+		return replacement, fmt.Errorf("could not record the deletion of the old version: %w", err)
+	}
+	return replacement, nil
+}
+
+// StaleFileSweeper re-encrypts the stale files of a group in the background, a batch of them every interval, so a
+// lazy group catches up without a removal or a write having to wait for it
+type StaleFileSweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartStaleFileSweep starts a StaleFileSweeper for the group. The sweeper uses operator from its own goroutine, next to
+// whatever else the owner and the members do with it.
+func (g *GroupOwner) StartStaleFileSweep(operator *Operators, groupID string, interval time.Duration, batch int) (*StaleFileSweeper, error) {
+	sweeper := &StaleFileSweeper{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(sweeper.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sweeper.stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := g.SweepStaleFiles(operator, groupID, batch); err != nil {
+				fmt.Println("could not re-encrypt stale files", err)
+			}
+		}
+	}()
+	return sweeper, nil
+}
+
+// Stop stops the sweeper, a sweep that is under way is finished first
+func (s *StaleFileSweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,123 @@
+package entities
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const MAX_KEY_SHARES = 255 //shares are points of a polynomial over GF(2^8), x = 0 is the secret itself
+
+// keyShare is one point of the polynomials that split a file's data key, index is the x coordinate (1 to
+// MAX_KEY_SHARES) and value holds one y coordinate per byte of the key. Group requests use it for the key pair of one
+// proxy of a threshold group as well, index is then the proxy's place in the group key.
+type keyShare struct {
+	index int
+	value []byte
+}
+
+// splitSecret splits secret into n shares so that any k of them give it back and fewer than k say nothing about it
+// (Shamir's secret sharing, one polynomial of degree k-1 per byte of the secret)
+func splitSecret(secret []byte, n int, k int) ([]keyShare, error) {
+	if k < 1 || k > n || n > MAX_KEY_SHARES {
+		return nil, fmt.Errorf("can't split a key into %d shares with a threshold of %d", n, k)
+	}
+
+	coefficients := make([]byte, len(secret)*(k-1)) //the random ones, the constant term of each polynomial is the secret
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, err
+	}
+	defer clear(coefficients)
+
+	shares := make([]keyShare, n)
+	for i := range shares {
+		x := byte(i + 1)
+		shares[i] = keyShare{index: i + 1, value: make([]byte, len(secret))}
+		for b := range secret {
+			polynomial := coefficients[b*(k-1) : (b+1)*(k-1)]
+			y := byte(0)
+			for c := len(polynomial) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ polynomial[c]
+			}
+			shares[i].value[b] = gfMul(y, x) ^ secret[b]
+		}
+	}
+	return shares, nil
+}
+
+// combineShares gives back the secret shares were split from, as long as there are at least as many as the threshold
+// it was split with. With fewer, or with a share that was tampered with, the result is garbage rather than an error.
+func combineShares(shares []keyShare) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no key shares to combine")
+	}
+	seen := map[int]bool{}
+	for _, share := range shares {
+		if share.index < 1 || share.index > MAX_KEY_SHARES || seen[share.index] {
+			return nil, errors.New("key shares have invalid or repeated indexes")
+		}
+		if len(share.value) != len(shares[0].value) {
+			return nil, errors.New("key shares are not of the same key")
+		}
+		seen[share.index] = true
+	}
+
+	//Lagrange interpolation at x = 0, subtraction is xor in GF(2^8)
+	secret := make([]byte, len(shares[0].value))
+	for i, share := range shares {
+		xi := byte(share.index)
+		basis := byte(1)
+		for j, other := range shares {
+			if j == i {
+				continue
+			}
+			xj := byte(other.index)
+			basis = gfMul(basis, gfMul(xj, gfInverse(xj^xi)))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, share.value[b])
+		}
+	}
+	return secret, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching on the (secret) operands
+func gfMul(a byte, b byte) byte {
+	p := byte(0)
+	for i := 0; i < 8; i++ {
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInverse is a^254, which is 1/a for every a but 0
+func gfInverse(a byte) byte {
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = gfMul(inverse, a)
+	}
+	return inverse
+}
+
+// encodeKeyShare is what a proxy encrypts for the member when it releases its share, the tag keeps a share from being
+// taken for anything else encrypted with the member's key
+func encodeKeyShare(share keyShare) []byte {
+	buf := appendString([]byte{}, "key-share")
+	buf = binary.AppendUvarint(buf, uint64(share.index))
+	return appendString(buf, string(share.value))
+}
+
+func decodeKeyShare(buf []byte) (keyShare, error) {
+	r := &byteReader{buf: buf}
+	if r.string() != "key-share" {
+		return keyShare{}, errors.New("released key is not a key share")
+	}
+	share := keyShare{index: int(r.uvarint()), value: []byte(r.string())}
+	if r.err != nil {
+		return keyShare{}, fmt.Errorf("malformed key share: %w", r.err)
+	}
+	return share, nil
+}
@@ -0,0 +1,387 @@
+package entities
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	SNAPSHOT_FORMAT  = "blockchain-fileshare/ledger-snapshot"
+	SNAPSHOT_VERSION = 1
+	SNAPSHOT_MAGIC   = "BCFSLEDG" //first bytes of a binary snapshot, a JSON snapshot starts with '{'
+)
+
+// the JSON snapshot spells everything out so an auditor can read it without this code,
+// keys are PEM text and signatures/seals are base64 (encoding/json's default for []byte)
+type jsonSnapshot struct {
+	Format     string          `json:"format"`
+	Version    int             `json:"version"`
+	Height     int             `json:"height"`
+	TipHash    string          `json:"tipHash"`
+	Validators []jsonValidator `json:"validators,omitempty"` //genesis validator set, only for proof of authority chains
+	Blocks     []jsonBlock     `json:"blocks"`
+}
+
+type jsonValidator struct {
+	Id        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+type jsonBlock struct {
+	Index        int               `json:"index"`
+	Timestamp    int64             `json:"timestamp"`
+	PrevHash     string            `json:"prevHash"`
+	MerkleRoot   string            `json:"merkleRoot"`
+	Sealer       string            `json:"sealer,omitempty"`
+	Hash         string            `json:"hash"`
+	Seal         []byte            `json:"seal,omitempty"`
+	Transactions []jsonTransaction `json:"transactions"`
+}
+
+type jsonTransaction struct {
+	Id            string   `json:"id"`
+	Kind          string   `json:"kind"`
+	UserId        string   `json:"userId"`
+	GroupId       string   `json:"groupId,omitempty"`
+	FileHash      []byte   `json:"fileHash,omitempty"` //raw md5 bytes, not text
+	IPFSHash      string   `json:"ipfsHash,omitempty"`
+	FileExtension string   `json:"fileExtension,omitempty"`
+	MemberId      string   `json:"memberId,omitempty"`
+	GroupKey      string   `json:"groupKey,omitempty"`
+	PublicKey     string   `json:"publicKey,omitempty"`
+	PreviousId    string   `json:"previousId,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Policy        string   `json:"policy,omitempty"`
+	FileKey       []byte   `json:"fileKey,omitempty"`
+	FileId        string   `json:"fileId,omitempty"`
+	Nonce         string   `json:"nonce,omitempty"`
+	Stale         bool     `json:"stale,omitempty"`
+	CreatedAt     int64    `json:"createdAt"`
+	SignerKey     string   `json:"signerKey"`
+	Signature     []byte   `json:"signature"`
+}
+
+func (b *Blockchain) snapshot() ([]Block, []Validator, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.checkpoint != nil {
+		return nil, nil, errors.New("a pruned ledger cannot be exported, export from an archival node")
+	}
+	return append([]Block{}, b.blocks...), b.genesisValidators(), nil
+}
+
+// ExportJSON writes the whole chain, genesis included, as a self-describing JSON document
+func (b *Blockchain) ExportJSON(w io.Writer) error {
+	blocks, validators, err := b.snapshot()
+	if err != nil {
+		return err
+	}
+
+	snapshot := jsonSnapshot{
+		Format:  SNAPSHOT_FORMAT,
+		Version: SNAPSHOT_VERSION,
+		Height:  len(blocks) - 1,
+		TipHash: blocks[len(blocks)-1].Header.Hash,
+		Blocks:  make([]jsonBlock, 0, len(blocks)),
+	}
+	for _, v := range validators {
+		snapshot.Validators = append(snapshot.Validators, jsonValidator{Id: v.Id, PublicKey: string(v.PublicKey)})
+	}
+	for _, block := range blocks {
+		jb := jsonBlock{
+			Index:        block.Header.Index,
+			Timestamp:    block.Header.Timestamp,
+			PrevHash:     block.Header.PrevHash,
+			MerkleRoot:   block.Header.MerkleRoot,
+			Sealer:       block.Header.Sealer,
+			Hash:         block.Header.Hash,
+			Seal:         block.Header.Seal,
+			Transactions: make([]jsonTransaction, 0, len(block.Transactions)),
+		}
+		for _, tx := range block.Transactions {
+			d := tx.Data
+			jb.Transactions = append(jb.Transactions, jsonTransaction{
+				Id:            tx.ID,
+				Kind:          d.kind.String(),
+				UserId:        d.userId,
+				GroupId:       d.groupId,
+				FileHash:      []byte(d.fileHash),
+				IPFSHash:      d.IPFSHash,
+				FileExtension: d.fileExtension,
+				MemberId:      d.memberId,
+				GroupKey:      d.groupKey,
+				PublicKey:     string(d.publicKey),
+				PreviousId:    d.previousId,
+				Tags:          d.tags,
+				Policy:        d.policy,
+				FileKey:       d.fileKey,
+				FileId:        d.fileId,
+				Nonce:         d.nonce,
+				Stale:         d.stale,
+				CreatedAt:     d.createdAt,
+				SignerKey:     string(d.signerKey),
+				Signature:     d.signature,
+			})
+		}
+		snapshot.Blocks = append(snapshot.Blocks, jb)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
+
+// ExportBinary writes the chain as SNAPSHOT_MAGIC, a version byte, the genesis validators, every block in the same
+// encoding the segment store uses and finally the tip hash
+func (b *Blockchain) ExportBinary(w io.Writer) error {
+	blocks, validators, err := b.snapshot()
+	if err != nil {
+		return err
+	}
+
+	buf := []byte(SNAPSHOT_MAGIC)
+	buf = append(buf, SNAPSHOT_VERSION)
+	buf = binary.AppendUvarint(buf, uint64(len(validators)))
+	for _, v := range validators {
+		buf = appendString(buf, v.Id)
+		buf = appendString(buf, string(v.PublicKey))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(blocks)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		if _, err := w.Write(appendString(nil, string(encodeBlock(block)))); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(appendString(nil, blocks[len(blocks)-1].Header.Hash))
+	return err
+}
+
+// SnapshotTrust is what a snapshot is checked against besides itself, obtained out of band: a snapshot can be made up
+// from scratch by whoever lists their own key as its validator, so at least one of the two has to be set
+type SnapshotTrust struct {
+	GenesisValidators []Validator //the validators the chain started with, nil for a chain without proof of authority
+	TipHash           string      //hash of the last block of the snapshot, e.g. from a Checkpoint
+}
+
+// ImportSnapshot reads a JSON or binary snapshot (told apart by the first bytes), re-verifies every hash link, merkle
+// root, transaction signature and (for proof of authority chains) block seal against trust, and only then hands back
+// a ledger. With an empty dir the ledger is in memory, otherwise it is written to a fresh on-disk ledger in dir.
+// A proof of authority ledger comes back as a follower, call EnableProofOfAuthority again to seal with it.
+func ImportSnapshot(r io.Reader, dir string, trust SnapshotTrust) (*Blockchain, error) {
+	if trust.GenesisValidators == nil && trust.TipHash == "" {
+		return nil, errors.New("snapshot import needs trusted genesis validators or the hash of its tip")
+	}
+
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(len(SNAPSHOT_MAGIC))
+	if err != nil && len(magic) == 0 {
+		return nil, err
+	}
+
+	var blocks []Block
+	var validators []Validator
+	if bytes.Equal(magic, []byte(SNAPSHOT_MAGIC)) {
+		blocks, validators, err = readBinarySnapshot(reader)
+	} else {
+		blocks, validators, err = readJSONSnapshot(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if trust.GenesisValidators != nil && !sameValidators(validators, trust.GenesisValidators) {
+		return nil, errors.New("snapshot validators do not match the trusted ones")
+	}
+	if badIdx, err := verifyBlocks(blocks, validators, nil, nil); err != nil {
+		return nil, fmt.Errorf("snapshot failed verification at block %d: %w", badIdx, err)
+	}
+	if trust.TipHash != "" && blocks[len(blocks)-1].Header.Hash != trust.TipHash {
+		return nil, errors.New("snapshot does not end at the trusted tip")
+	}
+	if err := checkUniqueTransactions(blocks); err != nil {
+		return nil, err
+	}
+
+	blockchain := CreateBlockChain()
+	if dir != "" {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+			return nil, errors.New("refusing to import into a directory that is not empty")
+		}
+		blockchain, err = OpenBlockChain(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	if validators != nil {
+		blockchain.authority = &proofOfAuthority{genesis: validators}
+		blockchain.validators = append([]Validator{}, validators...)
+	}
+	for _, block := range blocks[1:] {
+		if err := blockchain.appendBlock(block); err != nil {
+			return nil, err
+		}
+	}
+	return blockchain, nil
+}
+
+func sameValidators(validators []Validator, other []Validator) bool {
+	if len(validators) != len(other) {
+		return false
+	}
+	for idx, v := range validators {
+		if v.Id != other[idx].Id || !bytes.Equal(v.PublicKey, other[idx].PublicKey) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkUniqueTransactions(blocks []Block) error {
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			if seen[tx.ID] {
+				return fmt.Errorf("snapshot contains transaction %s twice", tx.ID)
+			}
+			seen[tx.ID] = true
+		}
+	}
+	return nil
+}
+
+func readJSONSnapshot(r io.Reader) ([]Block, []Validator, error) {
+	snapshot := jsonSnapshot{}
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, nil, fmt.Errorf("malformed snapshot: %w", err)
+	}
+	if snapshot.Format != SNAPSHOT_FORMAT || snapshot.Version != SNAPSHOT_VERSION {
+		return nil, nil, errors.New("unsupported snapshot format or version")
+	}
+
+	var validators []Validator
+	for _, v := range snapshot.Validators {
+		validators = append(validators, Validator{Id: v.Id, PublicKey: []byte(v.PublicKey)})
+	}
+
+	blocks := make([]Block, 0, len(snapshot.Blocks))
+	for _, jb := range snapshot.Blocks {
+		block := Block{
+			Header: BlockHeader{
+				Index:      jb.Index,
+				Timestamp:  jb.Timestamp,
+				PrevHash:   jb.PrevHash,
+				MerkleRoot: jb.MerkleRoot,
+				Sealer:     jb.Sealer,
+				Hash:       jb.Hash,
+				Seal:       jb.Seal,
+			},
+			Transactions: make([]Transaction, 0, len(jb.Transactions)),
+		}
+		for _, jt := range jb.Transactions {
+			kind, ok := parseTransactionKind(jt.Kind)
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown transaction kind %q", jt.Kind)
+			}
+			block.Transactions = append(block.Transactions, Transaction{
+				ID: jt.Id,
+				Data: Data{
+					userId:        jt.UserId,
+					groupId:       jt.GroupId,
+					fileHash:      string(jt.FileHash),
+					IPFSHash:      jt.IPFSHash,
+					fileExtension: jt.FileExtension,
+					kind:          kind,
+					memberId:      jt.MemberId,
+					groupKey:      jt.GroupKey,
+					publicKey:     []byte(jt.PublicKey),
+					previousId:    jt.PreviousId,
+					tags:          jt.Tags,
+					policy:        jt.Policy,
+					fileKey:       jt.FileKey,
+					fileId:        jt.FileId,
+					nonce:         jt.Nonce,
+					stale:         jt.Stale,
+					createdAt:     jt.CreatedAt,
+					signerKey:     []byte(jt.SignerKey),
+					signature:     jt.Signature,
+				},
+			})
+		}
+		blocks = append(blocks, block)
+	}
+
+	if err := checkSnapshotTip(blocks, snapshot.Height, snapshot.TipHash); err != nil {
+		return nil, nil, err
+	}
+	return blocks, validators, nil
+}
+
+func readBinarySnapshot(r io.Reader) ([]Block, []Validator, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw = raw[len(SNAPSHOT_MAGIC):]
+	if len(raw) == 0 || raw[0] != SNAPSHOT_VERSION {
+		return nil, nil, errors.New("unsupported snapshot format or version")
+	}
+
+	reader := &byteReader{buf: raw[1:]}
+	var validators []Validator
+	validatorCount := reader.uvarint()
+	for i := uint64(0); i < validatorCount && reader.err == nil; i++ {
+		validators = append(validators, Validator{Id: reader.string(), PublicKey: []byte(reader.string())})
+	}
+
+	blockCount := reader.uvarint()
+	if reader.err == nil && blockCount > uint64(len(raw)) {
+		return nil, nil, errors.New("malformed snapshot: block count out of range")
+	}
+	blocks := make([]Block, 0, blockCount)
+	for i := uint64(0); i < blockCount && reader.err == nil; i++ {
+		block, err := decodeBlock([]byte(reader.string()))
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	tipHash := reader.string()
+	if reader.err != nil {
+		return nil, nil, fmt.Errorf("malformed snapshot: %w", reader.err)
+	}
+
+	if err := checkSnapshotTip(blocks, len(blocks)-1, tipHash); err != nil {
+		return nil, nil, err
+	}
+	return blocks, validators, nil
+}
+
+// checkSnapshotTip catches snapshots that were cut short, the declared tip has to be the last block
+func checkSnapshotTip(blocks []Block, height int, tipHash string) error {
+	if len(blocks) == 0 || len(blocks)-1 != height || blocks[len(blocks)-1].Header.Hash != tipHash {
+		return errors.New("snapshot does not end at the tip it declares")
+	}
+	return nil
+}
+
+func parseTransactionKind(name string) (TransactionKind, bool) {
+	for kind := TX_FILE_UPLOADED; kind.String() != "unknown"; kind++ {
+		if kind.String() == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,127 @@
+package entities
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const SUBSCRIPTION_BUFFER_SIZE = 64
+
+// SubscriptionFilter picks the transactions a subscriber hears about, every field left at its zero value matches everything
+type SubscriptionFilter struct {
+	GroupId string
+	UserId  string
+	Kinds   []TransactionKind
+
+	//FromHeight is the first block to deliver. Blocks already on the chain from that height on are replayed before
+	//new ones, so a consumer that remembers the last BlockIndex it handled resumes from BlockIndex+1 without gaps.
+	FromHeight int
+}
+
+// Subscription delivers matching transactions on Events in chain order until Close is called
+type Subscription struct {
+	Events <-chan LedgerEntry
+
+	events    chan LedgerEntry
+	done      chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+	forksSeen atomic.Int64 //how many fork switches the subscription has rewound for, counted from the first one
+}
+
+// Subscribe streams transactions that match filter as they land on the chain. After a fork switch the subscription
+// rewinds to the block the chain rolled back to, so transactions of the winning branch are delivered even when a
+// block at the same height was delivered before. A consumer that must not act twice can dedupe on the transaction ID.
+func (b *Blockchain) Subscribe(filter SubscriptionFilter) (*Subscription, error) {
+	if filter.FromHeight < 0 {
+		return nil, errors.New("height must not be negative")
+	}
+
+	events := make(chan LedgerEntry, SUBSCRIPTION_BUFFER_SIZE)
+	sub := &Subscription{Events: events, events: events, done: make(chan struct{})}
+
+	b.mu.Lock()
+	sub.forksSeen.Store(int64(b.forkBase + len(b.forkPoints)))
+	if b.subs == nil {
+		b.subs = map[*Subscription]bool{}
+	}
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	sub.wg.Add(1)
+	go sub.run(b, filter)
+	return sub, nil
+}
+
+// Close stops delivery and closes Events, it is safe to call more than once
+func (s *Subscription) Close() {
+	s.once.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+func (s *Subscription) run(b *Blockchain, filter SubscriptionFilter) {
+	defer s.wg.Done()
+	defer close(s.events)
+	defer b.unsubscribe(s)
+
+	query := LedgerQuery{GroupId: filter.GroupId, UserId: filter.UserId, Kinds: filter.Kinds}
+	next := filter.FromHeight
+	for {
+		b.mu.RLock()
+		for _, keep := range b.forkPoints[int(s.forksSeen.Load())-b.forkBase:] {
+			if next > keep+1 {
+				next = keep + 1
+			}
+		}
+		s.forksSeen.Store(int64(b.forkBase + len(b.forkPoints))) //under the read lock, so no trim runs in between
+
+		if next >= len(b.blocks) {
+			changed := b.changed
+			b.mu.RUnlock()
+			select {
+			case <-changed:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		block := b.blocks[next]
+		b.mu.RUnlock()
+
+		for _, tx := range block.Transactions {
+			if tx.Pruned || !query.matches(tx.Data) {
+				continue
+			}
+			select {
+			case s.events <- LedgerEntry{BlockIndex: block.Header.Index, Timestamp: block.Header.Timestamp, Transaction: tx}:
+			case <-s.done:
+				return
+			}
+		}
+		next++
+	}
+}
+
+func (b *Blockchain) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+	b.trimForkPoints()
+}
+
+// trimForkPoints drops the fork points every subscription has already rewound for, it needs the write lock
+func (b *Blockchain) trimForkPoints() {
+	seen := b.forkBase + len(b.forkPoints)
+	for sub := range b.subs {
+		seen = min(seen, int(sub.forksSeen.Load()))
+	}
+	b.forkPoints = append([]int{}, b.forkPoints[seen-b.forkBase:]...)
+	b.forkBase = seen
+}
+
+// notifyChanged wakes every subscription waiting for the chain to move, it needs the write lock
+func (b *Blockchain) notifyChanged() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
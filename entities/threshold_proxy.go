@@ -0,0 +1,343 @@
+package entities
+
+import (
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// ThresholdProxy spreads every group over several proxies so that none of them can decrypt a file on its own: the data
+// key of every file is split into one share per proxy and any threshold of them have to release their share before a
+// member can decrypt. It runs on the client side, in front of the proxies (usually ProxyClients to proxies on other
+// hosts), and is used like any other Proxy.
+//
+// The group key of a threshold group is a set of key pairs, one per proxy, dealt by whoever registers the group or
+// rotates its key, in the owner's process: each proxy only ever gets its own private key. Uploads split the data key
+// and wrap every share to the public key of one proxy (see wrapDataKey). Every proxy checks a download on its own and
+// re-encrypts its share of that one file's data key for the member, so like with a single proxy a member only ever
+// gets the data key of the file they download, and only when threshold proxies agree to it.
+type ThresholdProxy struct {
+	proxies   []Proxy
+	threshold int
+	ledger    Ledger
+}
+
+// a ThresholdProxy's ReleaseKey returns the shares it collected bundled after this tag, each one still encrypted for
+// the member (see openReleasedKey). The data key of a file in a threshold group is bundled the same way on its ledger
+// record, share i encrypted for proxy i.
+var shareBundleTag = appendString([]byte{}, "key-shares")
+
+// the group key of a threshold group starts with this tag, followed by the threshold and the public key of every proxy
+var proxyKeysTag = appendString([]byte{}, "proxy-keys")
+
+func CreateThresholdProxy(threshold int, proxies ...Proxy) (*ThresholdProxy, error) {
+	if threshold < 1 || threshold > len(proxies) || len(proxies) > MAX_KEY_SHARES {
+		return nil, fmt.Errorf("can't require %d of %d proxies", threshold, len(proxies))
+	}
+	return &ThresholdProxy{proxies: proxies, threshold: threshold}, nil
+}
+
+// Connect wires every proxy behind t, the ledger is also where owners record their group changes
+func (t *ThresholdProxy) Connect(sh *shell.Shell, ledger Ledger) {
+	for _, proxy := range t.proxies {
+		proxy.Connect(sh, ledger)
+	}
+	t.ledger = ledger
+}
+
+func (t *ThresholdProxy) connectedLedger() Ledger {
+	return t.ledger
+}
+
+// prepareGroupRequest deals a new group key for registrations and key rotations, a key pair for every proxy: the
+// owner signs the public keys and a digest of every private one, so no proxy can be handed a key the owner did not deal
+func (t *ThresholdProxy) prepareGroupRequest(request GroupRequest) (GroupRequest, error) {
+	if request.action != GROUP_REGISTER && request.action != GROUP_ROTATE_KEY {
+		return request, nil
+	}
+
+	request.groupKey = binary.AppendUvarint(append([]byte{}, proxyKeysTag...), uint64(t.threshold))
+	request.shares = []keyShare{}
+	request.shareDigests = [][]byte{}
+	for i := range t.proxies {
+		public, private := keys.GenerateKeyPairInMemory()
+		request.groupKey = appendString(request.groupKey, string(public))
+		request.shares = append(request.shares, keyShare{index: i + 1, value: private})
+		digest := sha256.Sum256(private)
+		request.shareDigests = append(request.shareDigests, digest[:])
+	}
+	if request.action == GROUP_REGISTER {
+		request.groupId = uuid.New().String()[:6]
+	}
+	return request, nil
+}
+
+// prepareUpload encrypts the file under a new data key before it leaves the client and wraps a share of that key for
+// every proxy (see wrapDataKey), the proxy that takes the upload only gets the ciphertext and shares it can't open but
+// its own. filePath becomes the ciphertext, a file in the working directory the caller removes when done with it.
+func (t *ThresholdProxy) prepareUpload(uploadReq UploadRequest) (UploadRequest, error) {
+	groupKey, err := t.GroupKey(uploadReq.groupID)
+	if err != nil {
+		return UploadRequest{}, err
+	}
+	if !bytes.HasPrefix(groupKey, proxyKeysTag) {
+		return UploadRequest{}, errors.New("group is not split over threshold proxies")
+	}
+
+	encryptedFilePath, checksum, fileKey, err := utils.EncryptFileWithDataKey(uploadReq.filePath, func(dataKey []byte) ([]byte, error) {
+		return wrapDataKey(dataKey, groupKey)
+	})
+	if err != nil {
+		return UploadRequest{}, err
+	}
+	uploadReq.filePath, uploadReq.checksum, uploadReq.fileKey = encryptedFilePath, checksum, fileKey
+	return uploadReq, nil
+}
+
+// forProxy is request as proxy i gets it, with its own share only
+func (t *ThresholdProxy) forProxy(request GroupRequest, i int) GroupRequest {
+	request.shares = []keyShare{request.shares[i]}
+	return request
+}
+
+// RegisterGroup registers the group on every proxy, the group is only usable once they all have their share
+func (t *ThresholdProxy) RegisterGroup(request GroupRequest) (string, []byte, error) {
+	if len(request.shares) != len(t.proxies) {
+		return "", nil, errors.New("group key was not dealt for this threshold proxy")
+	}
+	for i, proxy := range t.proxies {
+		if _, _, err := proxy.RegisterGroup(t.forProxy(request, i)); err != nil {
+			return "", nil, fmt.Errorf("proxy %d could not register the group: %w", i+1, err)
+		}
+	}
+	return request.groupId, request.groupKey, nil
+}
+
+// AddMember and RemoveMember go to every proxy, the error says which ones did not take the change
+func (t *ThresholdProxy) AddMember(request GroupRequest) error {
+	return t.everyProxy(func(proxy Proxy) error { return proxy.AddMember(request) })
+}
+
+func (t *ThresholdProxy) RemoveMember(request GroupRequest) error {
+	return t.everyProxy(func(proxy Proxy) error { return proxy.RemoveMember(request) })
+}
+
+// RotateGroupKey hands every proxy its share of a newly dealt key. When some proxies fail the shares no longer add
+// up, rotating again deals a new key to all of them.
+func (t *ThresholdProxy) RotateGroupKey(request GroupRequest) ([]byte, error) {
+	if len(request.shares) != len(t.proxies) {
+		return nil, errors.New("group key was not dealt for this threshold proxy")
+	}
+	for i, proxy := range t.proxies {
+		if _, err := proxy.RotateGroupKey(t.forProxy(request, i)); err != nil {
+			return nil, fmt.Errorf("proxy %d could not rotate the group key: %w", i+1, err)
+		}
+	}
+	return request.groupKey, nil
+}
+
+func (t *ThresholdProxy) everyProxy(change func(proxy Proxy) error) error {
+	errs := []error{}
+	for i, proxy := range t.proxies {
+		if err := change(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("proxy %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OwnerOf is the owner threshold proxies agree on
+func (t *ThresholdProxy) OwnerOf(groupId string) (string, error) {
+	votes := map[string]int{}
+	errs := []error{}
+	for i, proxy := range t.proxies {
+		ownerId, err := proxy.OwnerOf(groupId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy %d: %w", i+1, err))
+			continue
+		}
+		votes[ownerId]++
+		if votes[ownerId] >= t.threshold {
+			return ownerId, nil
+		}
+	}
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+	return "", errors.New("proxies do not agree on the owner of the group")
+}
+
+// GroupKey is the group key threshold proxies agree on, the file keys of the group are wrapped for it
+func (t *ThresholdProxy) GroupKey(groupId string) ([]byte, error) {
+	votes := map[string]int{}
+	errs := []error{}
+	for i, proxy := range t.proxies {
+		groupKey, err := proxy.GroupKey(groupId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy %d: %w", i+1, err))
+			continue
+		}
+		votes[string(groupKey)]++
+		if votes[string(groupKey)] >= t.threshold {
+			return groupKey, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, errors.New("proxies do not agree on the group key")
+}
+
+// IsMember is true when threshold proxies say so, which is what it takes to download
+func (t *ThresholdProxy) IsMember(groupId string, userId string) bool {
+	votes := 0
+	for _, proxy := range t.proxies {
+		if proxy.IsMember(groupId, userId) {
+			votes++
+		}
+		if votes >= t.threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload hands the file prepareUpload encrypted to the first proxy that takes it, it only adds the ciphertext to IPFS
+func (t *ThresholdProxy) Upload(uploadReq UploadRequest) (string, string, []byte, error) {
+	errs := []error{}
+	for i, proxy := range t.proxies {
+		handle, checksum, fileKey, err := proxy.Upload(uploadReq)
+		if err == nil {
+			return handle, checksum, fileKey, nil
+		}
+		errs = append(errs, fmt.Errorf("proxy %d: %w", i+1, err))
+	}
+	return "", "", nil, errors.Join(errs...)
+}
+
+// ReleaseKey asks the proxies in turn for their share until threshold of them released one. Each proxy checks the
+// signed request on its own and accepts it once. The shares come back encrypted for the requester, who combines them.
+func (t *ThresholdProxy) ReleaseKey(downloadRequest DownloadRequest, signature []byte) ([]byte, error) {
+	released := append([]byte{}, shareBundleTag...)
+	count := 0
+	errs := []error{}
+	for i, proxy := range t.proxies {
+		encryptedShare, err := proxy.ReleaseKey(downloadRequest, signature)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy %d: %w", i+1, err))
+			continue
+		}
+		released = appendString(released, string(encryptedShare))
+		count++
+		if count == t.threshold {
+			return released, nil
+		}
+	}
+	return nil, fmt.Errorf("only %d of the %d proxies needed released their share: %w", count, t.threshold, errors.Join(errs...))
+}
+
+func (t *ThresholdProxy) ChangeKeyAndSecureFiles(operator *Operators, groupOwner *GroupOwner, groupIdx int, groupID string) ([]File, error) {
+	return changeKeyAndSecureFiles(operator, groupOwner, groupIdx, groupID)
+}
+
+// openReleasedKey decrypts what a proxy released with the requester's private key and returns the data key of the
+// file. A proxy releases the data key itself, a ThresholdProxy the shares of it, which are combined.
+func openReleasedKey(released []byte, privateKey []byte) ([]byte, error) {
+	if !bytes.HasPrefix(released, shareBundleTag) {
+		return utils.DecryptKey(released, privateKey)
+	}
+
+	r := &byteReader{buf: released[len(shareBundleTag):]}
+	shares := []keyShare{}
+	for len(r.buf) > 0 {
+		encryptedShare := r.string()
+		if r.err != nil {
+			return nil, fmt.Errorf("malformed key shares: %w", r.err)
+		}
+		encodedShare, err := utils.DecryptKey([]byte(encryptedShare), privateKey)
+		if err != nil {
+			return nil, err
+		}
+		share, err := decodeKeyShare(encodedShare)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	dataKey, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKey) != utils.DATA_KEY_SIZE {
+		return nil, errors.New("key shares do not combine into a data key")
+	}
+	return dataKey, nil
+}
+
+// wrapDataKey encrypts a file's data key for the group key: with the group public key, or for a threshold group split
+// into shares that are each encrypted with the public key of one proxy
+func wrapDataKey(dataKey []byte, groupKey []byte) ([]byte, error) {
+	if !bytes.HasPrefix(groupKey, proxyKeysTag) {
+		return utils.EncryptKey(dataKey, groupKey)
+	}
+
+	r := &byteReader{buf: groupKey[len(proxyKeysTag):]}
+	threshold := int(r.uvarint())
+	proxyKeys := []string{}
+	for len(r.buf) > 0 && r.err == nil {
+		proxyKeys = append(proxyKeys, r.string())
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed group key: %w", r.err)
+	}
+	shares, err := splitSecret(dataKey, len(proxyKeys), threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := append([]byte{}, shareBundleTag...)
+	for i, share := range shares {
+		encodedShare := encodeKeyShare(share)
+		encryptedShare, err := utils.EncryptKey(encodedShare, []byte(proxyKeys[i]))
+		clear(encodedShare)
+		clear(share.value)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = appendString(wrapped, string(encryptedShare))
+	}
+	return wrapped, nil
+}
+
+// unwrapDataKeyShare decrypts the share of a data key wrapped by wrapDataKey for the proxy at shareIndex, it comes
+// back encoded the way it is released
+func unwrapDataKeyShare(fileKey []byte, shareIndex int, proxyPrivateKey []byte) ([]byte, error) {
+	if !bytes.HasPrefix(fileKey, shareBundleTag) {
+		return nil, errors.New("data key of the file is not split for the proxies of the group")
+	}
+	r := &byteReader{buf: fileKey[len(shareBundleTag):]}
+	encryptedShare := ""
+	for i := 1; i <= shareIndex; i++ {
+		encryptedShare = r.string()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed data key shares: %w", r.err)
+	}
+
+	encodedShare, err := utils.DecryptKey([]byte(encryptedShare), proxyPrivateKey)
+	if err != nil {
+		return nil, errors.New("data key of the file is not encrypted with the current group key")
+	}
+	if share, err := decodeKeyShare(encodedShare); err != nil || share.index != shareIndex {
+		return nil, errors.New("data key share of the file is not this proxy's")
+	}
+	return encodedShare, nil
+}
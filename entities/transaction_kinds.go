@@ -0,0 +1,218 @@
+package entities
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+type TransactionKind uint8
+
+const (
+	TX_FILE_UPLOADED TransactionKind = iota
+	TX_GROUP_CREATED
+	TX_MEMBER_ADDED
+	TX_MEMBER_REMOVED
+	TX_KEY_ROTATED
+	TX_FILE_REENCRYPTED
+	TX_FILE_DELETED
+	TX_VALIDATOR_ADDED
+	TX_VALIDATOR_REMOVED
+	TX_POLICY_SET   //the group owner replaced the group's access policy
+	TX_KEY_RELEASED //the proxy released the group key to a user for a file
+	TX_FILE_REKEYED //the file's data key was encrypted again under a new group key, the file itself did not change
+	TX_FILE_UPDATED //new content for a file, under a data key of its own
+)
+
+func (k TransactionKind) String() string {
+	switch k {
+	case TX_FILE_UPLOADED:
+		return "file-uploaded"
+	case TX_GROUP_CREATED:
+		return "group-created"
+	case TX_MEMBER_ADDED:
+		return "member-added"
+	case TX_MEMBER_REMOVED:
+		return "member-removed"
+	case TX_KEY_ROTATED:
+		return "key-rotated"
+	case TX_FILE_REENCRYPTED:
+		return "file-reencrypted"
+	case TX_FILE_DELETED:
+		return "file-deleted"
+	case TX_VALIDATOR_ADDED:
+		return "validator-added"
+	case TX_VALIDATOR_REMOVED:
+		return "validator-removed"
+	case TX_POLICY_SET:
+		return "policy-set"
+	case TX_KEY_RELEASED:
+		return "key-released"
+	case TX_FILE_REKEYED:
+		return "file-rekeyed"
+	case TX_FILE_UPDATED:
+		return "file-updated"
+	}
+	return "unknown"
+}
+
+func (d Data) Kind() TransactionKind {
+	return d.kind
+}
+
+func (d Data) UserId() string {
+	return d.userId
+}
+
+func (d Data) GroupId() string {
+	return d.groupId
+}
+
+func (d Data) MemberId() string {
+	return d.memberId
+}
+
+// FileHash is the raw md5 digest of the encrypted file, not text
+func (d Data) FileHash() string {
+	return d.fileHash
+}
+
+func (d Data) FileExtension() string {
+	return d.fileExtension
+}
+
+// GroupKey is the fingerprint of the group key a group or key rotation record refers to
+func (d Data) GroupKey() string {
+	return d.groupKey
+}
+
+// CreatedAt is when the signer made the record, in unix nanoseconds
+func (d Data) CreatedAt() int64 {
+	return d.createdAt
+}
+
+func (d Data) SignerKey() []byte {
+	return d.signerKey
+}
+
+func (d Data) PreviousId() string {
+	return d.previousId
+}
+
+func (d Data) Tags() []string {
+	return d.tags
+}
+
+func (d Data) Policy() string {
+	return d.policy
+}
+
+// Stale is true for a rekeyed file whose ciphertext a removed member may still have the data key of
+func (d Data) Stale() bool {
+	return d.stale
+}
+
+// FileKey is the data key of the file encrypted with the group public key
+func (d Data) FileKey() []byte {
+	return d.fileKey
+}
+
+// keyFingerprint is what goes on the chain instead of the group key itself
+func keyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// isMembershipRecord is true for the records that make up a group's membership history
+func isMembershipRecord(kind TransactionKind) bool {
+	return kind == TX_GROUP_CREATED || kind == TX_MEMBER_ADDED || kind == TX_MEMBER_REMOVED
+}
+
+// checkMembership makes sure a membership record is signed with the key that created its group, creation is the
+// group's TX_GROUP_CREATED record when there is one (created). A group is only created once.
+func checkMembership(data Data, creation Data, created bool) error {
+	if !isMembershipRecord(data.kind) {
+		return nil
+	}
+	if data.kind == TX_GROUP_CREATED {
+		if created {
+			return errors.New("group has already been created")
+		}
+		return nil
+	}
+	if !created {
+		return errors.New("group has not been created")
+	}
+	if data.userId != creation.userId || !bytes.Equal(data.signerKey, creation.signerKey) {
+		return errors.New("membership records must be signed by the group owner")
+	}
+	return nil
+}
+
+// groupCreation is the TX_GROUP_CREATED record of groupId on the chain or waiting to be sealed, the chain lock must
+// be held
+func (b *Blockchain) groupCreation(groupId string) (Data, bool) {
+	for _, seq := range b.index.byGroup[groupId] {
+		if data := b.transactionAt(seq).Data; data.kind == TX_GROUP_CREATED {
+			return data, true
+		}
+	}
+	pending := b.orphans
+	if b.mempool != nil {
+		pending = append(append([]Transaction{}, pending...), b.mempool.pending...)
+	}
+	for _, tx := range pending {
+		if tx.Data.groupId == groupId && tx.Data.kind == TX_GROUP_CREATED {
+			return tx.Data, true
+		}
+	}
+	return Data{}, false
+}
+
+// MembersAt replays the membership records of a group up to (and including) the blocks sealed at the given time
+// and returns the uuids that had access to the group at that point. Only the records signed by whoever created the
+// group count (see checkMembership).
+func (b *Blockchain) MembersAt(groupId string, at time.Time) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.checkpoint != nil {
+		return nil, errors.New("membership history has been pruned from this ledger")
+	}
+
+	members := []string{}
+	creation := Data{}
+	created := false
+	for _, block := range b.blocks {
+		if block.Header.Timestamp > at.UnixNano() {
+			break
+		}
+		for _, tx := range block.Transactions {
+			if tx.Data.groupId != groupId || checkMembership(tx.Data, creation, created) != nil {
+				continue
+			}
+			switch tx.Data.kind {
+			case TX_GROUP_CREATED:
+				creation = tx.Data
+				created = true
+				members = append(members, tx.Data.memberId)
+			case TX_MEMBER_ADDED:
+				members = append(members, tx.Data.memberId)
+			case TX_MEMBER_REMOVED:
+				for idx, m := range members {
+					if m == tx.Data.memberId {
+						members = append(members[:idx], members[idx+1:]...)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	if !created {
+		return nil, errors.New("group did not exist at that time")
+	}
+	return members, nil
+}
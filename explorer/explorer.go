@@ -0,0 +1,317 @@
+package explorer
+
+import (
+	"blockchain-fileshare/entities"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	DEFAULT_BLOCK_PAGE = 20  //blocks per page when ?limit is not given
+	MAX_BLOCK_PAGE     = 100 //anything larger is capped to this
+)
+
+// Explorer is a read-only HTTP view of a ledger: JSON under /api/ and a plain HTML view everywhere else.
+// It never writes to the ledger, so it is safe to expose to people who are only meant to audit it.
+type Explorer struct {
+	blockchain *entities.Blockchain
+	mux        *http.ServeMux
+
+	mu       sync.Mutex
+	verified verification //VerifyChain of the last tip it was run for, a chain only has to be verified once per tip
+}
+
+type verification struct {
+	tipHash string
+	badIdx  int
+	err     error
+}
+
+// the JSON views use hex for hashes and key fingerprints instead of whole PEM keys, the full records are
+// in a snapshot (ExportJSON) for anyone who wants to re-verify signatures
+type chainStatus struct {
+	Height     int      `json:"height"`
+	TipHash    string   `json:"tipHash"`
+	Checkpoint int      `json:"checkpoint,omitempty"` //height the ledger was pruned up to, 0 for an archival ledger
+	Valid      bool     `json:"valid"`
+	BadBlock   int      `json:"badBlock"` //-1 when the chain verifies
+	Error      string   `json:"error,omitempty"`
+	Validators []string `json:"validators,omitempty"`
+}
+
+type blockView struct {
+	Index            int               `json:"index"`
+	Timestamp        int64             `json:"timestamp"`
+	PrevHash         string            `json:"prevHash"`
+	MerkleRoot       string            `json:"merkleRoot"`
+	Sealer           string            `json:"sealer,omitempty"`
+	Hash             string            `json:"hash"`
+	TransactionCount int               `json:"transactionCount"`
+	Transactions     []transactionView `json:"transactions,omitempty"`
+}
+
+type transactionView struct {
+	Id            string   `json:"id"`
+	Kind          string   `json:"kind"`
+	UserId        string   `json:"userId"`
+	GroupId       string   `json:"groupId,omitempty"`
+	IPFSHash      string   `json:"ipfsHash,omitempty"`
+	FileExtension string   `json:"fileExtension,omitempty"`
+	FileHash      string   `json:"fileHash,omitempty"`
+	MemberId      string   `json:"memberId,omitempty"`
+	GroupKey      string   `json:"groupKey,omitempty"`
+	PreviousId    string   `json:"previousId,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Policy        string   `json:"policy,omitempty"`
+	CreatedAt     int64    `json:"createdAt"`
+	Signer        string   `json:"signer,omitempty"` //sha256 of the signer's public key
+	Pruned        bool     `json:"pruned,omitempty"` //only the ID is left on this node, the rest is on archival nodes
+	BlockIndex    int      `json:"blockIndex"`
+	Timestamp     int64    `json:"timestamp"` //when the block holding it was sealed
+}
+
+type blockPage struct {
+	Blocks []blockView `json:"blocks"`
+	Next   int         `json:"next"` //index to pass as ?before for the next (older) page, -1 at genesis
+}
+
+type historyPage struct {
+	GroupId      string            `json:"groupId"`
+	Transactions []transactionView `json:"transactions"`
+	NextCursor   string            `json:"nextCursor,omitempty"`
+}
+
+type errorView struct {
+	Error string `json:"error"`
+}
+
+func CreateExplorer(blockchain *entities.Blockchain) *Explorer {
+	e := &Explorer{blockchain: blockchain, mux: http.NewServeMux()}
+
+	e.mux.HandleFunc("GET /api/status", e.apiStatus)
+	e.mux.HandleFunc("GET /api/blocks", e.apiBlocks)
+	e.mux.HandleFunc("GET /api/blocks/{index}", e.apiBlock)
+	e.mux.HandleFunc("GET /api/transactions/{id}", e.apiTransaction)
+	e.mux.HandleFunc("GET /api/groups/{groupId}/history", e.apiGroupHistory)
+
+	e.mux.HandleFunc("GET /{$}", e.pageIndex)
+	e.mux.HandleFunc("GET /blocks/{index}", e.pageBlock)
+	e.mux.HandleFunc("GET /transactions/{id}", e.pageTransaction)
+	e.mux.HandleFunc("GET /groups/{groupId}", e.pageGroup)
+	return e
+}
+
+func (e *Explorer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mux.ServeHTTP(w, r)
+}
+
+func (e *Explorer) status() chainStatus {
+	height := e.blockchain.Height()
+	tip, _ := e.blockchain.GetBlock(height)
+	status := chainStatus{Height: height, TipHash: tip.Header.Hash, Valid: true, BadBlock: -1}
+	if verified := e.verify(tip.Header.Hash); verified.err != nil {
+		status.Valid, status.BadBlock, status.Error = false, verified.badIdx, verified.err.Error()
+	}
+	if checkpoint, pruned := e.blockchain.Checkpoint(); pruned {
+		status.Checkpoint = checkpoint.Height
+	}
+	for _, v := range e.blockchain.Validators() {
+		status.Validators = append(status.Validators, v.Id)
+	}
+	return status
+}
+
+// verify is VerifyChain for the chain ending at tipHash, run again only once the tip has moved. A result is only kept
+// when the tip did not move while the chain was being verified, it could belong to either tip otherwise.
+func (e *Explorer) verify(tipHash string) verification {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.verified.tipHash == tipHash && tipHash != "" {
+		return e.verified
+	}
+
+	badIdx, err := e.blockchain.VerifyChain()
+	result := verification{tipHash: tipHash, badIdx: badIdx, err: err}
+	if tip, _ := e.blockchain.GetBlock(e.blockchain.Height()); tip.Header.Hash == tipHash {
+		e.verified = result
+	}
+	return result
+}
+
+// blocks is a page of blocks, newest first, starting below before (the tip when before is past it)
+func (e *Explorer) blocks(before int, limit int) blockPage {
+	if limit <= 0 {
+		limit = DEFAULT_BLOCK_PAGE
+	}
+	if limit > MAX_BLOCK_PAGE {
+		limit = MAX_BLOCK_PAGE
+	}
+	if height := e.blockchain.Height(); before > height {
+		before = height + 1
+	}
+
+	page := blockPage{Blocks: []blockView{}, Next: -1}
+	for index := before - 1; index >= 0 && len(page.Blocks) < limit; index-- {
+		block, err := e.blockchain.GetBlock(index)
+		if err != nil {
+			break
+		}
+		page.Blocks = append(page.Blocks, viewBlock(block, false))
+		page.Next = index
+	}
+	if page.Next == 0 {
+		page.Next = -1
+	}
+	return page
+}
+
+// transaction looks a transaction up by ID together with the block it was sealed in
+func (e *Explorer) transaction(id string) (transactionView, error) {
+	proof, _, err := e.blockchain.GetInclusionProof(id)
+	if err != nil {
+		return transactionView{}, err
+	}
+	block, err := e.blockchain.GetBlock(proof.BlockIndex)
+	if err != nil {
+		return transactionView{}, err
+	}
+	for _, tx := range block.Transactions {
+		if tx.ID == id {
+			return viewTransaction(tx, block.Header), nil
+		}
+	}
+	return transactionView{}, errors.New("could not locate transaction")
+}
+
+func (e *Explorer) groupHistory(groupId string, cursor string) (historyPage, error) {
+	result, err := e.blockchain.Query(entities.LedgerQuery{GroupId: groupId, Cursor: cursor})
+	if err != nil {
+		return historyPage{}, err
+	}
+	page := historyPage{GroupId: groupId, Transactions: []transactionView{}, NextCursor: result.NextCursor}
+	for _, entry := range result.Entries {
+		page.Transactions = append(page.Transactions, viewTransaction(entry.Transaction, entities.BlockHeader{
+			Index:     entry.BlockIndex,
+			Timestamp: entry.Timestamp,
+		}))
+	}
+	return page, nil
+}
+
+func viewBlock(block entities.Block, withTransactions bool) blockView {
+	view := blockView{
+		Index:            block.Header.Index,
+		Timestamp:        block.Header.Timestamp,
+		PrevHash:         block.Header.PrevHash,
+		MerkleRoot:       block.Header.MerkleRoot,
+		Sealer:           block.Header.Sealer,
+		Hash:             block.Header.Hash,
+		TransactionCount: len(block.Transactions),
+	}
+	if withTransactions {
+		view.Transactions = []transactionView{}
+		for _, tx := range block.Transactions {
+			view.Transactions = append(view.Transactions, viewTransaction(tx, block.Header))
+		}
+	}
+	return view
+}
+
+func viewTransaction(tx entities.Transaction, header entities.BlockHeader) transactionView {
+	if tx.Pruned {
+		return transactionView{Id: tx.ID, Kind: "pruned", Pruned: true, BlockIndex: header.Index, Timestamp: header.Timestamp}
+	}
+	d := tx.Data
+	signer := sha256.Sum256(d.SignerKey())
+	return transactionView{
+		Id:            tx.ID,
+		Kind:          d.Kind().String(),
+		UserId:        d.UserId(),
+		GroupId:       d.GroupId(),
+		IPFSHash:      d.IPFSHash,
+		FileExtension: d.FileExtension(),
+		FileHash:      hex.EncodeToString([]byte(d.FileHash())),
+		MemberId:      d.MemberId(),
+		GroupKey:      d.GroupKey(),
+		PreviousId:    d.PreviousId(),
+		Tags:          d.Tags(),
+		Policy:        d.Policy(),
+		CreatedAt:     d.CreatedAt(),
+		Signer:        hex.EncodeToString(signer[:]),
+		BlockIndex:    header.Index,
+		Timestamp:     header.Timestamp,
+	}
+}
+
+func (e *Explorer) apiStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.status())
+}
+
+func (e *Explorer) apiBlocks(w http.ResponseWriter, r *http.Request) {
+	before, limit, err := pageParams(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, e.blocks(before, limit))
+}
+
+func (e *Explorer) apiBlock(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{"block index must be a number"})
+		return
+	}
+	block, err := e.blockchain.GetBlock(index)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, errorView{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, viewBlock(block, true))
+}
+
+func (e *Explorer) apiTransaction(w http.ResponseWriter, r *http.Request) {
+	tx, err := e.transaction(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, errorView{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, tx)
+}
+
+func (e *Explorer) apiGroupHistory(w http.ResponseWriter, r *http.Request) {
+	page, err := e.groupHistory(r.PathValue("groupId"), r.URL.Query().Get("cursor"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// pageParams reads ?before and ?limit, before defaults to past the tip so the first page starts at the newest block
+func pageParams(r *http.Request) (int, int, error) {
+	before, limit := int(^uint(0)>>1), 0
+	var err error
+	if value := r.URL.Query().Get("before"); value != "" {
+		if before, err = strconv.Atoi(value); err != nil || before < 0 {
+			return 0, 0, errors.New("before must be a block index")
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil {
+			return 0, 0, errors.New("limit must be a number")
+		}
+	}
+	return before, limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
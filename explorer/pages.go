@@ -0,0 +1,150 @@
+package explorer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// one template per page, all sharing the layout and the transaction table,
+// html/template escapes everything that comes off the ledger
+var pages = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"time": func(nanos int64) string { return time.Unix(0, nanos).UTC().Format(time.RFC3339) },
+	"prev": func(index int) int { return index - 1 },
+}).Parse(`{{define "layout"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Ledger explorer</title>
+<style>body{font-family:sans-serif;margin:2em}td,th{padding:.2em .8em;text-align:left}code{font-size:.9em}.bad{color:#b00}</style>
+</head>
+<body>
+<p><a href="/">Ledger explorer</a></p>
+{{template "content" .}}
+</body>
+</html>{{end}}
+{{define "transactions"}}<table>
+<tr><th>Block</th><th>Kind</th><th>User</th><th>ID</th></tr>
+{{range .}}<tr><td><a href="/blocks/{{.BlockIndex}}">{{.BlockIndex}}</a></td><td>{{.Kind}}</td><td><code>{{.UserId}}</code></td><td><a href="/transactions/{{.Id}}"><code>{{.Id}}</code></a></td></tr>
+{{else}}<tr><td colspan="4">none</td></tr>
+{{end}}</table>{{end}}`))
+
+var indexPage = template.Must(template.Must(pages.Clone()).Parse(`{{define "content"}}
+<h1>Chain status</h1>
+<p>Height {{.Status.Height}}, tip <code>{{.Status.TipHash}}</code></p>
+{{with .Status.Checkpoint}}<p>Pruned up to block {{.}}, older transactions that no live file needs only have their IDs here.</p>{{end}}
+{{if .Status.Valid}}<p>Chain verifies.</p>{{else}}<p class="bad">Chain fails verification at block {{.Status.BadBlock}}: {{.Status.Error}}</p>{{end}}
+{{with .Status.Validators}}<p>Validators: {{range .}}<code>{{.}}</code> {{end}}</p>{{end}}
+<h2>Blocks</h2>
+<table>
+<tr><th>Index</th><th>Sealed</th><th>Transactions</th><th>Hash</th></tr>
+{{range .Blocks.Blocks}}<tr><td><a href="/blocks/{{.Index}}">{{.Index}}</a></td><td>{{time .Timestamp}}</td><td>{{.TransactionCount}}</td><td><code>{{.Hash}}</code></td></tr>
+{{end}}</table>
+{{if ge .Blocks.Next 0}}<p><a href="/?before={{.Blocks.Next}}">Older blocks</a></p>{{end}}
+{{end}}`))
+
+var blockPageTemplate = template.Must(template.Must(pages.Clone()).Parse(`{{define "content"}}
+<h1>Block {{.Index}}</h1>
+<table>
+<tr><th>Sealed</th><td>{{time .Timestamp}}</td></tr>
+<tr><th>Hash</th><td><code>{{.Hash}}</code></td></tr>
+<tr><th>Previous</th><td>{{if .Index}}<a href="/blocks/{{.Index | prev}}"><code>{{.PrevHash}}</code></a>{{end}}</td></tr>
+<tr><th>Merkle root</th><td><code>{{.MerkleRoot}}</code></td></tr>
+{{with .Sealer}}<tr><th>Sealer</th><td><code>{{.}}</code></td></tr>{{end}}
+</table>
+<h2>Transactions</h2>
+{{template "transactions" .Transactions}}
+{{end}}`))
+
+var transactionPage = template.Must(template.Must(pages.Clone()).Parse(`{{define "content"}}
+<h1>Transaction</h1>
+<table>
+<tr><th>ID</th><td><code>{{.Id}}</code></td></tr>
+<tr><th>Kind</th><td>{{.Kind}}</td></tr>
+<tr><th>Block</th><td><a href="/blocks/{{.BlockIndex}}">{{.BlockIndex}}</a>, sealed {{time .Timestamp}}</td></tr>
+{{if .Pruned}}<tr><td colspan="2">Pruned from this node, only the ID is left.</td></tr>{{else}}
+<tr><th>User</th><td><code>{{.UserId}}</code></td></tr>
+{{with .GroupId}}<tr><th>Group</th><td><a href="/groups/{{.}}"><code>{{.}}</code></a></td></tr>{{end}}
+{{with .MemberId}}<tr><th>Member</th><td><code>{{.}}</code></td></tr>{{end}}
+{{with .IPFSHash}}<tr><th>IPFS hash</th><td><code>{{.}}</code></td></tr>{{end}}
+{{with .FileExtension}}<tr><th>Extension</th><td>{{.}}</td></tr>{{end}}
+{{if .IPFSHash}}<tr><th>File md5</th><td><code>{{.FileHash}}</code></td></tr>{{end}}
+{{with .GroupKey}}<tr><th>Group key</th><td><code>{{.}}</code></td></tr>{{end}}
+{{with .PreviousId}}<tr><th>Replaces</th><td><a href="/transactions/{{.}}"><code>{{.}}</code></a></td></tr>{{end}}
+{{with .Tags}}<tr><th>Tags</th><td>{{range .}}{{.}} {{end}}</td></tr>{{end}}
+{{with .Policy}}<tr><th>Policy</th><td><pre>{{.}}</pre></td></tr>{{end}}
+<tr><th>Created</th><td>{{time .CreatedAt}}</td></tr>
+<tr><th>Signer key</th><td><code>{{.Signer}}</code></td></tr>
+{{end}}
+</table>
+{{end}}`))
+
+var groupPage = template.Must(template.Must(pages.Clone()).Parse(`{{define "content"}}
+<h1>Group <code>{{.GroupId}}</code></h1>
+{{template "transactions" .Transactions}}
+{{with .NextCursor}}<p><a href="?cursor={{.}}">More</a></p>{{end}}
+{{end}}`))
+
+var errorPage = template.Must(template.Must(pages.Clone()).Parse(`{{define "content"}}
+<h1>Nothing to show</h1>
+<p>{{.}}</p>
+{{end}}`))
+
+func (e *Explorer) pageIndex(w http.ResponseWriter, r *http.Request) {
+	before, limit, err := pageParams(r)
+	if err != nil {
+		writePage(w, http.StatusBadRequest, errorPage, err.Error())
+		return
+	}
+	writePage(w, http.StatusOK, indexPage, struct {
+		Status chainStatus
+		Blocks blockPage
+	}{e.status(), e.blocks(before, limit)})
+}
+
+func (e *Explorer) pageBlock(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writePage(w, http.StatusNotFound, errorPage, "block index must be a number")
+		return
+	}
+	block, err := e.blockchain.GetBlock(index)
+	if err != nil {
+		writePage(w, http.StatusNotFound, errorPage, err.Error())
+		return
+	}
+	writePage(w, http.StatusOK, blockPageTemplate, viewBlock(block, true))
+}
+
+func (e *Explorer) pageTransaction(w http.ResponseWriter, r *http.Request) {
+	tx, err := e.transaction(r.PathValue("id"))
+	if err != nil {
+		writePage(w, http.StatusNotFound, errorPage, err.Error())
+		return
+	}
+	writePage(w, http.StatusOK, transactionPage, tx)
+}
+
+func (e *Explorer) pageGroup(w http.ResponseWriter, r *http.Request) {
+	page, err := e.groupHistory(r.PathValue("groupId"), r.URL.Query().Get("cursor"))
+	if err != nil {
+		writePage(w, http.StatusBadRequest, errorPage, err.Error())
+		return
+	}
+	writePage(w, http.StatusOK, groupPage, page)
+}
+
+// writePage renders the whole page before sending anything, a template that fails halfway is a 500 rather than half a
+// page with the status of a whole one
+func writePage(w http.ResponseWriter, status int, page *template.Template, data any) {
+	var body bytes.Buffer
+	if err := page.ExecuteTemplate(&body, "layout", data); err != nil {
+		fmt.Println("could not render page", err)
+		http.Error(w, "could not render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
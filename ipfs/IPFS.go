@@ -4,7 +4,6 @@ import (
 	"blockchain-fileshare/utils"
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"strings"
 
@@ -24,36 +23,41 @@ func InitIPFS() (*shell.Shell, error) {
 	return sh, nil
 }
 
-func UploadFileToIPFS(sh *shell.Shell, filePath string, publicKeyBytes []byte) (string, string, error) {
-	filename, checksum, err := utils.EncryptFile(filePath, publicKeyBytes)
+// UploadFileToIPFS encrypts the file under its own data key and adds it, it returns the IPFS hash, the checksum of the
+// plaintext and the data key as wrapKey encrypted it
+func UploadFileToIPFS(sh *shell.Shell, filePath string, wrapKey func(dataKey []byte) ([]byte, error)) (string, string, []byte, error) {
+	filename, checksum, encryptedDataKey, err := utils.EncryptFileWithDataKey(filePath, wrapKey)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
 	}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", "", err
-	}
-
-	defer f.Close()
 	defer os.Remove(filename)
 
-	b, err := io.ReadAll(f)
+	hash, err := AddFileToIPFS(sh, filename)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
 	}
 
-	hash, err := sh.Add(bytes.NewReader(b))
+	return hash, checksum, encryptedDataKey, nil
+}
+
+// AddFileToIPFS adds the file as it is, for files that are encrypted already
+func AddFileToIPFS(sh *shell.Shell, filePath string) (string, error) {
+	b, err := os.ReadFile(filePath)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
-	return hash, checksum, nil
+	return sh.Add(bytes.NewReader(b))
 }
 
 func DownloadFileFromIPFS(sh *shell.Shell, handle string, fileExtension string) error {
-	err := sh.Get(handle, fmt.Sprintf(`%s%s`, handle, fileExtension))
-	return err
+	return GetFileFromIPFS(sh, handle, fmt.Sprintf(`%s%s`, handle, fileExtension))
+}
+
+// GetFileFromIPFS writes the file with the given handle to filePath instead of the working directory
+func GetFileFromIPFS(sh *shell.Shell, handle string, filePath string) error {
+	return sh.Get(handle, filePath)
 }
 
 func DeleteFileFromIPFS(sh *shell.Shell, handle string) error {
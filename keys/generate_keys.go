@@ -6,7 +6,6 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"os"
 )
 
@@ -18,52 +17,46 @@ func GenerateKeyPair(prefix string) ([]byte, []byte) {
 
 	prefix = fmt.Sprintf(`%s/%s`, PEM_FOLDER, prefix)
 
-	// Generate a new RSA private key with 2048 bits
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		fmt.Println("Error generating RSA private key:", err)
-		os.Exit(1)
-	}
-
-	// Encode the private key to the PEM format
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	}
+	publicKeyBytes, privateKeyBytes := GenerateKeyPairInMemory()
 
 	privateKeyPath := fmt.Sprintf(`%s_private_key.pem`, prefix)
-	privateKeyFile, err := os.Create(privateKeyPath)
-	if err != nil {
+	if err := os.WriteFile(privateKeyPath, privateKeyBytes, 0600); err != nil {
 		fmt.Println("Error creating private key file:", err)
 		os.Exit(1)
 	}
-	pem.Encode(privateKeyFile, privateKeyPEM)
-	privateKeyFile.Seek(0, 0) //seek to the start of file or else ReadAll will result with empty byte slice
-	privateKeyBytes, err := io.ReadAll(privateKeyFile)
-	defer privateKeyFile.Close()
-
-	// Extract the public key from the private key
-	publicKey := &privateKey.PublicKey
 
-	// Encode the public key to the PEM format
-	publicKeyPEM := &pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(publicKey),
+	publicKeyPath := fmt.Sprintf(`%s_public_key.pem`, prefix)
+	if err := os.WriteFile(publicKeyPath, publicKeyBytes, 0644); err != nil {
+		fmt.Println("Error creating public key file:", err)
+		os.Exit(1)
 	}
 
-	publicKeyPath := fmt.Sprintf(`%s_public_key.pem`, prefix)
-	publicKeyFile, err := os.Create(publicKeyPath)
+	fmt.Println("RSA key pair generated successfully!")
+
+	return publicKeyBytes, privateKeyBytes // (public, private)
+}
+
+// GenerateKeyPairInMemory is GenerateKeyPair without the copy in PEM_FOLDER, for keys that must only ever be stored
+// encrypted (the proxy's group keys)
+func GenerateKeyPairInMemory() ([]byte, []byte) {
+	// Generate a new RSA private key with 2048 bits
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		fmt.Println("Error creating public key file:", err)
+		fmt.Println("Error generating RSA private key:", err)
 		os.Exit(1)
 	}
-	pem.Encode(publicKeyFile, publicKeyPEM)
-	publicKeyFile.Seek(0, 0) //seek to the start of file or else ReadAll will result with empty byte slice
-	publicKeyBytes, err := io.ReadAll(publicKeyFile)
 
-	defer publicKeyFile.Close()
+	// Encode the private key to the PEM format
+	privateKeyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
 
-	fmt.Println("RSA key pair generated successfully!")
+	// Encode the public key to the PEM format
+	publicKeyBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey),
+	})
 
 	return publicKeyBytes, privateKeyBytes // (public, private)
 }
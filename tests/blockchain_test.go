@@ -0,0 +1,543 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signedUpload builds an upload record for handle signed by member, like UploadFile would
+func signedUpload(t *testing.T, member entities.GroupMember, handle string) entities.Data {
+	data, err := member.SignTransaction(entities.Data{IPFSHash: handle})
+	assert.Nil(t, err)
+	return data
+}
+
+func TestBlocksAreHashLinked(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+	assert.Equal(t, 0, blockchain.Height())
+
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	assert.Equal(t, 3, blockchain.Height())
+
+	for i, transactionID := range transactionIDs {
+		data, err := blockchain.GetTransactionByHash(transactionID)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"QmA", "QmB", "QmC"}[i], data.IPFSHash)
+	}
+
+	for i := 1; i <= blockchain.Height(); i++ {
+		block, err := blockchain.GetBlock(i)
+		assert.Nil(t, err)
+		previous, err := blockchain.GetBlock(i - 1)
+		assert.Nil(t, err)
+		assert.Equal(t, previous.Header.Hash, block.Header.PrevHash)
+	}
+
+	_, err := blockchain.GetBlock(4)
+	assert.EqualError(t, err, "block does not exist")
+
+	badIdx, err := blockchain.VerifyChain()
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+}
+
+func TestLedgerSurvivesRestart(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	assert.Nil(t, blockchain.Close())
+
+	//simulate a crash halfway through writing the next record
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(segments))
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	assert.Nil(t, err)
+	f.Close()
+
+	blockchain, err = entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, blockchain.Height())
+	for _, transactionID := range transactionIDs {
+		_, err := blockchain.GetTransactionByHash(transactionID)
+		assert.Nil(t, err)
+	}
+
+	transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, "QmC"))
+	assert.Nil(t, err)
+	assert.Nil(t, blockchain.Close())
+
+	blockchain, err = entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	defer blockchain.Close()
+	data, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, "QmC", data.IPFSHash)
+
+	badIdx, err := blockchain.VerifyChain()
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+}
+
+func TestCorruptedRecordBeforeTheTailIsNotTruncated(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		_, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, blockchain.Close())
+
+	//a header claiming a huge record at the tail is a torn write, it is dropped without reading 4 GiB
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Nil(t, err)
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	assert.Nil(t, err)
+	f.Close()
+	blockchain, err = entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, blockchain.Height())
+	assert.Nil(t, blockchain.Close())
+
+	//a bad checksum on the second block with a good third one after it is damage, not a crash
+	raw, err := os.ReadFile(segments[0])
+	assert.Nil(t, err)
+	offset := 8 + int(binary.BigEndian.Uint32(raw[0:4]))
+	raw[offset+4] ^= 0xff
+	assert.Nil(t, os.WriteFile(segments[0], raw, 0644))
+
+	_, err = entities.OpenBlockChain(dir)
+	assert.ErrorContains(t, err, "segment 1 is corrupted")
+	after, err := os.ReadFile(segments[0])
+	assert.Nil(t, err)
+	assert.Equal(t, raw, after)
+}
+
+func TestBlockTimestampsNeverGoBackwards(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+	for _, handle := range []string{"QmA", "QmB"} {
+		_, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	first, err := blockchain.GetBlock(1)
+	assert.Nil(t, err)
+	second, err := blockchain.GetBlock(2)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, second.Header.Timestamp, first.Header.Timestamp)
+
+	snapshot := &bytes.Buffer{}
+	assert.Nil(t, blockchain.ExportJSON(snapshot))
+	backdated := strings.Replace(snapshot.String(),
+		fmt.Sprintf(`"timestamp": %d`, second.Header.Timestamp), fmt.Sprintf(`"timestamp": %d`, first.Header.Timestamp-1), 1)
+	assert.NotEqual(t, snapshot.String(), backdated)
+	_, err = entities.ImportSnapshot(strings.NewReader(backdated), "", entities.SnapshotTrust{TipHash: second.Header.Hash})
+	assert.ErrorContains(t, err, "block 2: timestamp is earlier than block 1")
+}
+
+func TestTamperedLedgerIsRejected(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		_, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, blockchain.Close())
+
+	//rewrite the IPFS handle stored in the second block and fix up the record checksum so only the chain can tell
+	segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Nil(t, err)
+	raw, err := os.ReadFile(segments[0])
+	assert.Nil(t, err)
+	tampered := rewriteRecord(t, raw, 1, "QmB", "QmX")
+	assert.Nil(t, os.WriteFile(segments[0], tampered, 0644))
+
+	_, err = entities.OpenBlockChain(dir)
+	assert.ErrorContains(t, err, "failed verification at block 2")
+}
+
+func TestUnsignedOrForgedTransactionsAreRejected(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	_, err := blockchain.CreateTransaction(entities.Data{IPFSHash: "QmA"})
+	assert.EqualError(t, err, "transaction is not signed")
+
+	proxy := entities.CreateIPFSProxy()
+	blockchain.UseKeyRegistry(proxy)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	groupOwner.AddNewMemberObj(proxy, groupUuid, member)
+
+	forUpload := func(signer interface {
+		SignTransaction(entities.Data) (entities.Data, error)
+	}) entities.Data {
+		data, err := signer.SignTransaction(entities.CreateUploadData(groupUuid, "checksum", "QmA", ".txt"))
+		assert.Nil(t, err)
+		return data
+	}
+
+	_, err = blockchain.CreateTransaction(forUpload(member))
+	assert.Nil(t, err)
+	_, err = blockchain.CreateTransaction(forUpload(groupOwner))
+	assert.Nil(t, err)
+
+	_, err = blockchain.CreateTransaction(forUpload(outsider))
+	assert.EqualError(t, err, "user is not a member of the group")
+}
+
+func TestOnlyTheUploaderOrGroupOwnerReplaceAFile(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	otherMember := entities.CreateAGroupMember()
+
+	proxy := entities.CreateIPFSProxy()
+	blockchain := entities.CreateBlockChain()
+	blockchain.UseKeyRegistry(proxy)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, otherMember))
+
+	type signer interface {
+		SignTransaction(entities.Data) (entities.Data, error)
+	}
+	sign := func(signer signer, data entities.Data) entities.Data {
+		data, err := signer.SignTransaction(data)
+		assert.Nil(t, err)
+		return data
+	}
+
+	uploadID, err := blockchain.CreateTransaction(sign(member, entities.CreateUploadData(groupUuid, "checksum", "QmA", ".txt")))
+	assert.Nil(t, err)
+
+	//another member of the group can't point the file at content of their own
+	_, err = blockchain.CreateTransaction(sign(otherMember, entities.CreateUpdateData(groupUuid, "other", "QmB", ".txt", uploadID)))
+	assert.EqualError(t, err, "previous transaction can only be replaced by whoever recorded it or the group owner")
+	latestID, err := blockchain.ResolveLatestTransaction(uploadID)
+	assert.Nil(t, err)
+	assert.Equal(t, uploadID, latestID)
+
+	//the uploader can, and so can the group owner after them
+	updateID, err := blockchain.CreateTransaction(sign(member, entities.CreateUpdateData(groupUuid, "new", "QmC", ".txt", uploadID)))
+	assert.Nil(t, err)
+	ownerID, err := blockchain.CreateTransaction(sign(groupOwner, entities.CreateUpdateData(groupUuid, "newer", "QmD", ".txt", updateID)))
+	assert.Nil(t, err)
+	latestID, err = blockchain.ResolveLatestTransaction(uploadID)
+	assert.Nil(t, err)
+	assert.Equal(t, ownerID, latestID)
+}
+
+func TestOnlyTheUploaderOrGroupOwnerDeleteAFile(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	otherMember := entities.CreateAGroupMember()
+
+	proxy := entities.CreateIPFSProxy()
+	blockchain := entities.CreateBlockChain()
+	blockchain.UseKeyRegistry(proxy)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, otherMember))
+
+	type signer interface {
+		SignTransaction(entities.Data) (entities.Data, error)
+	}
+	sign := func(signer signer, data entities.Data) entities.Data {
+		data, err := signer.SignTransaction(data)
+		assert.Nil(t, err)
+		return data
+	}
+
+	uploadID, err := blockchain.CreateTransaction(sign(groupOwner, entities.CreateUploadData(groupUuid, "checksum", "QmA", ".txt")))
+	assert.Nil(t, err)
+
+	//a deletion has to say which version it deletes
+	_, err = blockchain.CreateTransaction(sign(groupOwner, entities.CreateDeleteData(groupUuid, "QmA", ".txt", "")))
+	assert.EqualError(t, err, "deletion record must reference the file version it deletes")
+
+	//another member of the group can't delete the owner's file
+	_, err = blockchain.CreateTransaction(sign(otherMember, entities.CreateDeleteData(groupUuid, "QmA", ".txt", uploadID)))
+	assert.EqualError(t, err, "previous transaction can only be replaced by whoever recorded it or the group owner")
+	latestID, err := blockchain.ResolveLatestTransaction(uploadID)
+	assert.Nil(t, err)
+	assert.Equal(t, uploadID, latestID)
+
+	//the group owner can delete a member's file
+	memberUploadID, err := blockchain.CreateTransaction(sign(member, entities.CreateUploadData(groupUuid, "checksum", "QmB", ".txt")))
+	assert.Nil(t, err)
+	_, err = blockchain.CreateTransaction(sign(groupOwner, entities.CreateDeleteData(groupUuid, "QmB", ".txt", memberUploadID)))
+	assert.Nil(t, err)
+	_, err = blockchain.ResolveLatestTransaction(memberUploadID)
+	assert.ErrorIs(t, err, entities.ErrFileDeleted)
+}
+
+func TestRecordsOnDiskAreCheckedAgainstTheKeyRegistry(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, nil, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+
+	data, err := member.SignTransaction(entities.CreateUploadData(groupUuid, "checksum", "QmA", ".txt"))
+	assert.Nil(t, err)
+	_, err = blockchain.CreateTransaction(data)
+	assert.Nil(t, err)
+	//the member's record still counts after they are gone
+	assert.Nil(t, groupOwner.RemoveMemberObj(&operator, groupUuid, member))
+	assert.Nil(t, blockchain.Close())
+
+	reopened, err := entities.OpenBlockChainWithRegistry(dir, proxy)
+	assert.Nil(t, err)
+	badIdx, err := reopened.VerifyChain()
+	assert.Equal(t, -1, badIdx)
+	assert.Nil(t, err)
+	assert.Nil(t, reopened.Close())
+
+	//written by a node that did not check it
+	unchecked, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	forged, err := outsider.SignTransaction(entities.CreateUploadData(groupUuid, "checksum", "QmB", ".txt"))
+	assert.Nil(t, err)
+	_, err = unchecked.CreateTransaction(forged)
+	assert.Nil(t, err)
+	height := unchecked.Height()
+	assert.Nil(t, unchecked.Close())
+
+	_, err = entities.OpenBlockChainWithRegistry(dir, proxy)
+	assert.ErrorContains(t, err, fmt.Sprintf("failed verification at block %d", height))
+	assert.ErrorContains(t, err, "transaction is not signed with a key registered for this user")
+}
+
+func TestGroupLifecycleIsRecorded(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, nil, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	beforeJoin := time.Now()
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	whileMember := time.Now()
+	assert.Nil(t, groupOwner.RemoveMemberObj(&operator, groupUuid, member))
+	afterLeave := time.Now()
+
+	kinds := []entities.TransactionKind{}
+	for i := 1; i <= blockchain.Height(); i++ {
+		block, err := blockchain.GetBlock(i)
+		assert.Nil(t, err)
+		for _, tx := range block.Transactions {
+			assert.Equal(t, groupOwner.GetUuid(), tx.Data.UserId())
+			kinds = append(kinds, tx.Data.Kind())
+		}
+	}
+	assert.Equal(t, []entities.TransactionKind{entities.TX_GROUP_CREATED, entities.TX_MEMBER_ADDED, entities.TX_MEMBER_REMOVED}, kinds)
+
+	members, err := blockchain.MembersAt(groupUuid, beforeJoin)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{groupOwner.GetUuid()}, members)
+
+	members, err = blockchain.MembersAt(groupUuid, whileMember)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{groupOwner.GetUuid(), member.GetUuid()}, members)
+
+	members, err = blockchain.MembersAt(groupUuid, afterLeave)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{groupOwner.GetUuid()}, members)
+
+	_, err = blockchain.MembersAt(groupUuid, time.Unix(0, 0))
+	assert.EqualError(t, err, "group did not exist at that time")
+}
+
+func TestOnlyTheGroupOwnerRecordsMembership(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	proxy := entities.CreateIPFSProxy()
+	entities.CreateOperator(proxy, nil, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+
+	forge := func(kind entities.TransactionKind, memberId string) error {
+		data, err := member.SignTransaction(entities.CreateMembershipData(kind, groupUuid, memberId))
+		assert.Nil(t, err)
+		_, err = blockchain.CreateTransaction(data)
+		return err
+	}
+
+	//a member can't let someone in or throw the owner out
+	assert.EqualError(t, forge(entities.TX_MEMBER_ADDED, outsider.GetUuid()), "membership records must be signed by the group owner")
+	assert.EqualError(t, forge(entities.TX_MEMBER_REMOVED, groupOwner.GetUuid()), "membership records must be signed by the group owner")
+	//nor take the group over by creating it again
+	assert.EqualError(t, forge(entities.TX_GROUP_CREATED, member.GetUuid()), "group has already been created")
+
+	members, err := blockchain.MembersAt(groupUuid, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{groupOwner.GetUuid(), member.GetUuid()}, members)
+	badIdx, err := blockchain.VerifyChain()
+	assert.Equal(t, -1, badIdx)
+	assert.Nil(t, err)
+}
+
+func TestInclusionProofs(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+
+	transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	otherID, err := blockchain.CreateTransaction(signedUpload(t, member, "QmB"))
+	assert.Nil(t, err)
+
+	proof, header, err := blockchain.GetInclusionProof(transactionID)
+	assert.Nil(t, err)
+	assert.Nil(t, entities.VerifyInclusionProof(proof, header))
+
+	//the proof only holds against its own block header
+	_, otherHeader, err := blockchain.GetInclusionProof(otherID)
+	assert.Nil(t, err)
+	assert.EqualError(t, entities.VerifyInclusionProof(proof, otherHeader), "proof is for a different block")
+
+	forged := proof
+	forged.TransactionID = otherID
+	assert.EqualError(t, entities.VerifyInclusionProof(forged, header), "transaction is not included in this block")
+
+	tamperedHeader := header
+	tamperedHeader.MerkleRoot = otherHeader.MerkleRoot
+	assert.EqualError(t, entities.VerifyInclusionProof(forged, tamperedHeader), "block header does not match its hash")
+
+	_, _, err = blockchain.GetInclusionProof("abc")
+	assert.EqualError(t, err, "could not locate transaction")
+}
+
+func TestInclusionProofsBindTheShapeOfTheTree(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockTransactions: 5}))
+	t.Cleanup(func() { blockchain.Close() })
+
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB", "QmC", "QmD", "QmE"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	for _, transactionID := range transactionIDs {
+		assert.Nil(t, blockchain.WaitForConfirmation(transactionID, 2*time.Second))
+	}
+
+	for position, transactionID := range transactionIDs {
+		proof, header, err := blockchain.GetInclusionProof(transactionID)
+		assert.Nil(t, err)
+		assert.Equal(t, position, proof.Position)
+		assert.Equal(t, 5, proof.LeafCount)
+		assert.Nil(t, entities.VerifyInclusionProof(proof, header))
+	}
+
+	//the inner node over the first two transactions, passed off as a transaction of a smaller tree
+	proof, header, err := blockchain.GetInclusionProof(transactionIDs[0])
+	assert.Nil(t, err)
+	leaf := func(id string) []byte {
+		raw, err := hex.DecodeString(id)
+		assert.Nil(t, err)
+		sum := sha256.Sum256(append([]byte{0x00}, raw...))
+		return sum[:]
+	}
+	inner := sha256.Sum256(append(append([]byte{0x01}, leaf(transactionIDs[0])...), leaf(transactionIDs[1])...))
+	forged := entities.MerkleProof{
+		TransactionID: hex.EncodeToString(inner[:]),
+		BlockIndex:    proof.BlockIndex,
+		Position:      0,
+		LeafCount:     3,
+		Steps:         proof.Steps[1:],
+	}
+	assert.EqualError(t, entities.VerifyInclusionProof(forged, header), "transaction is not included in this block")
+
+	//the last transaction is carried up twice, its proof has a single step that only fits position 4 of 5
+	proof, header, err = blockchain.GetInclusionProof(transactionIDs[4])
+	assert.Nil(t, err)
+	assert.Len(t, proof.Steps, 1)
+	moved := proof
+	moved.Position, moved.LeafCount = 1, 2
+	assert.EqualError(t, entities.VerifyInclusionProof(moved, header), "transaction is not included in this block")
+	moved.Position, moved.LeafCount = 3, 5
+	assert.EqualError(t, entities.VerifyInclusionProof(moved, header), "proof does not match the position of the transaction")
+	moved.Position = 5
+	assert.EqualError(t, entities.VerifyInclusionProof(moved, header), "proof position is out of range")
+}
+
+// rewriteRecord replaces old with replacement inside the n-th (0 based) segment record and recomputes its crc32
+func rewriteRecord(t *testing.T, raw []byte, n int, old string, replacement string) []byte {
+	offset := 0
+	for i := 0; i < n; i++ {
+		offset += 8 + int(binary.BigEndian.Uint32(raw[offset:offset+4]))
+	}
+	length := int(binary.BigEndian.Uint32(raw[offset : offset+4]))
+	payload := raw[offset+8 : offset+8+length]
+
+	idx := bytes.Index(payload, []byte(old))
+	assert.NotEqual(t, -1, idx)
+	copy(payload[idx:], replacement)
+	binary.BigEndian.PutUint32(raw[offset+4:offset+8], crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	return raw
+}
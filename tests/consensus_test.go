@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type validatorKeys struct {
+	validator  entities.Validator
+	privateKey []byte
+}
+
+func createValidator(id string) validatorKeys {
+	public, private := keys.GenerateKeyPair(id)
+	return validatorKeys{validator: entities.Validator{Id: id, PublicKey: public}, privateKey: private}
+}
+
+func startAuthorityNode(t *testing.T, validators []entities.Validator, sealer validatorKeys) *entities.LedgerNode {
+	blockchain := entities.CreateBlockChain()
+	assert.Nil(t, blockchain.EnableProofOfAuthority(validators, sealer.validator.Id, sealer.privateKey))
+
+	node, err := entities.StartLedgerNode(blockchain, "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func TestProofOfAuthoritySealing(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	v1, v2, v3 := createValidator("validator-1"), createValidator("validator-2"), createValidator("validator-3")
+	validators := []entities.Validator{v1.validator, v2.validator}
+
+	a := startAuthorityNode(t, validators, v1)
+	b := startAuthorityNode(t, validators, v2)
+	follower := startAuthorityNode(t, validators, validatorKeys{})
+	assert.Nil(t, a.Connect(b.Addr()))
+	assert.Nil(t, b.Connect(follower.Addr()))
+
+	//block 1 belongs to validator-2, block 2 to validator-1 and so on
+	_, err := b.Chain().CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, follower)
+	_, err = a.Chain().CreateTransaction(signedUpload(t, member, "QmB"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, follower)
+
+	block, err := follower.Chain().GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-2", block.Header.Sealer)
+	block, err = follower.Chain().GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-1", block.Header.Sealer)
+
+	//a follower never seals
+	_, err = follower.Chain().CreateTransaction(signedUpload(t, member, "QmF"))
+	assert.EqualError(t, err, "it is not this validator's turn to seal a block")
+
+	//someone who is not a validator can only convince themselves
+	rogue := startAuthorityNode(t, []entities.Validator{v3.validator}, v3)
+	for _, handle := range []string{"QmR1", "QmR2", "QmR3", "QmR4"} {
+		_, err := rogue.Chain().CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, rogue.Connect(follower.Addr()))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, follower.Chain().Height())
+	assert.Equal(t, 2, a.Chain().Height())
+
+	//validator set changes are transactions too, and only validators may make them
+	forged, err := entities.CreateValidatorChange(entities.TX_VALIDATOR_ADDED, v3.validator, v3.validator, v3.privateKey)
+	assert.Nil(t, err)
+	_, err = b.Chain().CreateTransaction(forged)
+	assert.EqualError(t, err, "validator set changes must be signed by a current validator")
+
+	change, err := entities.CreateValidatorChange(entities.TX_VALIDATOR_ADDED, v3.validator, v1.validator, v1.privateKey)
+	assert.Nil(t, err)
+	_, err = b.Chain().CreateTransaction(change)
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, follower)
+	assert.Equal(t, []entities.Validator{v1.validator, v2.validator, v3.validator}, follower.Chain().Validators())
+
+	//validator-3 joins with a fresh chain, catches up and seals block 5 (5 mod 3 = 2)
+	c := startAuthorityNode(t, validators, v3)
+	assert.Nil(t, c.Connect(a.Addr()))
+	waitForConvergence(t, a, b, c, follower)
+	_, err = b.Chain().CreateTransaction(signedUpload(t, member, "QmC"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, c, follower)
+	_, err = c.Chain().CreateTransaction(signedUpload(t, member, "QmD"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, c, follower)
+
+	block, err = follower.Chain().GetBlock(5)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-3", block.Header.Sealer)
+	badIdx, err := follower.Chain().VerifyChain()
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+}
+
+func TestOutOfTurnSealing(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	v1, v2 := createValidator("validator-1"), createValidator("validator-2")
+	validators := []entities.Validator{v1.validator, v2.validator}
+
+	//block 1 is validator-2's, validator-1 may take it since genesis is long past the out of turn delay
+	a := startAuthorityNode(t, validators, v1)
+	b := startAuthorityNode(t, validators, v2)
+	outOfTurn, err := a.Chain().CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	_, err = b.Chain().CreateTransaction(signedUpload(t, member, "QmB"))
+	assert.Nil(t, err)
+
+	//at the same height the block sealed in turn wins, the other one's transaction goes into validator-1's block 2
+	assert.Nil(t, a.Connect(b.Addr()))
+	assert.Nil(t, a.Chain().WaitForConfirmation(outOfTurn, 5*time.Second))
+	waitForConvergence(t, a, b)
+	assert.Equal(t, 2, b.Chain().Height())
+	block, err := b.Chain().GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-2", block.Header.Sealer)
+	block, err = b.Chain().GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-1", block.Header.Sealer)
+	assert.Equal(t, outOfTurn, block.Transactions[0].ID)
+
+	//block 3 is validator-2's again, with validator-2 gone validator-1 has to wait for the delay before sealing it
+	assert.Nil(t, b.Close())
+	started := time.Now()
+	data := signedUpload(t, member, "QmC")
+	pending, err := a.Chain().CreateTransaction(data)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_STATUS_PENDING, a.Chain().TransactionStatus(pending))
+	_, err = a.Chain().CreateTransaction(data)
+	assert.ErrorIs(t, err, entities.ErrAlreadyPending)
+	assert.Nil(t, a.Chain().WaitForConfirmation(pending, 5*time.Second))
+	assert.GreaterOrEqual(t, time.Since(started), entities.OUT_OF_TURN_SEAL_DELAY/2)
+
+	block, err = a.Chain().GetBlock(3)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-1", block.Header.Sealer)
+	badIdx, err := a.Chain().VerifyChain()
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+}
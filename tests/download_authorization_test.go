@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadsAreAuthorizedAgainstTheLedger(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupA := groupOwner.RegisterNewGroup(proxy)
+	groupB := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupA, member))
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupB, member))
+
+	fileID, handle, err := groupOwner.UploadFile(&operator, groupA, TEST_FILEPATH)
+	assert.Nil(t, err)
+
+	record, err := proxy.AuthorizeDownload(member.GetUuid(), groupA, fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, handle, record.IPFSHash)
+
+	_, err = proxy.AuthorizeDownload(outsider.GetUuid(), groupA, fileID)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+	denial := &entities.DownloadDeniedError{}
+	assert.True(t, errors.As(err, &denial))
+	assert.Equal(t, outsider.GetUuid(), denial.UserId)
+	assert.Equal(t, groupA, denial.GroupId)
+	assert.Equal(t, fileID, denial.TransactionId)
+
+	_, err = proxy.AuthorizeDownload(member.GetUuid(), groupA, "not-a-transaction")
+	assert.ErrorIs(t, err, entities.ErrUnknownTransaction)
+
+	memberAdded, err := blockchain.Query(entities.LedgerQuery{GroupId: groupA, Kinds: []entities.TransactionKind{entities.TX_MEMBER_ADDED}})
+	assert.Nil(t, err)
+	_, err = proxy.AuthorizeDownload(member.GetUuid(), groupA, memberAdded.Entries[0].Transaction.ID)
+	assert.ErrorIs(t, err, entities.ErrNotAFile)
+
+	//being a member of some group is not enough, the record has to belong to the group the download is made in
+	_, err = proxy.AuthorizeDownload(member.GetUuid(), groupB, fileID)
+	assert.ErrorIs(t, err, entities.ErrWrongGroup)
+	_, _, err = member.DownloadFile(&operator, groupB, fileID)
+	assert.ErrorIs(t, err, entities.ErrWrongGroup)
+
+	_, err = proxy.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupA)
+	assert.Nil(t, err)
+	latest, err := blockchain.ResolveLatestTransaction(fileID)
+	assert.Nil(t, err)
+	_, err = proxy.AuthorizeDownload(member.GetUuid(), groupA, fileID)
+	assert.ErrorIs(t, err, entities.ErrSuperseded)
+	assert.EqualError(t, err, "file has been replaced by transaction "+latest)
+
+	//clients resolve their bookmarks before asking, so the old ID still gets them the file
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupA, fileID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupA, "deny tag secret"))
+	secretID, _, err := groupOwner.UploadFile(&operator, groupA, TEST_FILEPATH, "secret")
+	assert.Nil(t, err)
+	_, _, err = member.DownloadFile(&operator, groupA, secretID)
+	assert.ErrorIs(t, err, entities.ErrPolicyDenied)
+	assert.EqualError(t, err, "download denied by policy line 1")
+
+	assert.Nil(t, groupOwner.RemoveMemberObj(&operator, groupA, member))
+	_, _, err = member.DownloadFile(&operator, groupA, latest)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+}
+
+func TestDeletedFilesCanNotBeDownloaded(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	otherMember := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, otherMember))
+
+	ownerFileID, _, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	memberFileID, _, err := member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+
+	//members only delete what they uploaded, the owner deletes anything in the group
+	err = otherMember.DeleteFile(&operator, &groupOwner, groupUuid, memberFileID)
+	assert.EqualError(t, err, "previous transaction can only be replaced by whoever recorded it or the group owner")
+	err = member.DeleteFile(&operator, &groupOwner, groupUuid, ownerFileID)
+	assert.EqualError(t, err, "previous transaction can only be replaced by whoever recorded it or the group owner")
+	files, err := groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	assert.Nil(t, member.DeleteFile(&operator, &groupOwner, groupUuid, memberFileID))
+	_, _, err = otherMember.DownloadFile(&operator, groupUuid, memberFileID)
+	assert.ErrorIs(t, err, entities.ErrFileDeleted)
+
+	//a file that has been replaced is deleted through any of its versions
+	_, err = proxy.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.Nil(t, err)
+	assert.Nil(t, groupOwner.DeleteFile(&operator, groupUuid, ownerFileID))
+	_, _, err = member.DownloadFile(&operator, groupUuid, ownerFileID)
+	assert.ErrorIs(t, err, entities.ErrFileDeleted)
+	_, _, err = groupOwner.DownloadFile(&operator, groupUuid, ownerFileID)
+	assert.ErrorIs(t, err, entities.ErrFileDeleted)
+	assert.ErrorIs(t, groupOwner.DeleteFile(&operator, groupUuid, ownerFileID), entities.ErrFileDeleted)
+
+	files, err = groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+}
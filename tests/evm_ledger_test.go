@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/stretchr/testify/assert"
+)
+
+// startSimulatedChain runs go-ethereum's simulated backend with a funded account, mining a block every few milliseconds
+func startSimulatedChain(t *testing.T) (*simulated.Backend, *entities.EVMLedger) {
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	funds := new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18))
+	backend := simulated.NewBackend(types.GenesisAlloc{crypto.PubkeyToAddress(key.PublicKey): {Balance: funds}})
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				backend.Commit()
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+		backend.Close()
+	})
+
+	ledger, err := entities.DeployEVMLedger(backend.Client(), key)
+	assert.Nil(t, err)
+	return backend, ledger
+}
+
+func TestEVMLedger(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	backend, ledger := startSimulatedChain(t)
+
+	var _ entities.Ledger = ledger
+	var _ entities.Ledger = entities.CreateBlockChain()
+
+	upload := signedUpload(t, member, "QmA")
+	transactionID, err := ledger.CreateTransaction(upload)
+	assert.Nil(t, err)
+	assert.Nil(t, ledger.WaitForConfirmation(transactionID, 5*time.Second))
+
+	data, err := ledger.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, "QmA", data.IPFSHash)
+	assert.Equal(t, member.GetUuid(), data.UserId())
+
+	latestID, err := ledger.ResolveLatestTransaction(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, transactionID, latestID)
+
+	//the built-in ledger hands out the same ID for the same record
+	builtIn, err := entities.CreateBlockChain().CreateTransaction(upload)
+	assert.Nil(t, err)
+	assert.Equal(t, builtIn, transactionID)
+
+	_, err = ledger.CreateTransaction(upload)
+	assert.EqualError(t, err, "transaction is already on the ledger")
+	_, err = ledger.CreateTransaction(entities.Data{IPFSHash: "QmB"})
+	assert.EqualError(t, err, "transaction is not signed")
+	_, err = ledger.GetTransactionByHash("")
+	assert.EqualError(t, err, "transaction ID should not be an empty string")
+	_, err = ledger.GetTransactionByHash("abc")
+	assert.EqualError(t, err, "could not locate transaction")
+	_, err = ledger.GetTransactionByHash(builtIn[:len(builtIn)-2] + "00")
+	assert.EqualError(t, err, "could not locate transaction")
+	assert.EqualError(t, ledger.WaitForConfirmation(builtIn[:len(builtIn)-2]+"00", time.Second), "transaction is not pending or on the ledger")
+
+	//a second machine attaches to the deployed contract and sees the same records
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	other, err := entities.OpenEVMLedger(backend.Client(), key, ledger.Address(), 0)
+	assert.Nil(t, err)
+	data, err = other.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, "QmA", data.IPFSHash)
+}
+
+func TestEVMLedgerContractCode(t *testing.T) {
+	backend, ledger := startSimulatedChain(t)
+	bin, err := hex.DecodeString(entities.FILE_SHARE_LEDGER_BIN)
+	assert.Nil(t, err)
+
+	//the constructor leaves exactly the runtime part of the creation code behind
+	code, err := backend.Client().CodeAt(context.Background(), ledger.Address(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, bin[entities.FILE_SHARE_LEDGER_RUNTIME_OFFSET:], code)
+
+	//and that code dispatches on every function of the ABI and emits its event
+	contractAbi, err := abi.JSON(strings.NewReader(entities.FILE_SHARE_LEDGER_ABI))
+	assert.Nil(t, err)
+	for name, method := range contractAbi.Methods {
+		assert.True(t, bytes.Contains(code, append([]byte{0x63}, method.ID...)), name)
+	}
+	event := contractAbi.Events["TransactionRecorded"].ID
+	assert.True(t, bytes.Contains(code, append([]byte{0x7f}, event.Bytes()...)))
+}
+
+func TestEVMRecordsAreCheckedOnTheWayOut(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	otherMember := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	proxy := entities.CreateIPFSProxy()
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, otherMember))
+
+	upload := func(signer interface {
+		SignTransaction(entities.Data) (entities.Data, error)
+	}, handle string) entities.Data {
+		data, err := signer.SignTransaction(entities.CreateUploadData(groupUuid, "checksum", handle, ".txt"))
+		assert.Nil(t, err)
+		return data
+	}
+
+	//the contract takes records from anyone, here from a machine that does not check signers against the proxy
+	backend, unchecked := startSimulatedChain(t)
+	forged, err := unchecked.CreateTransaction(upload(outsider, "QmB"))
+	assert.Nil(t, err)
+	assert.Nil(t, unchecked.WaitForConfirmation(forged, 5*time.Second))
+	_, err = unchecked.GetTransactionByHash(forged)
+	assert.Nil(t, err)
+
+	key, err := crypto.GenerateKey()
+	assert.Nil(t, err)
+	ledger, err := entities.OpenEVMLedger(backend.Client(), key, unchecked.Address(), 0)
+	assert.Nil(t, err)
+	ledger.UseKeyRegistry(proxy)
+	_, err = ledger.GetTransactionByHash(forged)
+	assert.EqualError(t, err, "could not locate transaction")
+	page, err := ledger.Query(entities.LedgerQuery{})
+	assert.Nil(t, err)
+	assert.Empty(t, page.Entries)
+
+	//records made after the first read are picked up by the next one
+	transactionID, err := unchecked.CreateTransaction(upload(member, "QmA"))
+	assert.Nil(t, err)
+	assert.Nil(t, unchecked.WaitForConfirmation(transactionID, 5*time.Second))
+	page, err = ledger.Query(entities.LedgerQuery{})
+	assert.Nil(t, err)
+	assert.Len(t, page.Entries, 1)
+	assert.Equal(t, transactionID, page.Entries[0].Transaction.ID)
+
+	//a record replacing someone else's file is left out as well, the file still resolves to its upload
+	update, err := otherMember.SignTransaction(entities.CreateUpdateData(groupUuid, "other", "QmC", ".txt", transactionID))
+	assert.Nil(t, err)
+	hijack, err := unchecked.CreateTransaction(update)
+	assert.Nil(t, err)
+	assert.Nil(t, unchecked.WaitForConfirmation(hijack, 5*time.Second))
+	_, err = ledger.GetTransactionByHash(hijack)
+	assert.EqualError(t, err, "could not locate transaction")
+	latestID, err := ledger.ResolveLatestTransaction(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, transactionID, latestID)
+
+	//and so is a deletion of someone else's file, the file is not deleted by it
+	deletion, err := otherMember.SignTransaction(entities.CreateDeleteData(groupUuid, "QmA", ".txt", transactionID))
+	assert.Nil(t, err)
+	deleted, err := unchecked.CreateTransaction(deletion)
+	assert.Nil(t, err)
+	assert.Nil(t, unchecked.WaitForConfirmation(deleted, 5*time.Second))
+	_, err = ledger.GetTransactionByHash(deleted)
+	assert.EqualError(t, err, "could not locate transaction")
+	latestID, err = ledger.ResolveLatestTransaction(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, transactionID, latestID)
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/explorer"
+	"blockchain-fileshare/keys"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplorer(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	alice := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB<script>", "QmC"} {
+		data, err := alice.SignTransaction(entities.CreateUploadData("group-a", "checksum", handle, ".txt"))
+		assert.Nil(t, err)
+		transactionID, err := blockchain.CreateTransaction(data)
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	data, err := alice.SignTransaction(entities.CreateUploadData("group-b", "checksum", "QmD", ".txt"))
+	assert.Nil(t, err)
+	_, err = blockchain.CreateTransaction(data)
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(explorer.CreateExplorer(blockchain))
+	defer server.Close()
+
+	get := func(path string, wantStatus int, into any) string {
+		response, err := http.Get(server.URL + path)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, wantStatus, response.StatusCode, path)
+		body, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		if into != nil {
+			assert.Nil(t, json.Unmarshal(body, into), path)
+		}
+		return string(body)
+	}
+
+	status := map[string]any{}
+	get("/api/status", http.StatusOK, &status)
+	assert.Equal(t, float64(4), status["height"])
+	assert.Equal(t, true, status["valid"])
+	assert.Equal(t, float64(-1), status["badBlock"])
+
+	blocks := struct {
+		Blocks []struct {
+			Index            int `json:"index"`
+			TransactionCount int `json:"transactionCount"`
+		} `json:"blocks"`
+		Next int `json:"next"`
+	}{}
+	get("/api/blocks?limit=3", http.StatusOK, &blocks)
+	assert.Equal(t, 3, len(blocks.Blocks))
+	assert.Equal(t, 4, blocks.Blocks[0].Index)
+	assert.Equal(t, 2, blocks.Next)
+	get("/api/blocks?limit=3&before=2", http.StatusOK, &blocks)
+	assert.Equal(t, 2, len(blocks.Blocks))
+	assert.Equal(t, 0, blocks.Blocks[1].Index)
+	assert.Equal(t, -1, blocks.Next)
+	get("/api/blocks?before=abc", http.StatusBadRequest, nil)
+
+	block := struct {
+		Index        int `json:"index"`
+		Transactions []struct {
+			Id string `json:"id"`
+		} `json:"transactions"`
+	}{}
+	get("/api/blocks/1", http.StatusOK, &block)
+	assert.Equal(t, transactionIDs[0], block.Transactions[0].Id)
+	get("/api/blocks/99", http.StatusNotFound, nil)
+
+	tx := map[string]any{}
+	get("/api/transactions/"+transactionIDs[1], http.StatusOK, &tx)
+	assert.Equal(t, "file-uploaded", tx["kind"])
+	assert.Equal(t, alice.GetUuid(), tx["userId"])
+	assert.Equal(t, float64(2), tx["blockIndex"])
+	get("/api/transactions/nope", http.StatusNotFound, nil)
+
+	history := struct {
+		Transactions []struct {
+			Id string `json:"id"`
+		} `json:"transactions"`
+	}{}
+	get("/api/groups/group-a/history", http.StatusOK, &history)
+	assert.Equal(t, 3, len(history.Transactions))
+	assert.Equal(t, transactionIDs[2], history.Transactions[2].Id)
+	get("/api/groups/group-a/history?cursor=x", http.StatusBadRequest, nil)
+
+	page := get("/", http.StatusOK, nil)
+	assert.Contains(t, page, "Chain verifies.")
+	page = get("/transactions/"+transactionIDs[1], http.StatusOK, nil)
+	assert.Contains(t, page, "QmB&lt;script&gt;")
+	assert.False(t, strings.Contains(page, "QmB<script>"))
+	page = get("/groups/group-a", http.StatusOK, nil)
+	assert.Contains(t, page, transactionIDs[0])
+	get("/blocks/99", http.StatusNotFound, nil)
+
+	//the chain is verified once per tip, a new block moves the status along with it
+	data, err = alice.SignTransaction(entities.CreateUploadData("group-b", "checksum", "QmE", ".txt"))
+	assert.Nil(t, err)
+	_, err = blockchain.CreateTransaction(data)
+	assert.Nil(t, err)
+	get("/api/status", http.StatusOK, &status)
+	assert.Equal(t, float64(5), status["height"])
+	assert.Equal(t, true, status["valid"])
+	tip, err := blockchain.GetBlock(5)
+	assert.Nil(t, err)
+	assert.Equal(t, tip.Header.Hash, status["tipHash"])
+
+	//the explorer only reads
+	response, err := http.Post(server.URL+"/api/status", "application/json", strings.NewReader("{}"))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
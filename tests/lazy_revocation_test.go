@@ -0,0 +1,228 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyRevocation(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+
+	//keep whatever the proxy hands out, that is what a removed member may have kept
+	released := [][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		proxyServer.ServeHTTP(recorder, r)
+		if strings.HasSuffix(r.URL.Path, "/keys") && recorder.Code == http.StatusOK {
+			message := struct {
+				EncryptedKey []byte `json:"encryptedKey"`
+			}{}
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &message))
+			released = append(released, message.EncryptedKey)
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer server.Close()
+
+	//the sweeper runs in its own goroutine, the proxy is on the other side of a ProxyClient
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	assert.EqualError(t, groupOwner.SetRevocationMode(groupUuid, 7), "unknown revocation mode")
+	assert.EqualError(t, groupOwner.SetRevocationMode("123", entities.REVOCATION_LAZY), "group not found")
+	assert.Nil(t, groupOwner.SetRevocationMode(groupUuid, entities.REVOCATION_LAZY))
+
+	firstID, firstHandle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	secondID, secondHandle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(firstHandle)
+	defer os.Remove(secondHandle)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, firstID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	memberPrivateKey, err := os.ReadFile(filepath.Join(keys.PEM_FOLDER, member.GetUuid()+"_private_key.pem"))
+	assert.Nil(t, err)
+	keptDataKey, err := utils.DecryptKey(released[len(released)-1], memberPrivateKey)
+	assert.Nil(t, err)
+
+	//removal only rotates the key and rewraps the data keys, the files are left for later
+	assert.Nil(t, groupOwner.RemoveMemberObjAndSecureFiles(&operator, groupUuid, member))
+	_, _, err = member.DownloadFile(&operator, groupUuid, firstID)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+	files, err := groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+	for _, file := range files {
+		assert.True(t, file.Stale)
+		rekeyed, err := blockchain.GetTransactionByHash(file.TransactionID)
+		assert.Nil(t, err)
+		assert.Equal(t, entities.TX_FILE_REKEYED, rekeyed.Kind())
+		assert.True(t, rekeyed.Stale())
+	}
+	//which is why they are stale: the ciphertext a removed member has the data key of is still there
+	assert.Nil(t, ipfs.DownloadFileFromIPFS(sh, firstHandle, ""))
+	decryptedFilePath, _, err = utils.DecryptFileWithDataKey(firstHandle, keptDataKey)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	//writing the file re-encrypts it
+	newContent := []byte("the new version of the file")
+	newFilePath := filepath.Join(t.TempDir(), "notes")
+	assert.Nil(t, os.WriteFile(newFilePath, newContent, 0644))
+	_, _, err = groupOwner.UpdateFile(&operator, groupUuid, "abc", newFilePath)
+	assert.EqualError(t, err, "could not locate transaction")
+	updatedID, updatedHandle, err := groupOwner.UpdateFile(&operator, groupUuid, firstID, newFilePath)
+	assert.Nil(t, err)
+	defer os.Remove(updatedHandle)
+	assert.NotEqual(t, firstHandle, updatedHandle)
+	updated, err := blockchain.GetTransactionByHash(updatedID)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_FILE_UPDATED, updated.Kind())
+	assert.Equal(t, "file-updated", updated.Kind().String())
+	latest, err := blockchain.ResolveLatestTransaction(firstID)
+	assert.Nil(t, err)
+	assert.Equal(t, updatedID, latest)
+
+	decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, firstID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, newContent, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+	assert.Nil(t, ipfs.DownloadFileFromIPFS(sh, updatedHandle, ""))
+	_, _, err = utils.DecryptFileWithDataKey(updatedHandle, keptDataKey)
+	assert.EqualError(t, err, "Decrypt File | wrong data key or the file has been tampered with")
+
+	files, err = groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.False(t, files[0].Stale)
+	assert.True(t, files[1].Stale)
+
+	//the sweeper gets to the rest
+	sweeper, err := groupOwner.StartStaleFileSweep(&operator, groupUuid, 10*time.Millisecond, 1)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		files, err := groupOwner.ListFiles(groupUuid)
+		return err == nil && !files[1].Stale
+	}, 10*time.Second, 10*time.Millisecond)
+	sweeper.Stop()
+
+	files, err = groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	reencrypted, err := blockchain.GetTransactionByHash(files[1].TransactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_FILE_REENCRYPTED, reencrypted.Kind())
+	assert.NotEqual(t, secondHandle, reencrypted.IPFSHash)
+	defer os.Remove(reencrypted.IPFSHash)
+	latest, err = blockchain.ResolveLatestTransaction(secondID)
+	assert.Nil(t, err)
+	assert.Equal(t, files[1].TransactionID, latest)
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, secondID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err = utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	swept, err := groupOwner.SweepStaleFiles(&operator, groupUuid, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, swept)
+}
+
+func TestStaleFileSweepThroughAnInProcessProxy(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	newMember := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.SetRevocationMode(groupUuid, entities.REVOCATION_LAZY))
+
+	transactionIDs := []string{}
+	for i := 0; i < 3; i++ {
+		transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+		assert.Nil(t, err)
+		defer os.Remove(handle)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	assert.Nil(t, groupOwner.RemoveMemberObjAndSecureFiles(&operator, groupUuid, member))
+
+	//the sweeper shares the proxy with everything the group keeps doing in the meantime
+	sweeper, err := groupOwner.StartStaleFileSweep(&operator, groupUuid, time.Millisecond, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, newMember))
+	_, handle, err := newMember.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+	for _, transactionID := range transactionIDs {
+		decryptedFilePath, _, err := newMember.DownloadFile(&operator, groupUuid, transactionID)
+		assert.Nil(t, err)
+		os.Remove(decryptedFilePath)
+	}
+	assert.Eventually(t, func() bool {
+		files, err := groupOwner.ListFiles(groupUuid)
+		if err != nil {
+			return false
+		}
+		for _, file := range files {
+			if file.Stale {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	sweeper.Stop()
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	for _, transactionID := range transactionIDs {
+		latest, err := blockchain.ResolveLatestTransaction(transactionID)
+		assert.Nil(t, err)
+		reencrypted, err := blockchain.GetTransactionByHash(latest)
+		assert.Nil(t, err)
+		assert.Equal(t, entities.TX_FILE_REENCRYPTED, reencrypted.Kind())
+		defer os.Remove(reencrypted.IPFSHash)
+
+		decryptedFilePath, _, err := newMember.DownloadFile(&operator, groupUuid, transactionID)
+		assert.Nil(t, err)
+		decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+		assert.Nil(t, err)
+		assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+		os.Remove(decryptedFilePath)
+	}
+}
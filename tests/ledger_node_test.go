@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startNode(t *testing.T) *entities.LedgerNode {
+	node, err := entities.StartLedgerNode(entities.CreateBlockChain(), "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// waitForConvergence polls until every node reports the same tip, forks settle asynchronously
+func waitForConvergence(t *testing.T, nodes ...*entities.LedgerNode) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		first, _ := nodes[0].Chain().GetBlock(nodes[0].Chain().Height())
+		converged := true
+		for _, node := range nodes[1:] {
+			block, _ := node.Chain().GetBlock(node.Chain().Height())
+			if block.Header.Hash != first.Header.Hash {
+				converged = false
+				break
+			}
+		}
+		if converged {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("ledger nodes did not converge")
+}
+
+func TestLedgerNodesConverge(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+
+	a, b, c := startNode(t), startNode(t), startNode(t)
+	assert.Nil(t, a.Connect(b.Addr()))
+	assert.Nil(t, b.Connect(c.Addr()))
+
+	first, err := a.Chain().CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, b, c)
+	_, err = c.Chain().GetTransactionByHash(first)
+	assert.Nil(t, err)
+
+	//an operator that was cut off keeps writing, then rejoins with a competing history
+	rogue := startNode(t)
+	rogueIDs := []string{}
+	for _, handle := range []string{"QmR1", "QmR2", "QmR3"} {
+		transactionID, err := rogue.Chain().CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		rogueIDs = append(rogueIDs, transactionID)
+	}
+	second, err := c.Chain().CreateTransaction(signedUpload(t, member, "QmB"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, rogue.Connect(a.Addr()))
+	waitForConvergence(t, a, b, c, rogue)
+
+	for _, node := range []*entities.LedgerNode{a, b, c, rogue} {
+		for _, transactionID := range append([]string{first, second}, rogueIDs...) {
+			_, err := node.Chain().GetTransactionByHash(transactionID)
+			assert.Nil(t, err)
+		}
+		badIdx, err := node.Chain().VerifyChain()
+		assert.Nil(t, err)
+		assert.Equal(t, -1, badIdx)
+	}
+
+	//a node that lost its disk starts from genesis and catches up from any peer
+	fresh := startNode(t)
+	assert.Nil(t, fresh.Connect(c.Addr()))
+	waitForConvergence(t, a, fresh)
+	_, err = fresh.Chain().GetTransactionByHash(second)
+	assert.Nil(t, err)
+}
+
+func TestBlocksWithForgedRecordsAreNotAdopted(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	proxy := entities.CreateIPFSProxy()
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+
+	//a checks every record against the proxy, the rogue node takes whatever it is given
+	a, rogue := startNode(t), startNode(t)
+	a.Chain().UseKeyRegistry(proxy)
+	assert.Nil(t, a.Connect(rogue.Addr()))
+
+	upload := func(signer interface {
+		SignTransaction(entities.Data) (entities.Data, error)
+	}, handle string) entities.Data {
+		data, err := signer.SignTransaction(entities.CreateUploadData(groupUuid, "checksum", handle, ".txt"))
+		assert.Nil(t, err)
+		return data
+	}
+
+	_, err := rogue.Chain().CreateTransaction(upload(member, "QmA"))
+	assert.Nil(t, err)
+	waitForConvergence(t, a, rogue)
+
+	forged, err := rogue.Chain().CreateTransaction(upload(outsider, "QmB"))
+	assert.Nil(t, err)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, a.Chain().Height())
+	_, err = a.Chain().GetTransactionByHash(forged)
+	assert.NotNil(t, err)
+}
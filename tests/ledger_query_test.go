@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerQueries(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	alice, bob := entities.CreateAGroupMember(), entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+
+	upload := func(member entities.GroupMember, groupId string, handle string) string {
+		data, err := member.SignTransaction(entities.CreateUploadData(groupId, "checksum", handle, ".txt"))
+		assert.Nil(t, err)
+		transactionID, err := blockchain.CreateTransaction(data)
+		assert.Nil(t, err)
+		return transactionID
+	}
+
+	aliceInGroupA := []string{}
+	for i := 0; i < 5; i++ {
+		aliceInGroupA = append(aliceInGroupA, upload(alice, "group-a", fmt.Sprintf("QmA%d", i)))
+		upload(bob, "group-a", fmt.Sprintf("QmB%d", i))
+	}
+	lastWeek := time.Now()
+	upload(alice, "group-b", "QmC0")
+	lateUpload := upload(alice, "group-a", "QmA5")
+
+	//page through alice's uploads to group-a two at a time
+	seen := []string{}
+	cursor := ""
+	for {
+		result, err := blockchain.Query(entities.LedgerQuery{GroupId: "group-a", UserId: alice.GetUuid(), Cursor: cursor, Limit: 2})
+		assert.Nil(t, err)
+		for _, entry := range result.Entries {
+			seen = append(seen, entry.Transaction.ID)
+		}
+		if result.NextCursor == "" {
+			break
+		}
+		cursor = result.NextCursor
+	}
+	assert.Equal(t, append(aliceInGroupA, lateUpload), seen)
+
+	result, err := blockchain.Query(entities.LedgerQuery{IPFSHash: "QmB3"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Entries))
+	assert.Equal(t, bob.GetUuid(), result.Entries[0].Transaction.Data.UserId())
+
+	result, err = blockchain.Query(entities.LedgerQuery{UserId: alice.GetUuid(), From: lastWeek})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.Entries))
+	assert.Equal(t, lateUpload, result.Entries[1].Transaction.ID)
+
+	result, err = blockchain.Query(entities.LedgerQuery{UserId: alice.GetUuid(), To: lastWeek})
+	assert.Nil(t, err)
+	assert.Equal(t, aliceInGroupA, []string{
+		result.Entries[0].Transaction.ID, result.Entries[1].Transaction.ID, result.Entries[2].Transaction.ID,
+		result.Entries[3].Transaction.ID, result.Entries[4].Transaction.ID,
+	})
+
+	result, err = blockchain.Query(entities.LedgerQuery{Kinds: []entities.TransactionKind{entities.TX_FILE_UPLOADED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 12, len(result.Entries))
+
+	result, err = blockchain.Query(entities.LedgerQuery{Kinds: []entities.TransactionKind{entities.TX_MEMBER_ADDED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(result.Entries))
+
+	_, err = blockchain.Query(entities.LedgerQuery{Cursor: "not-a-cursor"})
+	assert.EqualError(t, err, "invalid cursor")
+}
+
+func TestQueryCursorDoesNotSurviveAForkSwitch(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+
+	a, rogue := startNode(t), startNode(t)
+	for _, handle := range []string{"QmA1", "QmA2"} {
+		_, err := a.Chain().CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	result, err := a.Chain().Query(entities.LedgerQuery{Limit: 1})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", result.NextCursor)
+
+	//a's blocks are replaced by a longer history, the transaction the cursor pointed at is not where it was any more
+	for _, handle := range []string{"QmR1", "QmR2", "QmR3"} {
+		_, err := rogue.Chain().CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, a.Connect(rogue.Addr()))
+	waitForConvergence(t, a, rogue)
+
+	_, err = a.Chain().Query(entities.LedgerQuery{Limit: 1, Cursor: result.NextCursor})
+	assert.ErrorIs(t, err, entities.ErrStaleCursor)
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMempoolBatchesTransactions(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockTransactions: 5, MaxBlockDelay: 300 * time.Millisecond}))
+	defer blockchain.Close()
+
+	//a full batch is sealed right away, as one block
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB", "QmC", "QmD", "QmE"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	for _, transactionID := range transactionIDs {
+		assert.Nil(t, blockchain.WaitForConfirmation(transactionID, 2*time.Second))
+	}
+	assert.Equal(t, 1, blockchain.Height())
+
+	//every transaction in a multi-transaction block still has its own inclusion proof
+	for _, transactionID := range transactionIDs {
+		proof, header, err := blockchain.GetInclusionProof(transactionID)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, header.Index)
+		assert.Nil(t, entities.VerifyInclusionProof(proof, header))
+	}
+	proof, header, err := blockchain.GetInclusionProof(transactionIDs[4])
+	assert.Nil(t, err)
+	proof.TransactionID = transactionIDs[3]
+	assert.EqualError(t, entities.VerifyInclusionProof(proof, header), "transaction is not included in this block")
+
+	//a lone transaction waits for the delay instead
+	lone := signedUpload(t, member, "QmF")
+	transactionID, err := blockchain.CreateTransaction(lone)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_STATUS_PENDING, blockchain.TransactionStatus(transactionID))
+	_, err = blockchain.GetTransactionByHash(transactionID)
+	assert.EqualError(t, err, "could not locate transaction")
+	_, err = blockchain.CreateTransaction(lone)
+	assert.EqualError(t, err, "transaction is already pending")
+	assert.EqualError(t, blockchain.WaitForConfirmation(transactionID, 10*time.Millisecond), "timed out waiting for the transaction to be committed")
+
+	assert.Nil(t, blockchain.WaitForConfirmation(transactionID, 2*time.Second))
+	assert.Equal(t, entities.TX_STATUS_COMMITTED, blockchain.TransactionStatus(transactionID))
+	assert.Equal(t, 2, blockchain.Height())
+
+	assert.Equal(t, entities.TX_STATUS_UNKNOWN, blockchain.TransactionStatus("nope"))
+	assert.EqualError(t, blockchain.WaitForConfirmation("nope", time.Second), "transaction is not pending or on the ledger")
+}
+
+func TestMempoolIsFlushedOnClose(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockTransactions: 2, MaxBlockDelay: time.Hour}))
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	assert.Nil(t, blockchain.Close())
+
+	reopened, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 2, reopened.Height())
+	for _, transactionID := range transactionIDs {
+		assert.Equal(t, entities.TX_STATUS_COMMITTED, reopened.TransactionStatus(transactionID))
+	}
+}
+
+func TestMempoolIsReleasedWhenItCannotBeSealedOnClose(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	v1 := createValidator("validator-1")
+	dir := t.TempDir()
+
+	//a follower queues transactions it can never seal itself
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, blockchain.EnableProofOfAuthority([]entities.Validator{v1.validator}, "", nil))
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockDelay: time.Hour}))
+	_, err = blockchain.CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+
+	assert.EqualError(t, blockchain.Close(), "it is not this validator's turn to seal a block")
+	assert.Nil(t, blockchain.Close())
+	reopened, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, reopened.Height())
+	assert.Nil(t, reopened.Close())
+}
+
+func TestPendingTransactionsAreGossipedToTheSealer(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	v1, v2 := createValidator("validator-1"), createValidator("validator-2")
+	validators := []entities.Validator{v1.validator, v2.validator}
+
+	a := startAuthorityNode(t, validators, v1)
+	b := startAuthorityNode(t, validators, v2)
+	for _, node := range []*entities.LedgerNode{a, b} {
+		assert.Nil(t, node.Chain().EnableMempool(entities.MempoolConfig{MaxBlockDelay: 20 * time.Millisecond}))
+	}
+	assert.Nil(t, a.Connect(b.Addr()))
+
+	//block 1 is validator-2's
+	first, err := b.Chain().CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Chain().WaitForConfirmation(first, 2*time.Second))
+	waitForConvergence(t, a, b)
+
+	//block 2 is validator-1's, it hears about the transaction and seals it long before validator-2 may
+	started := time.Now()
+	second, err := b.Chain().CreateTransaction(signedUpload(t, member, "QmB"))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Chain().WaitForConfirmation(second, 2*time.Second))
+	assert.Less(t, time.Since(started), entities.OUT_OF_TURN_SEAL_DELAY)
+	block, err := b.Chain().GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, "validator-1", block.Header.Sealer)
+	assert.Equal(t, second, block.Transactions[0].ID)
+}
+
+func TestUploadsCanWaitForConfirmation(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockDelay: 200 * time.Millisecond}))
+	t.Cleanup(func() { blockchain.Close() })
+
+	pending, _, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_STATUS_PENDING, blockchain.TransactionStatus(pending))
+
+	operator.ConfirmUploads(2 * time.Second)
+	confirmed, _, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_STATUS_COMMITTED, blockchain.TransactionStatus(confirmed))
+}
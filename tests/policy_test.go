@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicy(t *testing.T) {
+	_, err := entities.ParsePolicy("# nothing yet\n\nallow\n")
+	assert.Nil(t, err)
+
+	_, err = entities.ParsePolicy("allow\npermit role member")
+	assert.EqualError(t, err, `policy line 2: unknown rule "permit"`)
+	_, err = entities.ParsePolicy("role auditor")
+	assert.EqualError(t, err, "policy line 1: role needs a role name and at least one user")
+	_, err = entities.ParsePolicy("max-downloads many")
+	assert.EqualError(t, err, `policy line 1: "many" is not a download count`)
+	_, err = entities.ParsePolicy("allow hours 9-17")
+	assert.EqualError(t, err, `policy line 1: "9-17" is not a HH:MM-HH:MM window`)
+	_, err = entities.ParsePolicy("deny days monday")
+	assert.EqualError(t, err, `policy line 1: "monday" is not a day`)
+	_, err = entities.ParsePolicy("deny tag")
+	assert.EqualError(t, err, "policy line 1: every condition needs a value")
+	_, err = entities.ParsePolicy("deny colour red")
+	assert.EqualError(t, err, `policy line 1: unknown condition "colour"`)
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := entities.ParsePolicy(`
+role auditor carol
+allow role auditor
+allow tag public
+allow tag internal hours 09:00-17:00 days mon,tue,wed,thu,fri
+deny tag secret
+max-downloads 2 tag public
+`)
+	assert.Nil(t, err)
+
+	monday := time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+	request := func(userId string, at time.Time, downloads int, tags ...string) entities.AccessRequest {
+		return entities.AccessRequest{UserId: userId, Roles: []string{"member"}, Tags: tags, At: at, Downloads: downloads}
+	}
+
+	assert.Nil(t, policy.Evaluate(request("bob", monday, 0, "public")))
+	assert.EqualError(t, policy.Evaluate(request("bob", monday, 2, "public")), "download limit of 2 reached (policy line 7)")
+	assert.Nil(t, policy.Evaluate(request("bob", monday, 5, "internal")))
+	assert.EqualError(t, policy.Evaluate(request("bob", monday.Add(8*time.Hour), 0, "internal")), "no policy rule allows this download")
+	assert.EqualError(t, policy.Evaluate(request("bob", monday.AddDate(0, 0, 5), 0, "internal")), "no policy rule allows this download")
+	assert.EqualError(t, policy.Evaluate(request("bob", monday, 0)), "no policy rule allows this download")
+	assert.Nil(t, policy.Evaluate(request("carol", monday.Add(12*time.Hour), 0)))
+	assert.EqualError(t, policy.Evaluate(request("carol", monday, 0, "secret")), "download denied by policy line 6")
+
+	//a window past midnight, the end is exclusive
+	overnight, err := entities.ParsePolicy("allow hours 22:00-06:00")
+	assert.Nil(t, err)
+	assert.Nil(t, overnight.Evaluate(request("bob", monday.Add(13*time.Hour), 0)))
+	assert.Nil(t, overnight.Evaluate(request("bob", monday.Add(-5*time.Hour), 0)))
+	assert.NotNil(t, overnight.Evaluate(request("bob", monday.Add(-4*time.Hour), 0)))
+	assert.NotNil(t, overnight.Evaluate(request("bob", monday, 0)))
+
+	empty, err := entities.ParsePolicy("")
+	assert.Nil(t, err)
+	assert.Nil(t, empty.Evaluate(request("bob", monday, 100, "secret")))
+}
+
+func TestPolicyLimitsKeyReleases(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+
+	assert.EqualError(t, groupOwner.SetPolicy(&operator, groupUuid, "allow weather sunny"), `policy line 1: unknown condition "weather"`)
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "max-downloads 1 tag report\ndeny tag draft"))
+
+	reportID, _, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH, "report")
+	assert.Nil(t, err)
+	draftID, _, err := member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH, "draft")
+	assert.Nil(t, err)
+
+	report, err := blockchain.GetTransactionByHash(reportID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"report"}, report.Tags())
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, reportID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	_, _, err = member.DownloadFile(&operator, groupUuid, reportID)
+	assert.EqualError(t, err, "download limit of 1 reached (policy line 1)")
+	_, _, err = member.DownloadFile(&operator, groupUuid, draftID)
+	assert.EqualError(t, err, "download denied by policy line 2")
+
+	//the owner is not bound by the policy
+	for i := 0; i < 2; i++ {
+		decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, reportID)
+		assert.Nil(t, err)
+		os.Remove(decryptedFilePath)
+	}
+
+	//every released key is on the ledger, refused downloads are not
+	releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(releases))
+	assert.Equal(t, member.GetUuid(), releases[0].Transaction.Data.UserId())
+
+	//a newer policy replaces the old one
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "allow tag draft"))
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, draftID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	_, _, err = member.DownloadFile(&operator, groupUuid, reportID)
+	assert.EqualError(t, err, "no policy rule allows this download")
+
+	stranger := entities.CreateAGroupOwner()
+	assert.EqualError(t, stranger.SetPolicy(&operator, groupUuid, "allow"), "only the group owner can set its policy")
+}
+
+func TestDownloadLimitHoldsForConcurrentDownloads(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "max-downloads 1"))
+	reportID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	//releases take a while to be sealed, every download would be evaluated before any of them is on the ledger unless
+	//the proxy lets them through one at a time
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockDelay: 100 * time.Millisecond}))
+	t.Cleanup(func() { blockchain.Close() })
+	results := make(chan error, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, reportID)
+			if err == nil {
+				os.Remove(decryptedFilePath)
+			}
+			results <- err
+		}()
+	}
+	released := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			released++
+		} else {
+			assert.EqualError(t, err, "download limit of 1 reached (policy line 1)")
+		}
+	}
+	assert.Equal(t, 1, released)
+
+	releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(releases))
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembersOnlyReceiveTheDataKeyOfTheirFile(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+
+	//keep whatever the proxy hands out
+	released := [][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		proxyServer.ServeHTTP(recorder, r)
+		if strings.HasSuffix(r.URL.Path, "/keys") && recorder.Code == http.StatusOK {
+			message := struct {
+				EncryptedKey []byte `json:"encryptedKey"`
+			}{}
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &message))
+			released = append(released, message.EncryptedKey)
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer server.Close()
+
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	firstID, firstHandle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	_, secondHandle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(firstHandle)
+	defer os.Remove(secondHandle)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, firstID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	assert.Equal(t, 1, len(released))
+
+	//what the member got is the data key of that one file, not the group private key
+	memberPrivateKey, err := os.ReadFile(filepath.Join(keys.PEM_FOLDER, member.GetUuid()+"_private_key.pem"))
+	assert.Nil(t, err)
+	dataKey, err := utils.DecryptKey(released[0], memberPrivateKey)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.DATA_KEY_SIZE, len(dataKey))
+	assert.NotContains(t, string(dataKey), "PRIVATE KEY")
+
+	//it opens the file it was released for
+	assert.Nil(t, ipfs.DownloadFileFromIPFS(sh, firstHandle, ""))
+	decryptedFilePath, _, err = utils.DecryptFileWithDataKey(firstHandle, dataKey)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	//and no other file of the group, even one with the same content
+	assert.Nil(t, ipfs.DownloadFileFromIPFS(sh, secondHandle, ""))
+	_, _, err = utils.DecryptFileWithDataKey(secondHandle, dataKey)
+	assert.EqualError(t, err, "Decrypt File | wrong data key or the file has been tampered with")
+}
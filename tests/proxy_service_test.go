@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyOverHTTP(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	//the proxy host
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	server := httptest.NewServer(entities.CreateProxyServer(proxy))
+	defer server.Close()
+
+	//everyone else only knows where it is
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.NotEqual(t, "", groupUuid)
+	ownerId, err := client.OwnerOf(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, groupOwner.GetUuid(), ownerId)
+	_, err = client.OwnerOf("nope")
+	assert.EqualError(t, err, "group does not exist")
+
+	_, _, err = member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.EqualError(t, err, "is not a member")
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	assert.EqualError(t, groupOwner.AddNewMemberObj(client, groupUuid, member), "user was already added!")
+	assert.True(t, proxy.IsMember(groupUuid, member.GetUuid()))
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+
+	transactionID, _, err := member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	uploaded, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	assert.Equal(t, ".txt", uploaded.FileExtension())
+
+	decryptedFilePath, _, err := groupOwner.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	//denials keep their reason across the wire
+	_, _, err = outsider.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+	assert.EqualError(t, err, "user is not a member of the group")
+
+	//group changes have to be signed by the owner, knowing the owner's ID is not enough
+	body := `{"ownerId":"` + groupOwner.GetUuid() + `","memberId":"` + outsider.GetUuid() + `","publicKey":"","signature":""}`
+	response, err := http.Post(server.URL+"/groups/"+groupUuid+"/members", "application/json", strings.NewReader(body))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.False(t, client.IsMember(groupUuid, outsider.GetUuid()))
+
+	//revoking goes through the client too, the owner re-encrypts the files against the rotated key
+	assert.Nil(t, groupOwner.RemoveMemberObjAndSecureFiles(&operator, groupUuid, member))
+	assert.False(t, proxy.IsMember(groupUuid, member.GetUuid()))
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+
+	latest, err := blockchain.ResolveLatestTransaction(transactionID)
+	assert.Nil(t, err)
+	assert.NotEqual(t, transactionID, latest)
+	decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err = utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+	reencrypted, err := blockchain.GetTransactionByHash(latest)
+	assert.Nil(t, err)
+	os.Remove(uploaded.IPFSHash)
+	os.Remove(reencrypted.IPFSHash)
+}
+
+// statusRecorder remembers the status of every response a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	statuses chan int
+}
+
+func (r statusRecorder) WriteHeader(status int) {
+	r.statuses <- status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func TestProxyServerHandlesRequestsSideBySide(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	server := httptest.NewServer(entities.CreateProxyServer(proxy))
+	defer server.Close()
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	//the key release waits for its record to be sealed, nobody else has to wait with it
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockDelay: 2 * time.Second}))
+	t.Cleanup(func() { blockchain.Close() })
+	downloaded := make(chan error, 1)
+	go func() {
+		decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+		if err == nil {
+			os.Remove(decryptedFilePath)
+		}
+		downloaded <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	started := time.Now()
+	assert.True(t, client.IsMember(groupUuid, member.GetUuid()))
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Nil(t, <-downloaded)
+}
+
+func TestProxyServerFailuresAreServerErrors(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+
+	//the proxy's IPFS node is down, the client's is not
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(shell.NewShell("localhost:1"), blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+	statuses := make(chan int, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyServer.ServeHTTP(statusRecorder{w, statuses}, r)
+	}))
+	defer server.Close()
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Equal(t, http.StatusCreated, <-statuses)
+
+	//a request the proxy refuses is the client's to fix
+	_, err := client.OwnerOf("nope")
+	assert.EqualError(t, err, "group does not exist")
+	assert.Equal(t, http.StatusBadRequest, <-statuses)
+
+	//one it can't carry out is not, the upload is the last request the owner makes
+	_, _, err = groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.NotNil(t, err)
+	last := 0
+	for len(statuses) > 0 {
+		last = <-statuses
+	}
+	assert.Equal(t, http.StatusInternalServerError, last)
+}
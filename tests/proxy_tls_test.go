@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyOverMutualTLS(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	outsider := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+	proxyCertificate, err := entities.CreateProxyCertificate("127.0.0.1")
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(proxyServer)
+	server.TLS = proxyServer.TLSConfig(proxyCertificate)
+	server.StartTLS()
+	defer server.Close()
+
+	clientFor := func(user interface {
+		Certificate() (tls.Certificate, error)
+	}) *entities.ProxyClient {
+		certificate, err := user.Certificate()
+		assert.Nil(t, err)
+		return entities.CreateTLSProxyClient(server.URL, certificate, proxyCertificate.Leaf)
+	}
+	ownerClient := clientFor(groupOwner)
+	ownerOperator := entities.CreateOperator(ownerClient, sh, blockchain)
+	memberClient := clientFor(member)
+	memberOperator := entities.CreateOperator(memberClient, sh, blockchain)
+
+	//nobody the proxy doesn't know gets past the handshake
+	_, err = ownerClient.OwnerOf("123")
+	assert.ErrorContains(t, err, "could not reach the proxy")
+	assert.Equal(t, "", groupOwner.RegisterNewGroup(ownerClient))
+
+	proxyServer.Enroll(groupOwner.GetUuid(), groupOwner.GetPublicKey())
+	groupUuid := groupOwner.RegisterNewGroup(ownerClient)
+	assert.NotEqual(t, "", groupUuid)
+
+	_, _, err = member.UploadFile(&memberOperator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.EqualError(t, err, "is not a member")
+	assert.Nil(t, groupOwner.AddNewMemberObj(ownerClient, groupUuid, member))
+
+	transactionID, _, err := member.UploadFile(&memberOperator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	decryptedFilePath, _, err := member.DownloadFile(&memberOperator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	//a member's connection can only speak for the member, even with a request the owner would be allowed to make
+	memberCertificate, err := member.Certificate()
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(proxyCertificate.Leaf)
+	memberHTTP := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates: []tls.Certificate{memberCertificate},
+		RootCAs:      roots,
+	}}}
+	body := `{"ownerId":"` + groupOwner.GetUuid() + `","memberId":"` + outsider.GetUuid() + `","signature":""}`
+	response, err := memberHTTP.Post(server.URL+"/groups/"+groupUuid+"/members", "application/json", strings.NewReader(body))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	//a proxy that is not the pinned one is not trusted either
+	otherCertificate, err := entities.CreateProxyCertificate("127.0.0.1")
+	assert.Nil(t, err)
+	certificate, err := groupOwner.Certificate()
+	assert.Nil(t, err)
+	_, err = entities.CreateTLSProxyClient(server.URL, certificate, otherCertificate.Leaf).OwnerOf(groupUuid)
+	assert.ErrorContains(t, err, "certificate")
+
+	//once removed, the member's certificate is worth nothing, on the connection it already has open too
+	assert.Nil(t, groupOwner.RemoveMemberObj(&ownerOperator, groupUuid, member))
+	_, _, err = member.DownloadFile(&memberOperator, groupUuid, transactionID)
+	assert.ErrorContains(t, err, "client certificate is not bound to a registered key")
+
+	outsiderClient := clientFor(outsider)
+	assert.False(t, outsiderClient.IsMember(groupUuid, groupOwner.GetUuid()))
+	assert.True(t, ownerClient.IsMember(groupUuid, groupOwner.GetUuid()))
+
+	data, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	os.Remove(data.IPFSHash)
+}
+
+func TestTLSHandshakesDoNotWaitForRequests(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+	proxyCertificate, err := entities.CreateProxyCertificate("127.0.0.1")
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(proxyServer)
+	server.TLS = proxyServer.TLSConfig(proxyCertificate)
+	server.StartTLS()
+	defer server.Close()
+
+	clientFor := func(user interface {
+		Certificate() (tls.Certificate, error)
+	}) *entities.ProxyClient {
+		certificate, err := user.Certificate()
+		assert.Nil(t, err)
+		return entities.CreateTLSProxyClient(server.URL, certificate, proxyCertificate.Leaf)
+	}
+	proxyServer.Enroll(groupOwner.GetUuid(), groupOwner.GetPublicKey())
+	ownerClient := clientFor(groupOwner)
+	groupUuid := groupOwner.RegisterNewGroup(ownerClient)
+	assert.Nil(t, groupOwner.AddNewMemberObj(ownerClient, groupUuid, member))
+	memberOperator := entities.CreateOperator(clientFor(member), sh, blockchain)
+	transactionID, _, err := member.UploadFile(&memberOperator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	data, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	defer os.Remove(data.IPFSHash)
+
+	//the member's key release is held up until its record is sealed, a new connection is checked meanwhile
+	assert.Nil(t, blockchain.EnableMempool(entities.MempoolConfig{MaxBlockDelay: 2 * time.Second}))
+	t.Cleanup(func() { blockchain.Close() })
+	downloaded := make(chan error, 1)
+	go func() {
+		decryptedFilePath, _, err := member.DownloadFile(&memberOperator, groupUuid, transactionID)
+		if err == nil {
+			os.Remove(decryptedFilePath)
+		}
+		downloaded <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	started := time.Now()
+	assert.True(t, clientFor(groupOwner).IsMember(groupUuid, member.GetUuid()))
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Nil(t, <-downloaded)
+}
@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrunedLedgerKeepsLiveFiles(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "allow"))
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "max-downloads 5"))
+
+	firstVersion, _, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH, "report")
+	assert.Nil(t, err)
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, firstVersion)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	_, err = proxy.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.Nil(t, err)
+	secondVersion, err := blockchain.ResolveLatestTransaction(firstVersion)
+	assert.Nil(t, err)
+	assert.NotEqual(t, firstVersion, secondVersion)
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, firstVersion)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	memberAdded, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_MEMBER_ADDED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(memberAdded))
+	memberAddedID := memberAdded[0].Transaction.ID
+
+	_, pruned := blockchain.Checkpoint()
+	assert.False(t, pruned)
+	_, err = blockchain.Prune(blockchain.Height())
+	assert.EqualError(t, err, "chain is too short to prune")
+
+	height := blockchain.Height()
+	checkpoint, err := blockchain.Prune(0)
+	assert.Nil(t, err)
+	assert.Equal(t, height, checkpoint.Height)
+	tip, err := blockchain.GetBlock(height)
+	assert.Nil(t, err)
+	assert.Equal(t, tip.Header.Hash, checkpoint.Hash)
+
+	check := func(blockchain *entities.Blockchain, keyReleases int) {
+		badIdx, err := blockchain.VerifyChain()
+		assert.Nil(t, err)
+		assert.Equal(t, -1, badIdx)
+
+		//the live file and the version it replaced are still readable, so old bookmarks still resolve
+		latest, err := blockchain.ResolveLatestTransaction(firstVersion)
+		assert.Nil(t, err)
+		assert.Equal(t, secondVersion, latest)
+		data, err := blockchain.GetTransactionByHash(secondVersion)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"report"}, data.Tags())
+
+		_, err = blockchain.GetTransactionByHash(memberAddedID)
+		assert.EqualError(t, err, "transaction has been pruned from this ledger")
+		proof, header, err := blockchain.GetInclusionProof(memberAddedID)
+		assert.Nil(t, err)
+		assert.Nil(t, entities.VerifyInclusionProof(proof, header))
+
+		policies, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_POLICY_SET}})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(policies))
+		assert.Equal(t, "max-downloads 5", policies[0].Transaction.Data.Policy())
+
+		//a rekey keeps the ciphertext, so the keys released before it still count towards a limit, the owner's included
+		releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+		assert.Nil(t, err)
+		assert.Equal(t, keyReleases, len(releases))
+		assert.Equal(t, data.IPFSHash, releases[0].Transaction.Data.IPFSHash)
+
+		//the group's creation stays too, membership records are checked against it
+		everything, err := entities.QueryAll(blockchain, entities.LedgerQuery{})
+		assert.Nil(t, err)
+		assert.Equal(t, 4+keyReleases, len(everything))
+	}
+	check(blockchain, 3)
+
+	_, err = blockchain.MembersAt(groupUuid, time.Now())
+	assert.EqualError(t, err, "membership history has been pruned from this ledger")
+	assert.EqualError(t, blockchain.ExportJSON(&bytes.Buffer{}), "a pruned ledger cannot be exported, export from an archival node")
+
+	//pruning did not get in the way of the policy engine
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, secondVersion)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	assert.Nil(t, blockchain.Close())
+
+	//a rewrite that never got as far as its checkpoint is thrown away on the next open
+	leftover := filepath.Join(dir, "pruned-00000099.log")
+	assert.Nil(t, os.WriteFile(leftover, []byte("half a rewrite"), 0644))
+
+	reopened, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err))
+
+	stored, pruned := reopened.Checkpoint()
+	assert.True(t, pruned)
+	assert.Equal(t, checkpoint, stored)
+	check(reopened, 4)
+
+	badIdx, err := reopened.VerifyFromCheckpoint(checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+	_, err = reopened.VerifyFromCheckpoint(entities.Checkpoint{Height: checkpoint.Height, Hash: "not-the-hash"})
+	assert.EqualError(t, err, "block does not match the checkpoint")
+	first, err := reopened.GetBlock(1)
+	assert.Nil(t, err)
+	_, err = reopened.VerifyFromCheckpoint(entities.Checkpoint{Height: 1, Hash: first.Header.Hash})
+	assert.ErrorContains(t, err, "has been pruned")
+}
+
+func TestPruningStandsWhenItsCleanupFails(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	dir := t.TempDir()
+
+	blockchain, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		_, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+	}
+
+	//the pruned log goes into the segment after the last one, a directory in its way stops it from being moved there
+	segments, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	assert.Nil(t, err)
+	last := 0
+	for _, path := range segments {
+		var segment int
+		_, err := fmt.Sscanf(filepath.Base(path), entities.SEGMENT_FILE_FORMAT, &segment)
+		assert.Nil(t, err)
+		last = max(last, segment)
+	}
+	blocker := filepath.Join(dir, fmt.Sprintf(entities.SEGMENT_FILE_FORMAT, last+1))
+	assert.Nil(t, os.MkdirAll(filepath.Join(blocker, "in-the-way"), 0755))
+
+	//the checkpoint is written, so the ledger is pruned, only writing has to wait for the cleanup
+	checkpoint, err := blockchain.Prune(0)
+	assert.Nil(t, err)
+	current, pruned := blockchain.Checkpoint()
+	assert.True(t, pruned)
+	assert.Equal(t, checkpoint, current)
+	_, err = blockchain.CreateTransaction(signedUpload(t, member, "QmD"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, blockchain.Height())
+
+	assert.Nil(t, os.RemoveAll(blocker))
+	_, err = blockchain.CreateTransaction(signedUpload(t, member, "QmD"))
+	assert.Nil(t, err)
+	assert.Nil(t, blockchain.Close())
+
+	reopened, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 4, reopened.Height())
+	current, pruned = reopened.Checkpoint()
+	assert.True(t, pruned)
+	assert.Equal(t, checkpoint, current)
+	badIdx, err := reopened.VerifyChain()
+	assert.Nil(t, err)
+	assert.Equal(t, -1, badIdx)
+}
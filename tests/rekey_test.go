@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotationRewrapsDataKeys(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	operator := entities.CreateOperator(proxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(proxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(proxy, groupUuid, member))
+	firstVersion, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH, "report")
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+	uploaded, err := blockchain.GetTransactionByHash(firstVersion)
+	assert.Nil(t, err)
+
+	_, err = proxy.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.Nil(t, err)
+
+	//the new version is the same ciphertext with its data key encrypted under the new group key
+	secondVersion, err := blockchain.ResolveLatestTransaction(firstVersion)
+	assert.Nil(t, err)
+	rekeyed, err := blockchain.GetTransactionByHash(secondVersion)
+	assert.Nil(t, err)
+	assert.Equal(t, entities.TX_FILE_REKEYED, rekeyed.Kind())
+	assert.Equal(t, "file-rekeyed", rekeyed.Kind().String())
+	assert.Equal(t, firstVersion, rekeyed.PreviousId())
+	assert.Equal(t, handle, rekeyed.IPFSHash)
+	assert.Equal(t, uploaded.FileHash(), rekeyed.FileHash())
+	assert.Equal(t, []string{"report"}, rekeyed.Tags())
+	assert.NotEqual(t, uploaded.FileKey(), rekeyed.FileKey())
+
+	files, err := groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, secondVersion, files[0].TransactionID)
+
+	//nothing was taken off IPFS
+	deleted, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_FILE_DELETED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(deleted))
+	assert.Nil(t, ipfs.DownloadFileFromIPFS(sh, handle, ""))
+
+	//members still get the file through the old bookmark
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, firstVersion)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	//rotating again rewraps the rekeyed version
+	_, err = proxy.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.Nil(t, err)
+	thirdVersion, err := blockchain.ResolveLatestTransaction(firstVersion)
+	assert.Nil(t, err)
+	rekeyedAgain, err := blockchain.GetTransactionByHash(thirdVersion)
+	assert.Nil(t, err)
+	assert.Equal(t, secondVersion, rekeyedAgain.PreviousId())
+	decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, firstVersion)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+}
+
+func TestKeyRotationStopsWhenADataKeyCannotBeReleased(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+
+	//the proxy turns key releases away while refusing is set, group changes still go through
+	refusing := atomic.Bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refusing.Load() && strings.HasSuffix(r.URL.Path, "/keys") {
+			http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		proxyServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	//the key is not rotated when a data key can't be released first, the file would be lost under the new key
+	refusing.Store(true)
+	_, err = client.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.ErrorContains(t, err, "could not rekey file")
+	files, err := groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, transactionID, files[0].TransactionID)
+	rotations, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_ROTATED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rotations))
+
+	refusing.Store(false)
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	_, err = client.ChangeKeyAndSecureFiles(&operator, &groupOwner, 0, groupUuid)
+	assert.Nil(t, err)
+	files, err = groupOwner.ListFiles(groupUuid)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, files[0].TransactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+}
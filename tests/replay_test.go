@@ -0,0 +1,225 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadRequestsCannotBeReplayed(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+
+	//someone on the path between the member and the proxy keeps a copy of every key release request
+	captured := [][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/keys") {
+			body, _ := io.ReadAll(r.Body)
+			captured = append(captured, body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		proxyServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	assert.Equal(t, 1, len(captured))
+
+	response, err := http.Post(server.URL+"/groups/"+groupUuid+"/keys", "application/json", bytes.NewReader(captured[0]))
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	assert.Contains(t, string(body), "download request has already been used")
+
+	//the replay did not count as a download
+	releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(releases))
+
+	//every download signs a new request, so downloading again is fine
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	proxy.SetReplayWindow(30*time.Second, entities.REPLAY_CACHE_SIZE, entities.REPLAY_CACHE_PER_USER)
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrStaleRequest)
+	assert.EqualError(t, err, "download request is valid for longer than 30s")
+
+	//the cache never drops a nonce that could still be replayed, it turns new requests away instead
+	proxy.SetReplayWindow(entities.MAX_DOWNLOAD_REQUEST_LIFETIME, 1, 1)
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	_, _, err = groupOwner.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrTooManyRequests)
+	assert.EqualError(t, err, "too many download requests in flight, try again later")
+
+	//one user filling their share of the cache does not turn anyone else away
+	proxy.SetReplayWindow(entities.MAX_DOWNLOAD_REQUEST_LIFETIME, 3, 2)
+	for i := 0; i < 2; i++ {
+		decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+		assert.Nil(t, err)
+		os.Remove(decryptedFilePath)
+	}
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrTooManyRequests)
+	assert.EqualError(t, err, "too many download requests in flight for this user, try again later")
+	decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	os.Remove(handle)
+}
+
+// resign signs a key release request the way a member's client does, so a test can play a member who sends the proxy
+// something other than what DownloadFile would. message is decoded with decodeMessage.
+func resign(t *testing.T, message map[string]interface{}, groupId string, privateKeyPEM []byte) {
+	field := func(buf []byte, value []byte) []byte {
+		return append(binary.AppendUvarint(buf, uint64(len(value))), value...)
+	}
+	bytesOf := func(name string) []byte {
+		raw, err := base64.StdEncoding.DecodeString(message[name].(string))
+		assert.Nil(t, err)
+		return raw
+	}
+	extension, _ := message["fileExtension"].(string)
+	buf := field([]byte{}, []byte("download-request"))
+	buf = field(buf, []byte(message["userId"].(string)))
+	buf = field(buf, []byte(groupId))
+	buf = field(buf, []byte(message["ipfsHandle"].(string)))
+	buf = field(buf, []byte(extension))
+	buf = field(buf, bytesOf("publicKey"))
+	buf = field(buf, bytesOf("keyRelease"))
+	buf = field(buf, []byte(message["transactionId"].(string)))
+	buf = field(buf, []byte(message["nonce"].(string)))
+	issuedAt, err := message["issuedAt"].(json.Number).Int64()
+	assert.Nil(t, err)
+	expiresAt, err := message["expiresAt"].(json.Number).Int64()
+	assert.Nil(t, err)
+	buf = binary.AppendVarint(buf, issuedAt)
+	buf = binary.AppendVarint(buf, expiresAt)
+
+	block, _ := pem.Decode(privateKeyPEM)
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	assert.Nil(t, err)
+	hash := sha256.Sum256(buf)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	assert.Nil(t, err)
+	message["signature"] = base64.StdEncoding.EncodeToString(signature)
+}
+
+// decodeMessage keeps the numbers of a request as they were sent, the timestamps are too big for a float64
+func decodeMessage(t *testing.T, raw []byte) map[string]interface{} {
+	message := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	assert.Nil(t, decoder.Decode(&message))
+	return message
+}
+
+func TestRecordedKeyReleasesCannotBeReused(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+	proxy := entities.CreateIPFSProxy()
+	proxy.Connect(sh, blockchain)
+	proxyServer := entities.CreateProxyServer(proxy)
+
+	captured := [][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/keys") {
+			body, _ := io.ReadAll(r.Body)
+			captured = append(captured, body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		proxyServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := entities.CreateProxyClient(server.URL)
+	operator := entities.CreateOperator(client, sh, blockchain)
+	groupUuid := groupOwner.RegisterNewGroup(client)
+	assert.Nil(t, groupOwner.AddNewMemberObj(client, groupUuid, member))
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "max-downloads 1"))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	assert.Equal(t, 1, len(captured))
+	memberPrivateKey, err := os.ReadFile(filepath.Join(keys.PEM_FOLDER, member.GetUuid()+"_private_key.pem"))
+	assert.Nil(t, err)
+
+	post := func(message map[string]interface{}) (int, string) {
+		body, err := json.Marshal(message)
+		assert.Nil(t, err)
+		response, err := http.Post(server.URL+"/groups/"+groupUuid+"/keys", "application/json", bytes.NewReader(body))
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		reply, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(reply)
+	}
+
+	//the member signs a new request around the release that is already on the ledger, it would not count twice
+	message := decodeMessage(t, captured[0])
+	message["nonce"] = "a nonce the proxy has not seen"
+	resign(t, message, groupUuid, memberPrivateKey)
+	status, reply := post(message)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, reply, "download request does not carry a matching key release record")
+
+	//and a proxy that forgot the nonce still sees the request was used once its release is on the ledger
+	message = decodeMessage(t, captured[0])
+	proxy.SetReplayWindow(entities.MAX_DOWNLOAD_REQUEST_LIFETIME, entities.REPLAY_CACHE_SIZE, entities.REPLAY_CACHE_PER_USER)
+	status, reply = post(message)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, reply, "download request has already been used")
+
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.EqualError(t, err, "download limit of 1 reached (policy line 1)")
+	releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(releases))
+}
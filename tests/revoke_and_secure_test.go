@@ -98,16 +98,30 @@ func TestRevokeAndSecureFiles(t *testing.T) {
 		groupOwner.RemoveMemberObjAndSecureFiles(&operator, groupOneUuid, groupOneMembers[i])
 
 		decryptedFilePath, _, err = groupOneMembers[i].DownloadFile(&operator, groupOneUuid, transactionIDs[i])
-		assert.EqualError(t, err, "crypto/rsa: decryption error")
-		os.Remove(decryptedFilePath)
-
-		decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupOneUuid, transactionIDs[i])
-		assert.EqualError(t, err, "crypto/rsa: decryption error")
+		assert.EqualError(t, err, "user is not a member of the group")
 		os.Remove(decryptedFilePath)
 
 		files, err := groupOwner.ListFiles(groupOneUuid)
 		assert.Nil(t, err)
 
+		//the old transaction ID now leads to the re-encrypted file, groups revoke eagerly and its data key is not rewrapped first
+		latestID, err := blockchain.ResolveLatestTransaction(transactionIDs[i])
+		assert.Nil(t, err)
+		assert.Equal(t, files[i].TransactionID, latestID)
+		assert.False(t, files[i].Stale)
+		reencrypted, err := blockchain.GetTransactionByHash(latestID)
+		assert.Nil(t, err)
+		assert.Equal(t, entities.TX_FILE_REENCRYPTED, reencrypted.Kind())
+		assert.NotEqual(t, IPFSHandles[i], reencrypted.IPFSHash)
+		assert.Equal(t, transactionIDs[i], reencrypted.PreviousId())
+
+		decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupOneUuid, transactionIDs[i])
+		assert.Nil(t, err)
+		decryptedFileRawBytes, err = utils.LoadRawBytesFromFile(decryptedFilePath)
+		assert.Nil(t, err)
+		assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+		os.Remove(decryptedFilePath)
+
 		decryptedFilePath, _, err = groupOwner.DownloadFile(&operator, groupOneUuid, files[i].TransactionID)
 		assert.Nil(t, err)
 
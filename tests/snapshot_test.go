@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	v1 := createValidator("validator-1")
+
+	blockchain := entities.CreateBlockChain()
+	assert.Nil(t, blockchain.EnableProofOfAuthority([]entities.Validator{v1.validator}, v1.validator.Id, v1.privateKey))
+	transactionIDs := []string{}
+	for _, handle := range []string{"QmA", "QmB", "QmC"} {
+		transactionID, err := blockchain.CreateTransaction(signedUpload(t, member, handle))
+		assert.Nil(t, err)
+		transactionIDs = append(transactionIDs, transactionID)
+	}
+	tip, err := blockchain.GetBlock(3)
+	assert.Nil(t, err)
+
+	jsonSnapshot, binarySnapshot := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Nil(t, blockchain.ExportJSON(jsonSnapshot))
+	assert.Nil(t, blockchain.ExportBinary(binarySnapshot))
+	assert.Contains(t, jsonSnapshot.String(), `"format": "blockchain-fileshare/ledger-snapshot"`)
+	assert.Less(t, binarySnapshot.Len(), jsonSnapshot.Len())
+
+	trusted := entities.SnapshotTrust{GenesisValidators: []entities.Validator{v1.validator}}
+	for _, snapshot := range []string{jsonSnapshot.String(), binarySnapshot.String()} {
+		restored, err := entities.ImportSnapshot(strings.NewReader(snapshot), "", trusted)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, restored.Height())
+		block, err := restored.GetBlock(3)
+		assert.Nil(t, err)
+		assert.Equal(t, tip.Header.Hash, block.Header.Hash)
+		assert.Equal(t, []entities.Validator{v1.validator}, restored.Validators())
+		for _, transactionID := range transactionIDs {
+			_, err := restored.GetTransactionByHash(transactionID)
+			assert.Nil(t, err)
+		}
+	}
+
+	//restoring onto disk gives a ledger that reopens like any other
+	dir := t.TempDir()
+	restored, err := entities.ImportSnapshot(bytes.NewReader(binarySnapshot.Bytes()), dir, trusted)
+	assert.Nil(t, err)
+	assert.Nil(t, restored.Close())
+	reopened, err := entities.OpenBlockChain(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, reopened.Height())
+	assert.Nil(t, reopened.Close())
+	_, err = entities.ImportSnapshot(bytes.NewReader(binarySnapshot.Bytes()), dir, trusted)
+	assert.EqualError(t, err, "refusing to import into a directory that is not empty")
+
+	//any edit to the contents is caught before the snapshot is accepted
+	tampered := strings.Replace(jsonSnapshot.String(), `"ipfsHash": "QmB"`, `"ipfsHash": "QmX"`, 1)
+	assert.NotEqual(t, jsonSnapshot.String(), tampered)
+	_, err = entities.ImportSnapshot(strings.NewReader(tampered), "", trusted)
+	assert.ErrorContains(t, err, "snapshot failed verification at block 2")
+
+	raw := binarySnapshot.Bytes()
+	flipped := bytes.Replace(raw, []byte("QmC"), []byte("QmZ"), 1)
+	_, err = entities.ImportSnapshot(bytes.NewReader(flipped), "", trusted)
+	assert.ErrorContains(t, err, "snapshot failed verification at block 3")
+
+	_, err = entities.ImportSnapshot(bytes.NewReader(raw[:len(raw)-10]), "", trusted)
+	assert.NotNil(t, err)
+
+	//a chain sealed by someone else does not pass as this one
+	v2 := createValidator("validator-2")
+	forged := strings.Replace(jsonSnapshot.String(), strings.ReplaceAll(string(v1.validator.PublicKey), "\n", `\n`), strings.ReplaceAll(string(v2.validator.PublicKey), "\n", `\n`), 1)
+	assert.NotEqual(t, jsonSnapshot.String(), forged)
+	_, err = entities.ImportSnapshot(strings.NewReader(forged), "", trusted)
+	assert.EqualError(t, err, "snapshot validators do not match the trusted ones")
+	_, err = entities.ImportSnapshot(strings.NewReader(forged), "", entities.SnapshotTrust{TipHash: tip.Header.Hash})
+	assert.ErrorContains(t, err, "seal does not verify")
+
+	//nor does a whole chain made up by someone who lists themselves as its validator
+	madeUp := entities.CreateBlockChain()
+	assert.Nil(t, madeUp.EnableProofOfAuthority([]entities.Validator{v2.validator}, v2.validator.Id, v2.privateKey))
+	_, err = madeUp.CreateTransaction(signedUpload(t, member, "QmM"))
+	assert.Nil(t, err)
+	madeUpSnapshot := &bytes.Buffer{}
+	assert.Nil(t, madeUp.ExportBinary(madeUpSnapshot))
+	_, err = entities.ImportSnapshot(bytes.NewReader(madeUpSnapshot.Bytes()), "", trusted)
+	assert.EqualError(t, err, "snapshot validators do not match the trusted ones")
+	_, err = entities.ImportSnapshot(bytes.NewReader(madeUpSnapshot.Bytes()), "", entities.SnapshotTrust{TipHash: tip.Header.Hash})
+	assert.EqualError(t, err, "snapshot does not end at the trusted tip")
+	_, err = entities.ImportSnapshot(bytes.NewReader(madeUpSnapshot.Bytes()), "", entities.SnapshotTrust{})
+	assert.EqualError(t, err, "snapshot import needs trusted genesis validators or the hash of its tip")
+
+	//a chain without proof of authority can only be pinned by its tip
+	plain := entities.CreateBlockChain()
+	_, err = plain.CreateTransaction(signedUpload(t, member, "QmP"))
+	assert.Nil(t, err)
+	plainTip, err := plain.GetBlock(1)
+	assert.Nil(t, err)
+	plainSnapshot := &bytes.Buffer{}
+	assert.Nil(t, plain.ExportJSON(plainSnapshot))
+	restored, err = entities.ImportSnapshot(bytes.NewReader(plainSnapshot.Bytes()), "", entities.SnapshotTrust{TipHash: plainTip.Header.Hash})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, restored.Height())
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/keys"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveEvent(t *testing.T, sub *entities.Subscription) entities.LedgerEntry {
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event delivered")
+		return entities.LedgerEntry{}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+	blockchain := entities.CreateBlockChain()
+
+	upload := func(groupId string, handle string) string {
+		data, err := member.SignTransaction(entities.CreateUploadData(groupId, "", handle, ".txt"))
+		assert.Nil(t, err)
+		transactionID, err := blockchain.CreateTransaction(data)
+		assert.Nil(t, err)
+		return transactionID
+	}
+	first := upload("group-a", "QmA")
+
+	sub, err := blockchain.Subscribe(entities.SubscriptionFilter{GroupId: "group-a", Kinds: []entities.TransactionKind{entities.TX_FILE_UPLOADED}})
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	//history is replayed first, then new transactions arrive as they are sealed
+	event := receiveEvent(t, sub)
+	assert.Equal(t, first, event.Transaction.ID)
+	assert.Equal(t, 1, event.BlockIndex)
+
+	upload("group-b", "QmB")
+	third := upload("group-a", "QmC")
+	event = receiveEvent(t, sub)
+	assert.Equal(t, third, event.Transaction.ID)
+	assert.Equal(t, 3, event.BlockIndex)
+
+	//a consumer that restarts picks up right after the last block it handled
+	sub.Close()
+	_, open := <-sub.Events
+	assert.False(t, open)
+	fourth := upload("group-a", "QmD")
+
+	resumed, err := blockchain.Subscribe(entities.SubscriptionFilter{GroupId: "group-a", FromHeight: event.BlockIndex + 1})
+	assert.Nil(t, err)
+	defer resumed.Close()
+	event = receiveEvent(t, resumed)
+	assert.Equal(t, fourth, event.Transaction.ID)
+	select {
+	case extra := <-resumed.Events:
+		t.Fatalf("unexpected event for block %d", extra.BlockIndex)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = blockchain.Subscribe(entities.SubscriptionFilter{FromHeight: -1})
+	assert.EqualError(t, err, "height must not be negative")
+}
+
+func TestSubscriptionsRewindAcrossForkSwitches(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	member := entities.CreateAGroupMember()
+
+	a := startNode(t)
+	ours, err := a.Chain().CreateTransaction(signedUpload(t, member, "QmA"))
+	assert.Nil(t, err)
+	sub, err := a.Chain().Subscribe(entities.SubscriptionFilter{})
+	assert.Nil(t, err)
+	defer sub.Close()
+	assert.Equal(t, ours, receiveEvent(t, sub).Transaction.ID)
+
+	//every fork switch rewinds the subscription, including the ones after the fork points it passed were trimmed
+	for _, handles := range [][]string{{"QmR1", "QmR2"}, {"QmS1", "QmS2", "QmS3", "QmS4"}} {
+		rogue := startNode(t)
+		theirs := []string{}
+		for _, handle := range handles {
+			transactionID, err := rogue.Chain().CreateTransaction(signedUpload(t, member, handle))
+			assert.Nil(t, err)
+			theirs = append(theirs, transactionID)
+		}
+		assert.Nil(t, a.Connect(rogue.Addr()))
+		waitForConvergence(t, a, rogue)
+
+		delivered := map[string]bool{}
+		for _, transactionID := range theirs {
+			for !delivered[transactionID] {
+				delivered[receiveEvent(t, sub).Transaction.ID] = true
+			}
+		}
+
+		//one that starts after the switch only sees the chain as it is
+		late, err := a.Chain().Subscribe(entities.SubscriptionFilter{FromHeight: a.Chain().Height() + 1})
+		assert.Nil(t, err)
+		late.Close()
+	}
+}
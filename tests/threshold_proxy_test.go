@@ -0,0 +1,313 @@
+package tests
+
+import (
+	"blockchain-fileshare/entities"
+	"blockchain-fileshare/ipfs"
+	"blockchain-fileshare/keys"
+	"blockchain-fileshare/utils"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThresholdProxies(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	//three proxy hosts, any two of them can serve a download
+	//and keep what each of them releases to the member
+	servers := []*httptest.Server{}
+	clients := []entities.Proxy{}
+	released := [][]byte{}
+	for i := 0; i < 3; i++ {
+		proxy := entities.CreateIPFSProxy()
+		proxy.Connect(sh, blockchain)
+		proxyServer := entities.CreateProxyServer(proxy)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := httptest.NewRecorder()
+			proxyServer.ServeHTTP(recorder, r)
+			if strings.HasSuffix(r.URL.Path, "/keys") && recorder.Code == http.StatusOK {
+				message := struct {
+					EncryptedKey []byte `json:"encryptedKey"`
+				}{}
+				assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &message))
+				released = append(released, message.EncryptedKey)
+			}
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(recorder.Code)
+			w.Write(recorder.Body.Bytes())
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+		clients = append(clients, entities.CreateProxyClient(server.URL))
+	}
+	_, err := entities.CreateThresholdProxy(4, clients...)
+	assert.EqualError(t, err, "can't require 4 of 3 proxies")
+	thresholdProxy, err := entities.CreateThresholdProxy(2, clients...)
+	assert.Nil(t, err)
+	operator := entities.CreateOperator(thresholdProxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(thresholdProxy)
+	assert.NotEqual(t, "", groupUuid)
+	for _, client := range clients {
+		ownerId, err := client.OwnerOf(groupUuid)
+		assert.Nil(t, err)
+		assert.Equal(t, groupOwner.GetUuid(), ownerId)
+	}
+	assert.Nil(t, groupOwner.AddNewMemberObj(thresholdProxy, groupUuid, member))
+	assert.True(t, thresholdProxy.IsMember(groupUuid, member.GetUuid()))
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	transactionID, _, err := member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	//what the member got from each proxy is a share of that one file's data key, nothing of a key for the whole group
+	assert.Equal(t, 2, len(released))
+	memberPrivateKey, err := os.ReadFile(filepath.Join(keys.PEM_FOLDER, member.GetUuid()+"_private_key.pem"))
+	assert.Nil(t, err)
+	for _, encryptedShare := range released {
+		share, err := utils.DecryptKey(encryptedShare, memberPrivateKey)
+		assert.Nil(t, err)
+		assert.Less(t, len(share), 2*utils.DATA_KEY_SIZE)
+	}
+
+	//the proxies that released a share all recorded the same release
+	releases, err := entities.QueryAll(blockchain, entities.LedgerQuery{GroupId: groupUuid, Kinds: []entities.TransactionKind{entities.TX_KEY_RELEASED}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(releases))
+
+	//what a single proxy releases is a share, not the group key
+	singleOperator := entities.CreateOperator(clients[0], sh, blockchain)
+	_, _, err = member.DownloadFile(&singleOperator, groupUuid, transactionID)
+	assert.NotNil(t, err)
+
+	//one proxy can go down
+	servers[0].Close()
+	decryptedFilePath, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+
+	//two can't
+	servers[1].Close()
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorContains(t, err, "only 1 of the 2 proxies needed released their share")
+
+	data, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+	os.Remove(data.IPFSHash)
+}
+
+func TestThresholdProxiesOnlyGetCiphertext(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	//keep every upload a proxy is sent
+	clients := []entities.Proxy{}
+	uploads := make([][]struct {
+		Content []byte `json:"content"`
+		FileKey []byte `json:"fileKey"`
+	}, 3)
+	for i := 0; i < 3; i++ {
+		proxy := entities.CreateIPFSProxy()
+		proxy.Connect(sh, blockchain)
+		proxyServer := entities.CreateProxyServer(proxy)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/files") {
+				body, err := io.ReadAll(r.Body)
+				assert.Nil(t, err)
+				uploads[i] = append(uploads[i], struct {
+					Content []byte `json:"content"`
+					FileKey []byte `json:"fileKey"`
+				}{})
+				assert.Nil(t, json.Unmarshal(body, &uploads[i][len(uploads[i])-1]))
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			proxyServer.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		clients = append(clients, entities.CreateProxyClient(server.URL))
+	}
+	thresholdProxy, err := entities.CreateThresholdProxy(2, clients...)
+	assert.Nil(t, err)
+	operator := entities.CreateOperator(thresholdProxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(thresholdProxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(thresholdProxy, groupUuid, member))
+
+	//a proxy of the group refuses to encrypt a file itself, it would hold the whole data key
+	singleOperator := entities.CreateOperator(clients[0], sh, blockchain)
+	_, _, err = member.UploadFile(&singleOperator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.ErrorContains(t, err, "files of a threshold group have to be encrypted by the uploader")
+	uploads[0] = nil
+
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	transactionID, handle, err := member.UploadFile(&operator, &groupOwner, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+	data, err := blockchain.GetTransactionByHash(transactionID)
+	assert.Nil(t, err)
+
+	//the proxy that took the upload got the ciphertext and the data key as the ledger has it, split and wrapped for
+	//every proxy, which no proxy can open on its own
+	assert.Equal(t, 1, len(uploads[0])+len(uploads[1])+len(uploads[2]))
+	for _, sent := range uploads {
+		for _, upload := range sent {
+			assert.NotEqual(t, goldenFileBytes, upload.Content)
+			assert.False(t, bytes.Contains(upload.Content, goldenFileBytes))
+			assert.Equal(t, data.FileKey(), upload.FileKey)
+		}
+	}
+	_, _, err = member.DownloadFile(&singleOperator, groupUuid, transactionID)
+	assert.NotNil(t, err)
+
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+}
+
+func TestThresholdProxiesRevokeAndRotate(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	//proxies keep their share in their key store like they would the whole key
+	proxies := []entities.Proxy{}
+	dirs := []string{}
+	for i := 0; i < 3; i++ {
+		dir := t.TempDir()
+		proxy, err := entities.OpenIPFSProxy(dir, entities.MasterKeyFromPassphrase("passphrase"))
+		assert.Nil(t, err)
+		proxies = append(proxies, proxy)
+		dirs = append(dirs, dir)
+	}
+	thresholdProxy, err := entities.CreateThresholdProxy(2, proxies...)
+	assert.Nil(t, err)
+	operator := entities.CreateOperator(thresholdProxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(thresholdProxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(thresholdProxy, groupUuid, member))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	//revoking rotates the key on every proxy and the owner rewraps the file's data key under it
+	assert.Nil(t, groupOwner.RemoveMemberObjAndSecureFiles(&operator, groupUuid, member))
+	_, _, err = member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.ErrorIs(t, err, entities.ErrNotMember)
+
+	//after a restart the shares of the rotated key still combine
+	restarted := []entities.Proxy{}
+	for _, dir := range dirs[1:] {
+		proxy, err := entities.OpenIPFSProxy(dir, entities.MasterKeyFromPassphrase("passphrase"))
+		assert.Nil(t, err)
+		restarted = append(restarted, proxy)
+	}
+	thresholdProxy, err = entities.CreateThresholdProxy(2, restarted...)
+	assert.Nil(t, err)
+	operator = entities.CreateOperator(thresholdProxy, sh, blockchain)
+	decryptedFilePath, _, err := groupOwner.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	goldenFileBytes, err := utils.LoadRawBytesFromFile(TEST_FILEPATH)
+	assert.Nil(t, err)
+	decryptedFileRawBytes, err := utils.LoadRawBytesFromFile(decryptedFilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, goldenFileBytes, decryptedFileRawBytes)
+	os.Remove(decryptedFilePath)
+
+	latest, err := blockchain.ResolveLatestTransaction(transactionID)
+	assert.Nil(t, err)
+	data, err := blockchain.GetTransactionByHash(latest)
+	assert.Nil(t, err)
+	os.Remove(data.IPFSHash)
+}
+
+func TestThresholdProxiesEvaluateTimeWindowsAlike(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll(keys.PEM_FOLDER) })
+	groupOwner := entities.CreateAGroupOwner()
+	member := entities.CreateAGroupMember()
+
+	blockchain := entities.CreateBlockChain()
+	sh, _ := ipfs.InitIPFS()
+
+	//the second proxy only gets to a key release once the minute the request was made in is over
+	var windowEnd time.Time
+	clients := []entities.Proxy{}
+	for i := 0; i < 2; i++ {
+		proxy := entities.CreateIPFSProxy()
+		proxy.Connect(sh, blockchain)
+		proxyServer := entities.CreateProxyServer(proxy)
+		late := i == 1
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if late && strings.HasSuffix(r.URL.Path, "/keys") {
+				time.Sleep(time.Until(windowEnd.Add(200 * time.Millisecond)))
+			}
+			proxyServer.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		clients = append(clients, entities.CreateProxyClient(server.URL))
+	}
+	thresholdProxy, err := entities.CreateThresholdProxy(2, clients...)
+	assert.Nil(t, err)
+	operator := entities.CreateOperator(thresholdProxy, sh, blockchain)
+
+	groupUuid := groupOwner.RegisterNewGroup(thresholdProxy)
+	assert.Nil(t, groupOwner.AddNewMemberObj(thresholdProxy, groupUuid, member))
+	transactionID, handle, err := groupOwner.UploadFile(&operator, groupUuid, TEST_FILEPATH)
+	assert.Nil(t, err)
+	defer os.Remove(handle)
+
+	//downloads are only allowed in the current minute. The request is issued late enough in it that the late proxy
+	//does not keep the client waiting for long, and early enough that there is time left to issue it.
+	now := time.Now().UTC()
+	if now.Second() < 40 || now.Second() > 50 {
+		next := now.Truncate(time.Minute).Add(40 * time.Second)
+		if now.Second() > 50 {
+			next = next.Add(time.Minute)
+		}
+		time.Sleep(time.Until(next))
+		now = time.Now().UTC()
+	}
+	windowStart := now.Truncate(time.Minute)
+	windowEnd = windowStart.Add(time.Minute)
+	assert.Nil(t, groupOwner.SetPolicy(&operator, groupUuid, "allow hours "+windowStart.Format("15:04")+"-"+windowEnd.Format("15:04")))
+
+	//both proxies judge the request by when it was issued, so the late one does not turn it down
+	decryptedFilePath, _, err := member.DownloadFile(&operator, groupUuid, transactionID)
+	assert.Nil(t, err)
+	os.Remove(decryptedFilePath)
+	assert.True(t, time.Now().After(windowEnd))
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -23,6 +25,7 @@ const (
 	RSA_MAX_ENCRYPTION_SIZE = RSA_KEY_SIZE - RSA_PADDING_OVERHEAD
 )
 const MAX_READ_BUFFER = 32
+const DATA_KEY_SIZE = 32 //AES-256 key of a single file
 
 func SignSignature(filePath string, privateKeyBytes []byte) ([]byte, error) {
 	file, err := os.Open(filePath)
@@ -104,6 +107,36 @@ func VerifySignature(filePath string, signature []byte, publicKeyBytes []byte) (
 	return signature, nil
 }
 
+func SignBytes(data []byte, privateKeyBytes []byte) ([]byte, error) {
+	privateKeyBlock, _ := pem.Decode(privateKeyBytes)
+	if privateKeyBlock == nil {
+		return nil, errors.New("Sign Bytes | invalid private key")
+	}
+
+	privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+	if err != nil {
+		return nil, errors.New("Sign Bytes | error parsing private key")
+	}
+
+	hash := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+}
+
+func VerifyBytesSignature(data []byte, signature []byte, publicKeyBytes []byte) error {
+	publicKeyBlock, _ := pem.Decode(publicKeyBytes)
+	if publicKeyBlock == nil {
+		return errors.New("Verify Bytes | invalid public key")
+	}
+
+	publicKey, err := x509.ParsePKCS1PublicKey(publicKeyBlock.Bytes)
+	if err != nil {
+		return errors.New("Verify Bytes | error parsing public key")
+	}
+
+	hash := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature)
+}
+
 func EncryptKey(keyToBeEncryptedBytes []byte, publicKeyBytes []byte) ([]byte, error) {
 	publicKeyBlock, _ := pem.Decode(publicKeyBytes)
 	if publicKeyBlock == nil {
@@ -272,6 +305,83 @@ func DecryptFile(filePath string, privateKeyBytes []byte) (string, string, error
 	return decryptedFilePath, checksumHash, nil
 }
 
+// EncryptFileWithDataKey encrypts the file with AES-256-GCM under a new random data key and returns the data key
+// encrypted by wrapKey (usually EncryptKey with a public key) next to the name of the encrypted file and the checksum of
+// the plaintext. Whoever can decrypt the data key can decrypt this one file and nothing else.
+func EncryptFileWithDataKey(filePath string, wrapKey func(dataKey []byte) ([]byte, error)) (string, string, []byte, error) {
+	plaintext, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", "", nil, err
+	}
+	defer clear(dataKey)
+	encryptedDataKey, err := wrapKey(dataKey)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	aead, err := newFileCipher(dataKey)
+	if err != nil {
+		return "", "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", nil, err
+	}
+
+	encryptedFileName := fmt.Sprintf(`%s%s`, uuid.New().String(), filepath.Ext(filePath))
+	if err := os.WriteFile(encryptedFileName, aead.Seal(nonce, nonce, plaintext, nil), 0644); err != nil {
+		return "", "", nil, err
+	}
+
+	checksum := md5.Sum(plaintext)
+	return encryptedFileName, string(checksum[:]), encryptedDataKey, nil
+}
+
+// DecryptFileWithDataKey decrypts a file made by EncryptFileWithDataKey with its (decrypted) data key, the plaintext goes
+// next to it
+func DecryptFileWithDataKey(filePath string, dataKey []byte) (string, string, error) {
+	ciphertext, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	aead, err := newFileCipher(dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return "", "", errors.New("Decrypt File | file is too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return "", "", errors.New("Decrypt File | wrong data key or the file has been tampered with")
+	}
+
+	decryptedFilePath := fmt.Sprintf(`%s-decrypted`, filePath)
+	if err := os.WriteFile(decryptedFilePath, plaintext, 0644); err != nil {
+		return "", "", err
+	}
+
+	checksum := md5.Sum(plaintext)
+	return decryptedFilePath, string(checksum[:]), nil
+}
+
+func newFileCipher(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != DATA_KEY_SIZE {
+		return nil, errors.New("data key has the wrong size")
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 func LoadRawBytesFromFile(filePath string) ([]byte, error) {
 	file, err := os.Open(filePath)
 	if err != nil {